@@ -0,0 +1,121 @@
+package pooldap
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Transforms an AttributeMap value can name after the new key, as in
+// "enabled:bool" or "created:time".
+const (
+	// TransformBool decodes an LDAP boolean (TRUE or FALSE) or, for any other
+	// value, Active Directory userAccountControl flags, giving true unless
+	// the account is disabled.
+	TransformBool = "bool"
+	// TransformTime parses an LDAP generalized time, e.g. whenCreated, into a
+	// time.Time.
+	TransformTime = "time"
+	// TransformInt parses an integer into an int64.
+	TransformInt = "int"
+)
+
+// uacAccountDisable is the ACCOUNTDISABLE userAccountControl flag.
+const uacAccountDisable = 0x2
+
+var attributeTransforms = map[string]func(string) (interface{}, error){
+	TransformBool: transformBool,
+	TransformTime: transformTime,
+	TransformInt:  transformInt,
+}
+
+// attributeMapping returns the key GetUser stores attribute under and the
+// transform for its value, if any, from an AttributeMap entry of the form
+// "name" or "name:transform". Attributes are matched case-insensitively, as
+// config keys may have been lower-cased on the way in. An empty name keeps
+// the attribute's own.
+func (c LdapConfig) attributeMapping(attribute string) (key, transform string) {
+	for name, mapping := range c.AttributeMap {
+		if !strings.EqualFold(name, attribute) {
+			continue
+		}
+		key = mapping
+		if i := strings.LastIndexByte(mapping, ':'); i >= 0 {
+			key, transform = mapping[:i], mapping[i+1:]
+		}
+		if key == "" {
+			key = attribute
+		}
+		return key, transform
+	}
+	return attribute, ""
+}
+
+// checkAttributeMap reports an AttributeMap entry naming an unknown
+// transform.
+func (c LdapConfig) checkAttributeMap() error {
+	for attribute := range c.AttributeMap {
+		if _, transform := c.attributeMapping(attribute); transform != "" {
+			if _, ok := attributeTransforms[transform]; !ok {
+				return errors.Errorf("attribute_map %s: unknown transform %q, expected bool, time or int", attribute, transform)
+			}
+		}
+	}
+	return nil
+}
+
+// transformValue applies the named transform to value. An empty value, i.e.
+// a missing attribute, becomes nil.
+func transformValue(transform, attribute, value string) (interface{}, error) {
+	fn, ok := attributeTransforms[transform]
+	if !ok {
+		return nil, errors.Errorf("attribute %s: unknown transform %q", attribute, transform)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	v, err := fn(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "attribute %s", attribute)
+	}
+	return v, nil
+}
+
+func transformBool(value string) (interface{}, error) {
+	switch strings.ToUpper(value) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	flags, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("%q is neither a boolean nor userAccountControl flags", value)
+	}
+	return flags&uacAccountDisable == 0, nil
+}
+
+// generalizedTimeLayouts cover generalized times with seconds or only
+// minutes, in UTC or with an offset. Fractional seconds, e.g. the ".0" of
+// Active Directory, are accepted by time.Parse after the seconds.
+var generalizedTimeLayouts = []string{
+	"20060102150405Z0700",
+	"20060102150405Z07",
+	"200601021504Z0700",
+	"200601021504Z07",
+}
+
+func transformTime(value string) (interface{}, error) {
+	for _, layout := range generalizedTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return nil, errors.Errorf("%q is not a generalized time", value)
+}
+
+func transformInt(value string) (interface{}, error) {
+	return strconv.ParseInt(value, 10, 64)
+}
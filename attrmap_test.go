@@ -0,0 +1,81 @@
+package pooldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_GetUserAttributeMap(t *testing.T) {
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(append([]*ldap.EntryAttribute(nil), fakeUser.Attributes...),
+			&ldap.EntryAttribute{Name: "userAccountControl", Values: []string{"514"}},
+			&ldap.EntryAttribute{Name: "whenCreated", Values: []string{"20230102030405.0Z"}},
+			&ldap.EntryAttribute{Name: "logonCount", Values: []string{"42"}},
+			&ldap.EntryAttribute{Name: "mail", Values: []string{"fry@example.com"}},
+		),
+	}
+	config := fakeUserConfig()
+	config.Attributes = []string{"uid", "cn", "userAccountControl", "whenCreated", "logonCount", "mail"}
+	config.AttributeMap = map[string]string{
+		"useraccountcontrol": "enabled:bool",
+		"whenCreated":        "created:time",
+		"logonCount":         ":int",
+		"mail":               "email",
+	}
+	lc := newFakeClient(t, config, &fakeConn{searchFn: entriesResult(user)})
+
+	attrs, err := lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, false, attrs["enabled"])
+	assert.Equal(t, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), attrs["created"])
+	assert.Equal(t, int64(42), attrs["logonCount"])
+	assert.Equal(t, "fry@example.com", attrs["email"])
+	// unmapped attributes pass through
+	assert.Equal(t, "fry", attrs["uid"])
+	assert.Equal(t, "Philip J. Fry", attrs["cn"])
+	assert.NotContains(t, attrs, "userAccountControl")
+	assert.NotContains(t, attrs, "mail")
+}
+
+func TestTransformValue(t *testing.T) {
+	for _, tt := range []struct {
+		transform, value string
+		expected         interface{}
+	}{
+		{TransformBool, "512", true},
+		{TransformBool, "514", false},
+		{TransformBool, "TRUE", true},
+		{TransformBool, "false", false},
+		{TransformTime, "20230102030405Z", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{TransformTime, "20230102030405.250Z", time.Date(2023, 1, 2, 3, 4, 5, 250000000, time.UTC)},
+		{TransformTime, "202301020304-0500", time.Date(2023, 1, 2, 3, 4, 0, 0, time.FixedZone("", -5*3600))},
+		{TransformInt, "-7", int64(-7)},
+		{TransformInt, "", nil},
+	} {
+		v, err := transformValue(tt.transform, "attr", tt.value)
+		require.NoError(t, err, "%s %s", tt.transform, tt.value)
+		if expected, ok := tt.expected.(time.Time); ok {
+			assert.True(t, expected.Equal(v.(time.Time)), "%s %s: %v", tt.transform, tt.value, v)
+			continue
+		}
+		assert.Equal(t, tt.expected, v, "%s %s", tt.transform, tt.value)
+	}
+
+	for _, tt := range [][2]string{{TransformBool, "yes"}, {TransformTime, "yesterday"}, {TransformInt, "1.5"}} {
+		_, err := transformValue(tt[0], "attr", tt[1])
+		assert.Error(t, err, "%s %s", tt[0], tt[1])
+	}
+}
+
+func TestLdapConfig_ValidateAttributeMap(t *testing.T) {
+	config := LdapConfig{Host: "ldap", Port: 389, Base: "dc=example,dc=com", UserFilter: "(uid=%s)"}
+	config.AttributeMap = map[string]string{"whenCreated": "created:time"}
+	assert.NoError(t, config.Validate())
+	config.AttributeMap = map[string]string{"whenCreated": "created:date"}
+	assert.Error(t, config.Validate())
+}
@@ -0,0 +1,51 @@
+package pooldap
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ldap.v2"
+)
+
+// BindEvent describes one attempt to authenticate a user, for audit logging.
+// It never carries the password.
+type BindEvent struct {
+	Time     time.Time
+	Username string
+	// DN is the user's entry DN, empty if the user wasn't found.
+	DN string
+	// Mechanism is "simple" or the SASL mechanism used.
+	Mechanism string
+	Success   bool
+	// ResultCode is the LDAP result code of the bind, 0 on success or when
+	// the attempt failed before a bind was sent.
+	ResultCode uint16
+	// Err is why the attempt failed, nil on success.
+	Err error
+}
+
+// auditBind reports an authentication attempt to the bind hook, if one is
+// set.
+func (lc *Client) auditBind(username, mechanism string, userAttributes map[string]interface{}, err error) {
+	if lc.onBind == nil {
+		return
+	}
+	event := BindEvent{
+		Time:      time.Now(),
+		Username:  username,
+		Mechanism: mechanism,
+		Success:   err == nil,
+		Err:       err,
+	}
+	if dn, ok := userAttributes[lc.Config.dnKey()].(string); ok {
+		event.DN = dn
+	}
+	var bindErr *BindError
+	var ldapErr *ldap.Error
+	if errors.As(err, &bindErr) {
+		event.ResultCode = bindErr.Code
+	} else if errors.As(err, &ldapErr) {
+		event.ResultCode = uint16(ldapErr.ResultCode)
+	}
+	lc.onBind(event)
+}
@@ -0,0 +1,51 @@
+package pooldap
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_BindHook(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		bindFn: func(username, password string) error {
+			if password != "fry" {
+				return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+			}
+			return nil
+		},
+	}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+	var events []BindEvent
+	WithBindHook(func(e BindEvent) { events = append(events, e) })(lc)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	valid, _, err = lc.Authenticate("fry", "slurm")
+	assert.Error(t, err)
+	assert.False(t, valid)
+
+	require.Len(t, events, 2)
+	assert.True(t, events[0].Success)
+	assert.Equal(t, "fry", events[0].Username)
+	assert.Equal(t, fakeUser.DN, events[0].DN)
+	assert.Equal(t, "simple", events[0].Mechanism)
+	assert.Equal(t, uint16(0), events[0].ResultCode)
+	assert.False(t, events[0].Time.IsZero())
+	assert.NoError(t, events[0].Err)
+
+	assert.False(t, events[1].Success)
+	assert.Equal(t, fakeUser.DN, events[1].DN)
+	assert.Equal(t, uint16(ldap.LDAPResultInvalidCredentials), events[1].ResultCode)
+	assert.Error(t, events[1].Err)
+
+	for _, e := range events {
+		assert.NotContains(t, fmt.Sprintf("%+v", e), "slurm")
+	}
+}
@@ -0,0 +1,72 @@
+package pooldap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BatchError collects the per-user errors of a batch lookup, keyed by username.
+type BatchError map[string]error
+
+func (e BatchError) Error() string {
+	usernames := make([]string, 0, len(e))
+	for username := range e {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	messages := make([]string, 0, len(e))
+	for _, username := range usernames {
+		messages = append(messages, fmt.Sprintf("%s: %s", username, e[username]))
+	}
+	return fmt.Sprintf("%d lookups failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// GetUsersGroupsBatch runs GetUserGroups for every username using at most
+// concurrency goroutines, further capped at the search pool's maximum size.
+// Groups are returned for every user that succeeded; if any lookup failed the
+// error is a BatchError holding each failure.
+func (lc *Client) GetUsersGroupsBatch(usernames []string, concurrency int) (map[string]map[string]string, error) {
+	if max := lc.poolSettings.maxSearchConns; max > 0 && (concurrency <= 0 || concurrency > max) {
+		concurrency = max
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]map[string]string, len(usernames))
+		errs    = make(BatchError)
+		work    = make(chan string)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for username := range work {
+				groups, err := lc.GetUserGroups(username)
+				mu.Lock()
+				if err != nil {
+					errs[username] = err
+				} else {
+					results[username] = groups
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, username := range usernames {
+		work <- username
+	}
+	close(work)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
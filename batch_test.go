@@ -0,0 +1,36 @@
+package pooldap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_GetUsersGroupsBatch(t *testing.T) {
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.Contains(req.Filter, "ghost") {
+			return &ldap.SearchResult{}, nil
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+	}}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	var usernames []string
+	for i := 0; i < 40; i++ {
+		usernames = append(usernames, fmt.Sprintf("user%d", i))
+	}
+	usernames = append(usernames, "ghost1", "ghost2")
+
+	results, err := lc.GetUsersGroupsBatch(usernames, 3)
+	require.Error(t, err)
+	assert.Len(t, results, 40)
+
+	batchErr, ok := err.(BatchError)
+	require.True(t, ok)
+	assert.Len(t, batchErr, 2)
+	assert.Equal(t, ErrNotFound, batchErr["ghost1"])
+}
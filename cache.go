@@ -0,0 +1,97 @@
+package pooldap
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCache holds GetUserGroups results by username for a fixed TTL. When
+// it holds maxSize entries, adding one evicts the entry closest to expiry.
+type groupCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	entries map[string]groupCacheEntry
+}
+
+type groupCacheEntry struct {
+	groups  map[string]string
+	expires time.Time
+}
+
+func newGroupCache(ttl time.Duration, maxSize int) *groupCache {
+	return &groupCache{ttl: ttl, maxSize: maxSize, entries: make(map[string]groupCacheEntry)}
+}
+
+// get returns a copy of the cached groups of username, if they haven't expired.
+func (gc *groupCache) get(username string) (map[string]string, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	entry, ok := gc.entries[username]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(gc.entries, username)
+		return nil, false
+	}
+	return copyGroups(entry.groups), true
+}
+
+func (gc *groupCache) set(username string, groups map[string]string) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if _, ok := gc.entries[username]; !ok && gc.maxSize > 0 && len(gc.entries) >= gc.maxSize {
+		gc.evictLocked()
+	}
+	gc.entries[username] = groupCacheEntry{groups: copyGroups(groups), expires: time.Now().Add(gc.ttl)}
+}
+
+func (gc *groupCache) invalidate(username string) {
+	gc.mu.Lock()
+	delete(gc.entries, username)
+	gc.mu.Unlock()
+}
+
+// evictLocked removes the entry closest to expiry. gc.mu must be held.
+func (gc *groupCache) evictLocked() {
+	var (
+		oldest  string
+		expires time.Time
+	)
+	for username, entry := range gc.entries {
+		if expires.IsZero() || entry.expires.Before(expires) {
+			oldest, expires = username, entry.expires
+		}
+	}
+	delete(gc.entries, oldest)
+}
+
+func copyGroups(groups map[string]string) map[string]string {
+	c := make(map[string]string, len(groups))
+	for name, dn := range groups {
+		c[name] = dn
+	}
+	return c
+}
+
+// groups returns the Client's group cache, or nil if Config.GroupCacheTTL is
+// not set.
+func (lc *Client) groups() *groupCache {
+	if lc.Config.GroupCacheTTL <= 0 {
+		return nil
+	}
+	lc.groupCacheOnce.Do(func() {
+		lc.groupCache = newGroupCache(lc.Config.GroupCacheTTL, lc.Config.GroupCacheSize)
+	})
+	return lc.groupCache
+}
+
+// InvalidateGroups drops the cached groups of username so that the next
+// GetUserGroups queries the directory, e.g. after a membership change.
+// Usernames are compared as by GetUserGroups.
+func (lc *Client) InvalidateGroups(username string) {
+	if cache := lc.groups(); cache != nil {
+		cache.invalidate(lc.Config.usernameKey(username))
+	}
+}
@@ -0,0 +1,78 @@
+package pooldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGroupCacheClient(t *testing.T, ttl time.Duration, size int) (*Client, *fakeConn) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.GroupCacheTTL = ttl
+	config.GroupCacheSize = size
+	return newFakeClient(t, config, conn), conn
+}
+
+func TestClient_GroupCacheHit(t *testing.T) {
+	lc, conn := newGroupCacheClient(t, time.Hour, 0)
+
+	groups, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 2)
+
+	groups["ship_crew"] = "cn=ship_crew,dc=example,dc=com"
+	cached, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 2)
+	assert.NotContains(t, cached, "ship_crew")
+
+	_, err = lc.GetUserGroups("leela")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 4)
+}
+
+func TestClient_GroupCacheExpiry(t *testing.T) {
+	lc, conn := newGroupCacheClient(t, 20*time.Millisecond, 0)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	time.Sleep(30 * time.Millisecond)
+	_, err = lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 4)
+}
+
+func TestClient_GroupCacheInvalidate(t *testing.T) {
+	lc, conn := newGroupCacheClient(t, time.Hour, 0)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	lc.InvalidateGroups("fry")
+	_, err = lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 4)
+}
+
+func TestClient_GroupCacheSize(t *testing.T) {
+	lc, conn := newGroupCacheClient(t, time.Hour, 1)
+
+	for _, username := range []string{"fry", "leela", "fry"} {
+		_, err := lc.GetUserGroups(username)
+		require.NoError(t, err)
+	}
+	assert.Len(t, conn.searches, 6)
+}
+
+func TestClient_GroupCacheDisabled(t *testing.T) {
+	lc, conn := newGroupCacheClient(t, 0, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := lc.GetUserGroups("fry")
+		require.NoError(t, err)
+	}
+	assert.Len(t, conn.searches, 4)
+	lc.InvalidateGroups("fry")
+}
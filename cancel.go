@@ -0,0 +1,101 @@
+package pooldap
+
+import (
+	"context"
+
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// ExtendedOperationCancel is the OID of the Cancel extended operation
+// (RFC 3909).
+const ExtendedOperationCancel = "1.3.6.1.1.8"
+
+// Result codes of the Cancel operation (RFC 3909), which the ldap package
+// does not define.
+const (
+	LDAPResultCanceled        = 118
+	LDAPResultNoSuchOperation = 119
+	LDAPResultTooLate         = 120
+	LDAPResultCannotCancel    = 121
+)
+
+// ContextSearcher is implemented by connections that can cancel a search in
+// flight. When ctx is done before the result is in, SearchContext should
+// send a Cancel request, see NewCancelRequest, for the search's message ID
+// and return ctx.Err() once the search has ended, leaving the connection
+// usable, or closing it if the server wouldn't cancel. The connections
+// DefaultDialer and NetDialer return implement it; with others, a search
+// that was sent runs to completion even if its context is cancelled.
+type ContextSearcher interface {
+	SearchContext(ctx context.Context, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+// NewCancelRequest returns the extended request asking the server to stop
+// processing the operation with messageID. The server answers the cancelled
+// operation with LDAPResultCanceled and the Cancel itself with success, or
+// with LDAPResultNoSuchOperation or LDAPResultTooLate if there was nothing
+// left to cancel.
+func NewCancelRequest(messageID int64) *ber.Packet {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Cancel Extended Operation")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, ExtendedOperationCancel, "Extended Request Name: Cancel OID"))
+	value := ber.Encode(ber.ClassContext, ber.TypePrimitive, 1, nil, "Extended Request Value: Cancel Request")
+	cancelRequest := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Cancel Request")
+	cancelRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Cancel ID"))
+	value.AppendChild(cancelRequest)
+	request.AppendChild(value)
+	return request
+}
+
+// SearchContext runs searchRequest and, if ctx is done first, cancels it on
+// the server and waits for it to end. If the server can't cancel it, the
+// connection is closed instead, as the search would keep it busy.
+func (c *stateConn) SearchContext(ctx context.Context, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if ctx.Done() == nil {
+		return c.Search(searchRequest)
+	}
+	c.searchMu.Lock()
+	defer c.searchMu.Unlock()
+	type result struct {
+		sr  *ldap.SearchResult
+		err error
+	}
+	ids := c.mux.watchSearch()
+	done := make(chan result, 1)
+	go func() {
+		sr, err := c.Search(searchRequest)
+		done <- result{sr, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.sr, r.err
+	case <-ctx.Done():
+	}
+	var id int64
+	select {
+	case id = <-ids:
+	case r := <-done:
+		// it ended before it was even sent
+		return r.sr, r.err
+	}
+	if err := c.cancel(id); err != nil {
+		c.Close()
+	}
+	<-done
+	return nil, ctx.Err()
+}
+
+// cancel asks the server to stop processing the operation with messageID.
+// That it ended already is no error.
+func (c *stateConn) cancel(messageID int64) error {
+	response, err := c.mux.request(NewCancelRequest(messageID), nil, c.requestTimeout())
+	if err != nil {
+		return err
+	}
+	err = resultError(response)
+	if ldap.IsErrorWithCode(err, LDAPResultTooLate) || ldap.IsErrorWithCode(err, LDAPResultNoSuchOperation) {
+		return nil
+	}
+	return err
+}
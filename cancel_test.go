@@ -0,0 +1,155 @@
+package pooldap
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+func TestNewCancelRequest(t *testing.T) {
+	request := ber.DecodePacket(NewCancelRequest(7).Bytes())
+	assert.Equal(t, ber.ClassApplication, request.ClassType)
+	assert.Equal(t, ber.Tag(ldap.ApplicationExtendedRequest), request.Tag)
+	require.Len(t, request.Children, 2)
+	assert.Equal(t, ber.Tag(0), request.Children[0].Tag)
+	assert.Equal(t, ExtendedOperationCancel, request.Children[0].Data.String())
+	assert.Equal(t, ber.Tag(1), request.Children[1].Tag)
+	assert.Equal(t, int64(7), cancelID(request))
+}
+
+// cancelID returns the message ID a Cancel request op is for.
+func cancelID(op *ber.Packet) int64 {
+	value := ber.DecodePacket(op.Children[1].Data.Bytes())
+	return value.Children[0].Value.(int64)
+}
+
+// slowServer answers searches of the root DSE at once and holds others until
+// they are cancelled, answering the Cancel with cancelCode.
+func slowServer(cancelCode int, started chan<- int64) func(s *ldapServer, request *ber.Packet) {
+	return func(s *ldapServer, request *ber.Packet) {
+		op := protocolOp(request)
+		switch op.Tag {
+		case ldap.ApplicationSearchRequest:
+			if op.Children[0].Value.(string) == "" {
+				answerSearch(s, request)
+				return
+			}
+			started <- messageID(request)
+		case ldap.ApplicationExtendedRequest:
+			if cancelCode == ldap.LDAPResultSuccess {
+				s.reply(cancelID(op), ldapResult(ldap.ApplicationSearchResultDone, LDAPResultCanceled, ""))
+			}
+			s.reply(messageID(request), ldapResult(ldap.ApplicationExtendedResponse, cancelCode, ""))
+		}
+	}
+}
+
+// serverDialer dials ldapServers answering with handle.
+type serverDialer struct {
+	t       *testing.T
+	handle  func(s *ldapServer, request *ber.Packet)
+	servers chan *ldapServer
+}
+
+func (d *serverDialer) Dial(network, addr string) (ldap.Client, error) {
+	conn, server := serveLDAP(d.t, d.handle)
+	d.servers <- server
+	return conn, nil
+}
+
+func (d *serverDialer) DialTLS(network, addr string, config *tls.Config) (ldap.Client, error) {
+	return d.Dial(network, addr)
+}
+
+func TestClient_SearchContextCancel(t *testing.T) {
+	started := make(chan int64, 1)
+	dialer := &serverDialer{t: t, handle: slowServer(ldap.LDAPResultSuccess, started), servers: make(chan *ldapServer, 1)}
+	lc, err := NewClient(dialerTestConfig(), 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+	server := <-dialer.servers
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var searchID int64
+	go func() {
+		searchID = <-started
+		cancel()
+	}()
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=*)", nil, nil)
+	_, err = lc.SearchContext(ctx, req)
+	assert.Equal(t, context.Canceled, err)
+
+	// the server was asked to cancel the search
+	requests := server.received()
+	cancelRequest := protocolOp(requests[len(requests)-1])
+	assert.Equal(t, ber.Tag(ldap.ApplicationExtendedRequest), cancelRequest.Tag)
+	assert.Equal(t, ExtendedOperationCancel, cancelRequest.Children[0].Data.String())
+	assert.Equal(t, searchID, cancelID(cancelRequest))
+
+	// which leaves the connection usable
+	assert.Equal(t, 1, lc.searchPool.Len())
+	conn, err := lc.SearchConn()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Search(ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+	assert.NoError(t, err)
+}
+
+func TestClient_SearchContextCancelRefused(t *testing.T) {
+	started := make(chan int64, 1)
+	dialer := &serverDialer{t: t, handle: slowServer(ldap.LDAPResultProtocolError, started), servers: make(chan *ldapServer, 2)}
+	lc, err := NewClient(dialerTestConfig(), 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+	lc.searchPool.(*channelPool).AliveChecks(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=*)", nil, nil)
+	_, err = lc.SearchContext(ctx, req)
+	assert.Equal(t, context.Canceled, err)
+
+	// the connection, still busy with the search, was replaced
+	assert.Equal(t, 1, lc.searchPool.Len())
+	assert.Len(t, dialer.servers, 2)
+}
+
+// contextSearcher records the context its searches run with.
+type contextSearcher struct {
+	fakeConn
+	ctx context.Context
+}
+
+func (c *contextSearcher) SearchContext(ctx context.Context, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.ctx = ctx
+	return c.Search(req)
+}
+
+func TestPoolConn_SearchContext(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+
+	// the context reaches connections that can cancel the search
+	searcher := &contextSearcher{fakeConn: fakeConn{searchFn: entriesResult(fakeUser)}}
+	pool := &channelPool{parentClient: &Client{}}
+	_, err := pool.wrapConn(searcher, nil).SearchContext(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, ctx, searcher.ctx)
+	assert.Len(t, searcher.searches, 1)
+
+	// others run a plain search
+	plain := &fakeConn{searchFn: entriesResult(fakeUser)}
+	_, err = pool.wrapConn(plain, nil).SearchContext(ctx, req)
+	require.NoError(t, err)
+	assert.Len(t, plain.searches, 1)
+}
@@ -1,9 +1,11 @@
 package pooldap
 
 import (
+	"context"
 	"errors"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"sync/atomic"
 
 	"gopkg.in/ldap.v2"
 	"time"
@@ -11,6 +13,17 @@ import (
 
 type PoolType int
 
+func (t PoolType) String() string {
+	switch t {
+	case SharedPool:
+		return "shared"
+	case BindPool:
+		return "bind"
+	default:
+		return "unknown"
+	}
+}
+
 const (
 	// Shared is for searching the directory.
 	// Factory connections will be bound on initializaytion
@@ -21,6 +34,10 @@ const (
 
 // channelPool implements the Pool interface based on buffered channels.
 type channelPool struct {
+	// number of idle connections in conns, kept first for 64-bit atomic
+	// alignment so that Len doesn't need the mutex
+	idle int64
+
 	// storage for our net.Conn connections
 	mu    sync.Mutex
 	conns chan ldap.Client
@@ -28,8 +45,33 @@ type channelPool struct {
 	name        string
 	aliveChecks bool
 
+	// connections created by the pool and not yet closed, idle or not
+	open int
+
+	// factory failures, split by whether dialing or binding failed
+	dialErrors uint64
+	bindErrors uint64
+
+	// allow Get to open connections beyond the idle ones, up to maxConnections;
+	// always set when fewer connections may be idle than open
+	allowOverflow bool
+
+	// FIFO queue of goroutines blocked in Get, used when fairQueue is set
+	fairQueue bool
+	waiters   []chan ldap.Client
+
+	// per-connection bookkeeping, kept when any of these limits is set
+	maxUses     int
+	maxLifetime time.Duration
+	maxIdleTime time.Duration
+	info        map[ldap.Client]*connInfo
+
+	// bumped by Reset; connections created before it are retired
+	generation int
+
 	// net.Conn generator
 	factory PoolFactory
+	// result codes that retire a connection, replaced as a whole by SetCloseAt
 	closeAt []uint8
 
 	//Parent
@@ -47,6 +89,29 @@ type channelPool struct {
 
 	// Refill Timer
 	refreshInterval time.Duration
+	// probe refilled connections before they enter the pool
+	refillProbe bool
+	// the factory leaves connections unbound and Get binds them
+	lazyBind bool
+	// the initial fill tolerates failures as long as one connection binds
+	requireInitial bool
+	// connections the initial fill dials at a time
+	warmupConcurrency int
+
+	// closed once the initial connections have been created
+	warmedUp chan struct{}
+	// why the warm-up stopped early, readable once warmedUp is closed
+	warmupErr error
+}
+
+// connInfo is what the pool knows about one of its connections.
+type connInfo struct {
+	uses       int
+	createdAt  time.Time
+	idleSince  time.Time
+	generation int
+	// created without the service bind, which happens on first Get
+	unbound bool
 }
 
 // PoolFactory is a function to create new connections.
@@ -63,37 +128,170 @@ type PoolFactory func(*Client, PoolType) (ldap.Client, error)
 // of the call is one of those passed, most likely you want to set this to something
 // like
 //   []uint8{ldap.LDAPResultTimeLimitExceeded, ldap.ErrorNetwork}
+//
+// Config.MaxOpenConns replaces maxCap as the limit on open connections and
+// Config.MaxIdleConns limits how many of them are kept idle; connections
+// returned beyond that are closed. A pool with fewer idle than open
+// connections allowed opens new ones in Get as if AllowOverflow were set, and
+// is filled initially with at most MaxIdleConns.
 func NewChannelPool(initialCap, maxCap int, poolType PoolType, factory PoolFactory, client *Client, closeAt []uint8, refreshInterval time.Duration) (Pool, error) {
-	if initialCap < 0 || maxCap <= 0 || initialCap > maxCap {
+	maxOpen, maxIdle := maxCap, 0
+	if client != nil {
+		if client.Config.MaxOpenConns > 0 {
+			maxOpen = client.Config.MaxOpenConns
+		}
+		maxIdle = client.Config.MaxIdleConns
+	}
+	if maxIdle <= 0 || maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	if initialCap < 0 || maxOpen <= 0 || initialCap > maxOpen {
 		return nil, errors.New("invalid capacity settings")
 	}
+	if initialCap > maxIdle {
+		initialCap = maxIdle
+	}
 
 	c := &channelPool{
-		conns:              make(chan ldap.Client, maxCap),
+		conns:              make(chan ldap.Client, maxIdle),
 		poolType:           poolType,
 		factory:            factory,
 		closeAt:            closeAt,
 		aliveChecks:        true,
 		parentClient:       client,
 		initialConnections: initialCap,
-		maxConnections:     maxCap,
+		maxConnections:     maxOpen,
+		allowOverflow:      maxIdle < maxOpen,
 		refreshInterval:    refreshInterval,
+		info:               make(map[ldap.Client]*connInfo),
+		warmedUp:           make(chan struct{}),
+	}
+	if client != nil {
+		c.fairQueue = client.Config.FairQueue
+		c.allowOverflow = c.allowOverflow || client.Config.AllowOverflow
+		c.maxUses = client.Config.MaxUsesPerConn
+		c.maxLifetime = client.Config.MaxConnLifetime
+		c.maxIdleTime = client.Config.MaxConnIdleTime
+		c.refillProbe = client.Config.RefillProbe
+		c.lazyBind = client.Config.LazyBind && (poolType == SharedPool || client.Config.BindPoolAsService)
+		c.requireInitial = client.Config.RequireInitialConnection
+		c.warmupConcurrency = client.Config.WarmupConcurrency
+	}
+
+	if client != nil && client.asyncWarmup {
+		go c.warmup()
+		return c, nil
 	}
 
 	// create initial connections, if something goes wrong,
 	// just close the pool error out.
-	for i := 0; i < initialCap; i++ {
-		conn, err := factory(c.parentClient, c.poolType)
-		if err != nil {
-			c.Close()
-			return nil, errors.New("factory is not able to fill the pool: " + err.Error())
-		}
-		c.conns <- conn
+	if err := c.fill(context.Background()); err != nil {
+		c.Close()
+		return nil, errors.New("factory is not able to fill the pool: " + err.Error())
 	}
+	close(c.warmedUp)
 
 	return c, nil
 }
 
+// warmup fills the pool up to its initial capacity in the background. Unlike
+// the synchronous fill, a factory error is only logged and ends the warm-up.
+// It stops early once the parent client's warm-up context is done.
+func (c *channelPool) warmup() {
+	defer close(c.warmedUp)
+	ctx := context.Background()
+	if c.parentClient != nil && c.parentClient.warmupCtx != nil {
+		ctx = c.parentClient.warmupCtx
+	}
+	if err := c.fill(ctx); err != nil && err != ErrClosed {
+		c.GetLogger().Errorf("factory is not able to warm up the pool: %s", err.Error())
+		c.warmupErr = err
+	}
+}
+
+// fill creates the initial connections, stopping at the first factory error.
+// With Config.RequireInitialConnection it instead carries on past failures
+// and only fails if no connection at all could be opened, opening one even
+// when initialCap is zero; the first connection is bound right away even with
+// LazyBind so a bad service account is caught here. Up to
+// Config.WarmupConcurrency connections are dialed at a time; after an error
+// that ends the fill, no new dials start and those in flight still join the
+// pool.
+func (c *channelPool) fill(ctx context.Context) error {
+	n := c.initialConnections
+	if c.requireInitial && n == 0 {
+		n = 1
+	}
+	workers := c.warmupConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		mu            sync.Mutex
+		next, opened  int
+		fatal, failed error
+		wg            sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if next >= n || fatal != nil || ctx.Err() != nil {
+					mu.Unlock()
+					return
+				}
+				next++
+				i, first := next, opened == 0
+				mu.Unlock()
+
+				conn, err := c.openFillConn()
+				if err == nil && c.requireInitial && c.lazyBind && first {
+					if err = c.serviceBind(conn); err != nil {
+						c.closeConn(conn)
+					}
+				}
+				mu.Lock()
+				switch {
+				case err == nil:
+					opened++
+				case err == ErrClosed || !c.requireInitial:
+					if fatal == nil {
+						fatal = err
+					}
+				default:
+					c.GetLogger().Warnf("could not open initial connection %d of %d: %s", i, n, err.Error())
+					failed = err
+				}
+				mu.Unlock()
+				if err == nil {
+					c.put(conn)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fatal != nil {
+		return fatal
+	}
+	if opened == 0 && failed != nil {
+		return errors.New("no initial connection could be opened: " + failed.Error())
+	}
+	return nil
+}
+
+// WarmedUp returns a channel that is closed once the initial connections
+// have been created.
+func (c *channelPool) WarmedUp() <-chan struct{} {
+	return c.warmedUp
+}
+
 func (c *channelPool) AliveChecks(on bool) {
 	c.mu.Lock()
 	c.aliveChecks = on
@@ -109,28 +307,130 @@ func (c *channelPool) getConns() chan ldap.Client {
 
 // Get implements the Pool interfaces Get() method. If there is no new
 // connection available in the pool, a new connection will be created via the
-// Factory() method.
+// Factory() method. With Config.LazyBind the connection is bound as the
+// service account here, the first time it is handed out.
 func (c *channelPool) Get() (*PoolConn, error) {
+	return c.GetContext(context.Background())
+}
+
+// GetContext is Get that gives up with ctx.Err() once ctx is done while it
+// waits for an idle connection, leaving the wait queue at once.
+func (c *channelPool) GetContext(ctx context.Context) (*PoolConn, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.lazyBind {
+		if err := c.bindLazily(conn); err != nil {
+			return nil, err
+		}
+	}
+	if c.parentClient != nil && c.parentClient.Config.DetectLeaks {
+		c.watchLeak(conn, c.parentClient.Config.LeakThreshold)
+	}
+	return conn, nil
+}
+
+func (c *channelPool) get(ctx context.Context) (*PoolConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	conns := c.getConns()
 	if conns == nil {
 		return nil, ErrClosed
 	}
 
+	if c.allowOverflow && len(conns) == 0 {
+		conn, err := c.openConn(true)
+		if err == nil {
+			return c.wrapConn(conn, c.CloseAt()), nil
+		}
+		if err != ErrPoolFull {
+			return nil, err
+		}
+	}
+
+	var conn ldap.Client
+	if c.fairQueue {
+		var err error
+		if conn, err = c.getFair(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		select {
+		case conn = <-conns:
+			if conn != nil {
+				atomic.AddInt64(&c.idle, -1)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	// wrap our connections with our ldap.Client implementation (wrapConn
 	// method) that puts the connection back to the pool if it's closed.
+	if conn == nil {
+		return nil, ErrClosed
+	}
+	if c.expired(conn) {
+		c.GetLogger().Debugf("connection expired")
+	} else if !c.aliveChecks || isAlive(conn) {
+		return c.wrapConn(conn, c.CloseAt()), nil
+	} else {
+		c.GetLogger().Debugf("connection dead")
+	}
+
+	c.closeConn(conn)
+	return c.NewConn()
+}
+
+// getFair takes an idle connection only if nobody is queued ahead of the
+// caller, otherwise it joins the back of the waiter queue. put hands returned
+// connections to the oldest waiter first. A nil result means the pool closed.
+// When ctx is done first the caller leaves the queue, passing on a connection
+// handed to it meanwhile.
+func (c *channelPool) getFair(ctx context.Context) (ldap.Client, error) {
+	c.mu.Lock()
+	if c.conns == nil {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	if len(c.waiters) == 0 {
+		select {
+		case conn := <-c.conns:
+			atomic.AddInt64(&c.idle, -1)
+			c.mu.Unlock()
+			return conn, nil
+		default:
+		}
+	}
+	waiter := make(chan ldap.Client, 1)
+	c.waiters = append(c.waiters, waiter)
+	c.mu.Unlock()
+
 	select {
-	case conn := <-conns:
-		if conn == nil {
-			return nil, ErrClosed
+	case conn := <-waiter:
+		return conn, nil
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	queued := false
+	for i, w := range c.waiters {
+		if w == waiter {
+			c.waiters = append(c.waiters[:i:i], c.waiters[i+1:]...)
+			queued = true
+			break
 		}
-		if !c.aliveChecks || isAlive(conn) {
-			return c.wrapConn(conn, c.closeAt), nil
+	}
+	c.mu.Unlock()
+	if !queued {
+		// put or Close got to the waiter first
+		if conn := <-waiter; conn != nil {
+			c.put(conn)
 		}
-
-		c.GetLogger().Infof("connection dead")
-		conn.Close()
-		return c.NewConn()
 	}
+	return nil, ctx.Err()
 }
 
 func isAlive(conn ldap.Client) bool {
@@ -139,12 +439,224 @@ func isAlive(conn ldap.Client) bool {
 }
 
 func (c *channelPool) NewConn() (*PoolConn, error) {
-	conn, err := c.factory(c.parentClient, c.poolType)
+	conn, err := c.newConn()
 	if err != nil {
+		return nil, err
+	}
+	return c.wrapConn(conn, c.CloseAt()), nil
+}
+
+// newConn is openConn for a connection that takes the place of one that was
+// closed, logging why it could not be opened.
+func (c *channelPool) newConn() (ldap.Client, error) {
+	conn, err := c.openConn(false)
+	if err != nil && err != ErrClosed {
 		c.GetLogger().Errorf("failed to create NewConn for pooldap.channelPool %s", err.Error())
+	}
+	return conn, err
+}
+
+// replace puts a new connection in the pool in place of one that was closed.
+func (c *channelPool) replace() {
+	if conn, err := c.newConn(); err == nil {
+		c.put(conn)
+	}
+}
+
+// openFillConn is openConn for filling the pool up to its initial capacity.
+// While the directory answers LDAPResultBusy or LDAPResultUnavailable, e.g.
+// during maintenance, it retries up to Config.BusyRetries times, waiting
+// Config.BusyBackoff before the first retry and doubling it each time.
+func (c *channelPool) openFillConn() (conn ldap.Client, err error) {
+	var retries int
+	var backoff time.Duration
+	if c.parentClient != nil {
+		retries, backoff = c.parentClient.Config.BusyRetries, c.parentClient.Config.BusyBackoff
+	}
+	retryWithBackoff(retries, backoff, func(attempt int) error {
+		conn, err = c.openConn(false)
+		if err == nil || !isBusy(err) {
+			return nil
+		}
+		if attempt < retries {
+			c.GetLogger().Warnf("directory busy, retrying connection: %s", err.Error())
+		}
+		return err
+	})
+	return
+}
+
+// isBusy reports whether err carries LDAPResultBusy or LDAPResultUnavailable,
+// which servers return for a while instead of closing the connection.
+func isBusy(err error) bool {
+	var ldapErr *ldap.Error
+	return errors.As(err, &ldapErr) &&
+		(ldapErr.ResultCode == ldap.LDAPResultBusy || ldapErr.ResultCode == ldap.LDAPResultUnavailable)
+}
+
+// ErrPoolFull is returned when the pool already has maxConnections open.
+var ErrPoolFull = errors.New("pool has reached its maximum connections")
+
+// openConn creates a connection with the factory and counts it as open. With
+// capped set it fails with ErrPoolFull instead of exceeding maxConnections.
+func (c *channelPool) openConn(capped bool) (ldap.Client, error) {
+	c.mu.Lock()
+	factory := c.factory
+	if factory == nil {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if capped && c.open >= c.maxConnections {
+		c.mu.Unlock()
+		return nil, ErrPoolFull
+	}
+	c.open++
+	// a Reset while the factory runs, e.g. to rotate credentials, makes
+	// this connection stale
+	generation := c.generation
+	c.mu.Unlock()
+
+	conn, err := factory(c.parentClient, c.poolType)
+	if err != nil {
+		c.mu.Lock()
+		c.open--
+		if isBindFailure(err) {
+			c.bindErrors++
+		} else {
+			c.dialErrors++
+		}
+		c.mu.Unlock()
 		return nil, err
 	}
-	return c.wrapConn(conn, c.closeAt), nil
+	c.mu.Lock()
+	info := c.infoLocked(conn)
+	info.unbound = c.lazyBind
+	info.generation = generation
+	c.mu.Unlock()
+	return conn, nil
+}
+
+// requestTimeout is the timeout connections of this pool start a checkout
+// with, Config.RequestTimeout of the parent client.
+func (c *channelPool) requestTimeout() time.Duration {
+	if c.parentClient == nil {
+		return 0
+	}
+	return c.parentClient.Config.RequestTimeout
+}
+
+// bindLazily binds conn as the service account if it was created unbound.
+// A connection that fails to bind is closed.
+func (c *channelPool) bindLazily(conn *PoolConn) error {
+	c.mu.Lock()
+	info, ok := c.info[conn.Conn]
+	unbound := ok && info.unbound
+	c.mu.Unlock()
+	if !unbound {
+		return nil
+	}
+	if err := c.serviceBind(conn.Conn); err != nil {
+		c.closeConn(conn.Conn)
+		return err
+	}
+	return nil
+}
+
+// serviceBind binds conn as the service account and records that it is no
+// longer unbound.
+func (c *channelPool) serviceBind(conn ldap.Client) error {
+	if err := c.parentClient.serviceBind(conn); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if info, ok := c.info[conn]; ok {
+		info.unbound = false
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// isBindFailure reports whether a factory error came from binding the new
+// connection rather than from dialing it.
+func isBindFailure(err error) bool {
+	var bindErr *BindError
+	return errors.As(err, &bindErr) || err == ErrInsecureBind
+}
+
+// Stats returns the pool's connection counts and factory failures.
+func (c *channelPool) Stats() PoolStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return PoolStats{
+		Idle:       c.Len(),
+		Open:       c.open,
+		DialErrors: c.dialErrors,
+		BindErrors: c.bindErrors,
+	}
+}
+
+// Adopt adds a connection created outside of the pool, e.g. one that was
+// authenticated with SASL/GSSAPI elsewhere, to the idle connections. From
+// then on the pool owns conn as if its factory had created it. It fails with
+// ErrPoolFull if maxConnections are already open.
+func (c *channelPool) Adopt(conn ldap.Client) error {
+	if conn == nil {
+		return errors.New("connection is nil. rejecting")
+	}
+
+	c.mu.Lock()
+	if c.conns == nil {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if c.open >= c.maxConnections {
+		c.mu.Unlock()
+		return ErrPoolFull
+	}
+	c.open++
+	c.mu.Unlock()
+
+	c.track(conn)
+	c.put(conn)
+	return nil
+}
+
+// closeConn closes a connection created by the pool.
+func (c *channelPool) closeConn(conn ldap.Client) {
+	c.forget(conn)
+	unbindAndClose(conn)
+}
+
+// forget stops counting conn as open, for a connection the caller closes.
+func (c *channelPool) forget(conn ldap.Client) {
+	c.mu.Lock()
+	c.forgetLocked(conn)
+	c.mu.Unlock()
+}
+
+// forgetLocked is forget with c.mu held. Connections the pool never counted,
+// e.g. put after Close by a caller that didn't get them from the pool, leave
+// the open count alone.
+func (c *channelPool) forgetLocked(conn ldap.Client) {
+	if _, ok := c.info[conn]; ok {
+		delete(c.info, conn)
+		c.open--
+	}
+}
+
+// unbinder is implemented by connections that can send an LDAP Unbind
+// request. The ldap package's Conn only drops the TCP connection on Close,
+// which some servers log as an abnormal disconnect.
+type unbinder interface {
+	Unbind() error
+}
+
+// unbindAndClose sends an Unbind, if conn supports it, before closing it.
+func unbindAndClose(conn ldap.Client) {
+	if u, ok := conn.(unbinder); ok {
+		u.Unbind()
+	}
+	conn.Close()
 }
 
 // put puts the connection back to the pool. If the pool is full or closed,
@@ -152,53 +664,249 @@ func (c *channelPool) NewConn() (*PoolConn, error) {
 func (c *channelPool) put(conn ldap.Client) {
 	if conn == nil {
 		c.GetLogger().Debug("ldap connection is nil. recreating")
-		pConn, err := c.NewConn()
-		if err != nil {
+		var err error
+		if conn, err = c.newConn(); err != nil {
 			return
 		}
-		conn = pConn.Conn
 	}
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	discard := c.putLocked(conn)
+	c.mu.Unlock()
+	if discard {
+		// a slow peer mustn't hold up the pool while it is unbound
+		unbindAndClose(conn)
+	}
+}
 
-	if c.conns == nil {
-		// pool is closed, close passed connection
-		conn.Close()
-		return
+// putLocked hands conn to the oldest waiter or makes it idle, and reports
+// whether it was dropped instead, because the pool is closed, was reset or is
+// full. The caller must close a dropped connection. c.mu must be held.
+func (c *channelPool) putLocked(conn ldap.Client) (discard bool) {
+	if c.conns == nil || c.staleLocked(conn) {
+		// pool is closed or was reset
+		c.forgetLocked(conn)
+		return true
+	}
+
+	if len(c.waiters) > 0 {
+		waiter := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		waiter <- conn
+		return false
 	}
 
 	// put the resource back into the pool. If the pool is full, this will
 	// block and the default case will be executed.
 	select {
 	case c.conns <- conn:
-		return
+		atomic.AddInt64(&c.idle, 1)
+		return false
 	default:
-		// pool is full, close passed connection
-		conn.Close()
-		return
+		// pool is full
+		c.forgetLocked(conn)
+		return true
 	}
 }
 
+// tracking reports whether use and lifetime bookkeeping is needed.
+func (c *channelPool) tracking() bool {
+	return c.maxUses > 0 || c.maxLifetime > 0 || c.maxIdleTime > 0
+}
+
+// infoLocked returns the bookkeeping for conn, creating it if needed. c.mu
+// must be held.
+func (c *channelPool) infoLocked(conn ldap.Client) *connInfo {
+	info, ok := c.info[conn]
+	if !ok {
+		now := time.Now()
+		info = &connInfo{createdAt: now, idleSince: now, generation: c.generation}
+		c.info[conn] = info
+	}
+	return info
+}
+
+// track starts the bookkeeping for a newly created connection.
+func (c *channelPool) track(conn ldap.Client) {
+	c.mu.Lock()
+	c.infoLocked(conn)
+	c.mu.Unlock()
+}
+
+// staleLocked reports whether conn was created before the last Reset. c.mu
+// must be held.
+func (c *channelPool) staleLocked(conn ldap.Client) bool {
+	info, ok := c.info[conn]
+	return ok && info.generation < c.generation
+}
+
+// stale reports whether conn was created before the last Reset.
+func (c *channelPool) stale(conn ldap.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.staleLocked(conn)
+}
+
+// Reset retires every connection created so far. Idle connections are closed
+// and the pool refilled up to its initial capacity; checked-out connections
+// are closed and replaced when they are returned.
+func (c *channelPool) Reset() {
+	c.mu.Lock()
+	c.generation++
+	c.mu.Unlock()
+
+	for _, conn := range c.drainIdle() {
+		c.closeConn(conn)
+	}
+	for i := c.Len(); i < c.initialConnections; i++ {
+		conn, err := c.openFillConn()
+		if err != nil {
+			if err != ErrClosed {
+				c.GetLogger().Errorf("could not refill pool after reset: %s", err.Error())
+			}
+			return
+		}
+		c.put(conn)
+	}
+}
+
+// release records that conn was returned after serving n operations and
+// reports whether it has reached maxUses or maxLifetime and should be retired.
+func (c *channelPool) release(conn ldap.Client, n int) bool {
+	if !c.tracking() || conn == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.infoLocked(conn)
+	info.uses += n
+	info.idleSince = time.Now()
+	return (c.maxUses > 0 && info.uses >= c.maxUses) ||
+		(c.maxLifetime > 0 && time.Since(info.createdAt) >= c.maxLifetime)
+}
+
+// expired reports whether the idle connection conn has outlived maxLifetime
+// or maxIdleTime.
+func (c *channelPool) expired(conn ldap.Client) bool {
+	if c.maxLifetime <= 0 && c.maxIdleTime <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.infoLocked(conn)
+	return (c.maxLifetime > 0 && time.Since(info.createdAt) >= c.maxLifetime) ||
+		(c.maxIdleTime > 0 && time.Since(info.idleSince) >= c.maxIdleTime)
+}
+
+// Close closes the idle connections and shuts the pool down. It is safe to
+// call more than once, and concurrently with other methods. Afterwards Get,
+// NewConn and Adopt fail with ErrClosed, Len and Stats report no idle
+// connections, and connections handed back, e.g. by PoolConn.Close for one
+// checked out before, are closed instead of pooled.
 func (c *channelPool) Close() {
 	c.mu.Lock()
 	conns := c.conns
 	c.conns = nil
 	c.factory = nil
+	waiters := c.waiters
+	c.waiters = nil
 	c.mu.Unlock()
 
+	for _, waiter := range waiters {
+		close(waiter)
+	}
+
 	if conns == nil {
 		return
 	}
 
 	close(conns)
+	// getters racing with Close count the connections they take themselves
 	for conn := range conns {
-		conn.Close()
+		atomic.AddInt64(&c.idle, -1)
+		c.closeConn(conn)
 	}
 	return
 }
 
-func (c *channelPool) Len() int { return len(c.getConns()) }
+// Len returns the number of idle connections without taking the pool lock.
+func (c *channelPool) Len() int { return int(atomic.LoadInt64(&c.idle)) }
+
+// drainIdle takes every connection that is idle right now out of the pool
+// without blocking. The caller must put back or close each of them.
+func (c *channelPool) drainIdle() []ldap.Client {
+	conns := c.getConns()
+	if conns == nil {
+		return nil
+	}
+
+	var idle []ldap.Client
+	for n := len(conns); n > 0; n-- {
+		conn := c.takeIdle(conns)
+		if conn == nil {
+			return idle
+		}
+		idle = append(idle, conn)
+	}
+	return idle
+}
+
+// takeIdle takes one idle connection out of conns without blocking, or
+// returns nil if there is none or the pool closed.
+func (c *channelPool) takeIdle(conns chan ldap.Client) ldap.Client {
+	select {
+	case conn := <-conns:
+		if conn != nil {
+			atomic.AddInt64(&c.idle, -1)
+		}
+		return conn
+	default:
+		return nil
+	}
+}
+
+// LiveLen probes the idle connections and returns the number that are alive.
+// Dead connections are closed and dropped from the pool. The probes run one
+// at a time and only the connection being probed is out of the pool, so Get
+// keeps using the others meanwhile; connections checked out in the meantime
+// are not counted.
+func (c *channelPool) LiveLen() int {
+	conns := c.getConns()
+	if conns == nil {
+		return 0
+	}
+
+	live := 0
+	for n := len(conns); n > 0; n-- {
+		conn := c.takeIdle(conns)
+		if conn == nil {
+			break
+		}
+		if !isAlive(conn) {
+			c.GetLogger().Debugf("connection dead")
+			c.closeConn(conn)
+			continue
+		}
+		live++
+		c.put(conn)
+	}
+	return live
+}
+
+// CloseAt returns a copy of the result codes that mark a connection unusable.
+func (c *channelPool) CloseAt() []uint8 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]uint8(nil), c.closeAt...)
+}
+
+// SetCloseAt replaces the result codes that mark a connection unusable. Only
+// connections handed out afterwards use the new codes; nil clears them.
+func (c *channelPool) SetCloseAt(closeAt []uint8) {
+	c.mu.Lock()
+	c.closeAt = append([]uint8(nil), closeAt...)
+	c.mu.Unlock()
+}
 
 func (c *channelPool) wrapConn(conn ldap.Client, closeAt []uint8) *PoolConn {
 	p := &PoolConn{c: c, closeAt: closeAt}
@@ -211,17 +919,89 @@ func (c *channelPool) GetLogger() *log.Logger {
 }
 
 func (c *channelPool) RefillPool() {
+	c.RefillPoolContext(context.Background())
+}
+
+// RefillPoolContext runs every refreshInterval until ctx is cancelled or the
+// pool is closed. Each run closes idle connections that outlived
+// MaxConnLifetime or MaxConnIdleTime, then refills up to the initial cap.
+func (c *channelPool) RefillPoolContext(ctx context.Context) {
+	if c.refreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+
 	for {
-		time.Sleep(c.refreshInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if c.getConns() == nil {
+			return
+		}
+
 		c.GetLogger().Info("refreshing LDAP connections")
+		c.pruneIdle()
 		for i := c.Len(); i < c.initialConnections; i++ {
-			conn, err := c.NewConn()
+			conn, err := c.openFillConn()
 			if err != nil {
-				conn.Close()
-				c.GetLogger().Error("could not refresh connection")
-			} else {
-				c.put(conn.Conn)
+				if err != ErrClosed {
+					c.GetLogger().Errorf("could not refresh connection: %s", err.Error())
+				}
+				break
+			}
+			if c.refillProbe {
+				if err := c.probe(conn); err != nil {
+					c.GetLogger().Errorf("discarding refreshed connection that failed its probe: %s", err.Error())
+					c.closeConn(conn)
+					break
+				}
+				// the probe bound it already
+				c.mu.Lock()
+				c.infoLocked(conn).unbound = false
+				c.mu.Unlock()
+			}
+			c.put(conn)
+		}
+	}
+}
+
+// serviceBound reports whether the pool's connections are bound as the
+// service account rather than left anonymous.
+func (c *channelPool) serviceBound() bool {
+	return c.poolType == SharedPool || c.parentClient.Config.BindPoolAsService
+}
+
+// probe checks that conn can do the work of the pool: connections bound as
+// the service account bind again, then every connection runs the alive check.
+func (c *channelPool) probe(conn ldap.Client) error {
+	if c.serviceBound() {
+		if dn, password := c.parentClient.bindCredentials(); dn != "" {
+			if err := conn.Bind(dn, password); err != nil {
+				return err
 			}
 		}
 	}
+	if !isAlive(conn) {
+		return errors.New("alive check failed")
+	}
+	return nil
+}
+
+// pruneIdle closes the idle connections that have expired and puts the rest
+// back.
+func (c *channelPool) pruneIdle() {
+	if c.maxLifetime <= 0 && c.maxIdleTime <= 0 {
+		return
+	}
+	for _, conn := range c.drainIdle() {
+		if c.expired(conn) {
+			c.GetLogger().Debugf("closing expired connection")
+			c.closeConn(conn)
+			continue
+		}
+		c.put(conn)
+	}
 }
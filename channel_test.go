@@ -0,0 +1,751 @@
+package pooldap
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func fakeFactory(*Client, PoolType) (ldap.Client, error) {
+	return &fakeConn{}, nil
+}
+
+func newFakePool(t *testing.T, config LdapConfig, initialCap, maxCap int) *channelPool {
+	pool, err := NewChannelPool(initialCap, maxCap, SharedPool, fakeFactory, &Client{Config: config}, nil, time.Hour)
+	require.NoError(t, err)
+	return pool.(*channelPool)
+}
+
+func (c *channelPool) waiterCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func TestChannelPool_FairQueue(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{FairQueue: true}, 1, 1)
+	defer pool.Close()
+
+	first, err := pool.Get()
+	require.NoError(t, err)
+
+	const waiters = 5
+	order := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			conn, err := pool.Get()
+			if err != nil {
+				return
+			}
+			order <- i
+			conn.Close()
+		}(i)
+		require.Eventually(t, func() bool { return pool.waiterCount() == i+1 }, time.Second, time.Millisecond)
+	}
+
+	first.Close()
+	for i := 0; i < waiters; i++ {
+		assert.Equal(t, i, <-order)
+	}
+}
+
+func TestChannelPool_FairQueueClose(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{FairQueue: true}, 1, 1)
+	_, err := pool.Get()
+	require.NoError(t, err)
+
+	result := make(chan error)
+	go func() {
+		_, err := pool.Get()
+		result <- err
+	}()
+	require.Eventually(t, func() bool { return pool.waiterCount() == 1 }, time.Second, time.Millisecond)
+
+	pool.Close()
+	assert.Equal(t, ErrClosed, <-result)
+}
+
+func TestChannelPool_FairQueueCancel(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{FairQueue: true}, 1, 1)
+	defer pool.Close()
+	first, err := pool.Get()
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := getWithin(pool, time.Millisecond)
+		assert.Equal(t, errGetTimeout, err)
+	}
+	// the abandoned callers left the queue instead of waiting to be served
+	assert.Equal(t, 0, pool.waiterCount())
+
+	got := make(chan *PoolConn)
+	go func() {
+		conn, _ := pool.Get()
+		got <- conn
+	}()
+	require.Eventually(t, func() bool { return pool.waiterCount() == 1 }, time.Second, time.Millisecond)
+	first.Close()
+	conn := <-got
+	require.NotNil(t, conn)
+	assert.Equal(t, first.Conn, conn.Conn)
+	conn.Close()
+}
+
+func TestChannelPool_MaxUsesPerConn(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{MaxUsesPerConn: 2}, 1, 1)
+	pool.AliveChecks(false)
+	defer pool.Close()
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	first := conn.Conn.(*fakeConn)
+	conn.Search(&ldap.SearchRequest{})
+	conn.Close()
+
+	conn, err = pool.Get()
+	require.NoError(t, err)
+	assert.Same(t, first, conn.Conn)
+	conn.Search(&ldap.SearchRequest{})
+	conn.Close()
+	assert.True(t, first.closed)
+
+	conn, err = pool.Get()
+	require.NoError(t, err)
+	assert.NotSame(t, first, conn.Conn)
+	conn.Close()
+}
+
+func TestChannelPool_AsyncWarmup(t *testing.T) {
+	slowFactory := func(*Client, PoolType) (ldap.Client, error) {
+		time.Sleep(50 * time.Millisecond)
+		return &fakeConn{}, nil
+	}
+	client := &Client{asyncWarmup: true}
+
+	start := time.Now()
+	pool, err := NewChannelPool(3, 3, SharedPool, slowFactory, client, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+	assert.Equal(t, 0, pool.Len())
+
+	select {
+	case <-pool.WarmedUp():
+	case <-time.After(time.Second):
+		t.Fatal("pool did not warm up")
+	}
+	assert.Equal(t, 3, pool.Len())
+}
+
+func TestChannelPool_LiveLen(t *testing.T) {
+	dead := func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed"))
+	}
+	conns := []*fakeConn{{searchFn: dead}, {}, {searchFn: dead}}
+	next := 0
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		conn := conns[next]
+		next++
+		return conn, nil
+	}
+	pool, err := NewChannelPool(3, 3, SharedPool, factory, &Client{}, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	assert.Equal(t, 3, pool.Len())
+	assert.Equal(t, 1, pool.LiveLen())
+	assert.Equal(t, 1, pool.Len())
+	assert.True(t, conns[0].closed)
+	assert.False(t, conns[1].closed)
+	assert.True(t, conns[2].closed)
+}
+
+func TestChannelPool_LiveLenLeavesPoolAvailable(t *testing.T) {
+	probing, release := make(chan struct{}), make(chan struct{})
+	slow := func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		close(probing)
+		<-release
+		return &ldap.SearchResult{}, nil
+	}
+	conns := []*fakeConn{{searchFn: slow}, {}}
+	next := 0
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		conn := conns[next]
+		next++
+		return conn, nil
+	}
+	pool, err := NewChannelPool(2, 2, SharedPool, factory, &Client{}, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	live := make(chan int)
+	go func() { live <- pool.LiveLen() }()
+	<-probing
+
+	// the other idle connection is still handed out while the first is probed
+	conn, err := getWithin(pool, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, conns[1], conn.Conn)
+	conn.Close()
+
+	close(release)
+	assert.Equal(t, 2, <-live)
+	assert.Equal(t, 2, pool.Len())
+}
+
+func BenchmarkChannelPool_LenUnderContention(b *testing.B) {
+	pool, err := NewChannelPool(4, 4, SharedPool, fakeFactory, &Client{}, nil, time.Hour)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if i%2 == 0 {
+				pool.Len()
+			} else if conn, err := pool.Get(); err == nil {
+				conn.Close()
+			}
+			i++
+		}
+	})
+}
+
+// newChurnPool returns a pool logging to a null logger at level whose
+// connections fail their liveness check every other time.
+func newChurnPool(tb testing.TB, level log.Level) (*channelPool, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(level)
+	lc := &Client{}
+	lc.SetLogger(logger)
+	alive := false
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		alive = !alive
+		if alive {
+			return &fakeConn{}, nil
+		}
+		return &fakeConn{searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+			return nil, errors.New("connection reset")
+		}}, nil
+	}
+	pool, err := NewChannelPool(1, 1, SharedPool, factory, lc, nil, time.Hour)
+	require.NoError(tb, err)
+	return pool.(*channelPool), hook
+}
+
+// churn gets a connection, discarding a dead one on the way, and closes it
+// as unusable.
+func churn(pool *channelPool) {
+	conn, err := pool.Get()
+	if err != nil {
+		return
+	}
+	conn.MarkUnusable()
+	conn.Close()
+}
+
+func TestChannelPool_ChurnLogsAtDebug(t *testing.T) {
+	pool, hook := newChurnPool(t, log.InfoLevel)
+	defer pool.Close()
+	for i := 0; i < 10; i++ {
+		churn(pool)
+	}
+	assert.Empty(t, hook.AllEntries())
+
+	// nothing is formatted for the disabled debug messages
+	infoAllocs := testing.AllocsPerRun(100, func() { churn(pool) })
+	debugPool, hook := newChurnPool(t, log.DebugLevel)
+	defer debugPool.Close()
+	debugAllocs := testing.AllocsPerRun(100, func() { churn(debugPool) })
+	assert.NotEmpty(t, hook.AllEntries())
+	assert.Less(t, infoAllocs, debugAllocs)
+}
+
+func BenchmarkChannelPool_GetCloseChurn(b *testing.B) {
+	pool, _ := newChurnPool(b, log.InfoLevel)
+	defer pool.Close()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		churn(pool)
+	}
+}
+
+func TestChannelPool_RefillPrunesExpired(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		created []*fakeConn
+	)
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		conn := &fakeConn{}
+		created = append(created, conn)
+		return conn, nil
+	}
+	client := &Client{Config: LdapConfig{MaxConnLifetime: 30 * time.Millisecond}}
+	pool, err := NewChannelPool(2, 2, SharedPool, factory, client, nil, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.RefillPoolContext(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(created) >= 4 && created[0].isClosed() && created[1].isClosed()
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, pool.Len())
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refill loop did not stop")
+	}
+}
+
+func getsWithin(pool Pool, d time.Duration) bool {
+	got := make(chan struct{})
+	go func() {
+		if _, err := pool.Get(); err == nil {
+			close(got)
+		}
+	}()
+	select {
+	case <-got:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func TestChannelPool_NoOverflowWaits(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{}, 1, 2)
+	defer pool.Close()
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+
+	got := make(chan struct{})
+	go func() {
+		if _, err := pool.Get(); err == nil {
+			close(got)
+		}
+	}()
+	select {
+	case <-got:
+		t.Fatal("Get opened a connection beyond the idle ones")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("Get did not receive the returned connection")
+	}
+}
+
+func TestChannelPool_AllowOverflow(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{AllowOverflow: true}, 1, 2)
+	defer pool.Close()
+
+	_, err := pool.Get()
+	require.NoError(t, err)
+	assert.True(t, getsWithin(pool, time.Second))
+	assert.False(t, getsWithin(pool, 50*time.Millisecond))
+}
+
+func TestChannelPool_Adopt(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{}, 0, 1)
+	defer pool.Close()
+
+	adopted := &fakeConn{}
+	require.NoError(t, pool.Adopt(adopted))
+	assert.Equal(t, 1, pool.Len())
+	assert.Equal(t, ErrPoolFull, pool.Adopt(&fakeConn{}))
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	assert.Same(t, adopted, conn.Conn)
+	conn.Close()
+	assert.False(t, adopted.isClosed())
+
+	pool.Close()
+	assert.True(t, adopted.isClosed())
+	assert.Equal(t, ErrClosed, pool.Adopt(&fakeConn{}))
+}
+
+func TestChannelPool_RefillProbe(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		created []*fakeConn
+	)
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		conn := &fakeConn{}
+		if len(created) > 0 {
+			conn.bindFn = func(username, password string) error {
+				return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+			}
+		}
+		created = append(created, conn)
+		return conn, nil
+	}
+	client := &Client{Config: LdapConfig{
+		BindDN:       "cn=service,dc=example,dc=com",
+		BindPassword: "secret",
+		RefillProbe:  true,
+	}}
+	client.setBindCredentials(client.Config.BindDN, client.Config.BindPassword)
+	pool, err := NewChannelPool(1, 2, SharedPool, factory, client, nil, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	held, err := pool.Get()
+	require.NoError(t, err)
+	defer held.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.RefillPoolContext(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(created) >= 3
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, 0, pool.Len())
+	mu.Lock()
+	defer mu.Unlock()
+	for _, conn := range created[1:] {
+		assert.True(t, conn.isClosed())
+	}
+}
+
+// unbindConn records the Unbind and Close calls it receives, in order.
+type unbindConn struct {
+	fakeConn
+	calls []string
+}
+
+func (u *unbindConn) Unbind() error {
+	u.calls = append(u.calls, "unbind")
+	return nil
+}
+
+func (u *unbindConn) Close() {
+	u.calls = append(u.calls, "close")
+	u.fakeConn.Close()
+}
+
+func TestChannelPool_UnbindOnDiscard(t *testing.T) {
+	var created []*unbindConn
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		conn := &unbindConn{}
+		created = append(created, conn)
+		return conn, nil
+	}
+	pool, err := NewChannelPool(1, 1, SharedPool, factory, &Client{}, nil, time.Hour)
+	require.NoError(t, err)
+
+	// the pool is full, so an extra connection is discarded
+	extra, err := pool.(*channelPool).NewConn()
+	require.NoError(t, err)
+	extra.Close()
+	assert.Equal(t, []string{"unbind", "close"}, created[1].calls)
+
+	pool.Close()
+	assert.Equal(t, []string{"unbind", "close"}, created[0].calls)
+}
+
+// hangingUnbindConn blocks in Unbind until released.
+type hangingUnbindConn struct {
+	fakeConn
+	unbinding chan struct{}
+	release   chan struct{}
+}
+
+func (h *hangingUnbindConn) Unbind() error {
+	close(h.unbinding)
+	<-h.release
+	return nil
+}
+
+func TestChannelPool_DiscardOutsideLock(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{}, 1, 1)
+	defer pool.Close()
+
+	// the pool is full, so a returned connection is discarded
+	hanging := &hangingUnbindConn{unbinding: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		pool.put(hanging)
+		close(done)
+	}()
+	<-hanging.unbinding
+
+	stats := make(chan PoolStats)
+	go func() { stats <- pool.Stats() }()
+	select {
+	case s := <-stats:
+		assert.Equal(t, 1, s.Open)
+	case <-time.After(time.Second):
+		t.Fatal("Stats blocked while a connection was unbound")
+	}
+	conn, err := getWithin(pool, time.Second)
+	require.NoError(t, err)
+	conn.Close()
+
+	close(hanging.release)
+	<-done
+	assert.True(t, hanging.isClosed())
+}
+
+func TestChannelPool_SetCloseAt(t *testing.T) {
+	pool, err := NewChannelPool(1, 1, SharedPool, fakeFactory, &Client{}, []uint8{ldap.ErrorNetwork}, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+	assert.Equal(t, []uint8{ldap.ErrorNetwork}, pool.CloseAt())
+
+	checkedOut, err := pool.Get()
+	require.NoError(t, err)
+
+	codes := []uint8{ldap.LDAPResultTimeLimitExceeded}
+	pool.SetCloseAt(codes)
+	codes[0] = ldap.LDAPResultBusy
+	assert.Equal(t, []uint8{ldap.LDAPResultTimeLimitExceeded}, pool.CloseAt())
+	assert.Equal(t, []uint8{ldap.ErrorNetwork}, checkedOut.closeAt)
+	checkedOut.Close()
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	assert.Equal(t, []uint8{ldap.LDAPResultTimeLimitExceeded}, conn.closeAt)
+	conn.Close()
+
+	pool.SetCloseAt(nil)
+	assert.Empty(t, pool.CloseAt())
+}
+
+func TestChannelPool_MaxIdleConns(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{MaxIdleConns: 1}, 2, 3)
+	defer pool.Close()
+	assert.Equal(t, 1, pool.Len())
+
+	var conns []*PoolConn
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get()
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	assert.Equal(t, 3, pool.Stats().Open)
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	assert.Equal(t, PoolStats{Idle: 1, Open: 1}, pool.Stats())
+}
+
+func TestChannelPool_MaxOpenConns(t *testing.T) {
+	pool := newFakePool(t, LdapConfig{MaxOpenConns: 2}, 2, 10)
+	defer pool.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := pool.Get()
+		require.NoError(t, err)
+	}
+	assert.False(t, getsWithin(pool, 50*time.Millisecond))
+	assert.Equal(t, ErrPoolFull, pool.Adopt(&fakeConn{}))
+	assert.Equal(t, 2, pool.Stats().Open)
+}
+
+func TestChannelPool_AfterClose(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	lc := &Client{}
+	lc.SetLogger(logger)
+	p, err := NewChannelPool(2, 2, SharedPool, fakeFactory, lc, nil, time.Millisecond)
+	require.NoError(t, err)
+	pool := p.(*channelPool)
+	usable, err := pool.Get()
+	require.NoError(t, err)
+	unusable, err := pool.Get()
+	require.NoError(t, err)
+	unusable.MarkUnusable()
+
+	pool.Close()
+	pool.Close()
+
+	assert.Equal(t, 0, pool.Len())
+	assert.Equal(t, 0, pool.LiveLen())
+	_, err = pool.Get()
+	assert.Equal(t, ErrClosed, err)
+	_, err = pool.NewConn()
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, pool.Adopt(&fakeConn{}))
+
+	returned := &fakeConn{}
+	pool.put(returned)
+	pool.put(nil)
+	assert.True(t, returned.isClosed())
+
+	usable.Close()
+	unusable.Close()
+	assert.True(t, usable.Conn.(*fakeConn).isClosed())
+	assert.True(t, unusable.Conn.(*fakeConn).isClosed())
+
+	pool.Reset()
+	pool.RefillPool()
+	assert.Equal(t, PoolStats{}, pool.Stats())
+	assert.Empty(t, hook.AllEntries())
+}
+
+// runPoolOps drives a pool with the operations encoded in ops, split between
+// three goroutines, and checks the pool's invariants along the way: no more
+// than maxCap connections open, no negative counters, and every connection
+// closed once the pool and all checkouts are closed. The first byte picks
+// the pool options.
+func runPoolOps(t *testing.T, ops []byte) {
+	const initialCap, maxCap, workers = 2, 4, 3
+	if len(ops) == 0 {
+		return
+	}
+	var (
+		mu      sync.Mutex
+		created []*fakeConn
+		dead    []*int32
+	)
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		flag := new(int32)
+		conn := &fakeConn{searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+			if atomic.LoadInt32(flag) == 1 {
+				return nil, errors.New("connection reset")
+			}
+			return &ldap.SearchResult{}, nil
+		}}
+		mu.Lock()
+		created = append(created, conn)
+		dead = append(dead, flag)
+		mu.Unlock()
+		return conn, nil
+	}
+	logger, _ := test.NewNullLogger()
+	lc := &Client{Config: LdapConfig{
+		AllowOverflow:  ops[0]&1 != 0,
+		FairQueue:      ops[0]&2 != 0,
+		MaxUsesPerConn: int(ops[0]>>2) % 3,
+	}}
+	lc.SetLogger(logger)
+	p, err := NewChannelPool(initialCap, maxCap, SharedPool, factory, lc, nil, time.Hour)
+	require.NoError(t, err)
+	pool := p.(*channelPool)
+
+	checkStats := func() {
+		stats := pool.Stats()
+		if stats.Open > maxCap || stats.Open < 0 || stats.Idle < 0 {
+			t.Errorf("invalid pool stats %+v", stats)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var held []*PoolConn
+			for i := 1 + w; i < len(ops); i += workers {
+				op, arg := ops[i]%6, int(ops[i]/6)
+				switch {
+				case op == 0:
+					if conn, err := getWithin(pool, 5*time.Millisecond); err == nil {
+						held = append(held, conn)
+					}
+				case op <= 2 && len(held) > 0:
+					conn := held[len(held)-1]
+					held = held[:len(held)-1]
+					if op == 2 {
+						conn.MarkUnusable()
+					}
+					conn.Close()
+				case op == 3:
+					checkStats()
+				case op == 4 && arg%4 == 0:
+					pool.Close()
+				case op == 5:
+					mu.Lock()
+					atomic.StoreInt32(dead[arg%len(dead)], 1)
+					mu.Unlock()
+				}
+				checkStats()
+			}
+			for _, conn := range held {
+				conn.Close()
+			}
+		}(w)
+	}
+	wg.Wait()
+	pool.Close()
+
+	// gets that timed out return their connection once it arrives
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range created {
+			if !conn.isClosed() {
+				return false
+			}
+		}
+		return pool.Stats().Open == 0
+	}, time.Second, time.Millisecond, "connections left open: %+v", pool.Stats())
+}
+
+// FuzzChannelPool runs its seeds, like TestChannelPool_RandomOps, in every
+// test run; explore further with go test -race -fuzz FuzzChannelPool.
+func FuzzChannelPool(f *testing.F) {
+	for _, seed := range [][]byte{
+		{0, 0, 0, 0, 1, 1, 1},
+		{1, 0, 0, 0, 0, 0, 2, 3, 5, 0, 1},
+		{2, 0, 0, 0, 0, 0, 0, 4, 0, 1},
+		{7, 0, 5, 0, 11, 2, 0, 1, 3, 28, 0, 0},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(runPoolOps)
+}
+
+func TestChannelPool_RandomOps(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		ops := make([]byte, 1+rng.Intn(64))
+		rng.Read(ops)
+		runPoolOps(t, ops)
+		if t.Failed() {
+			t.Fatalf("failed for ops %v", ops)
+		}
+	}
+}
@@ -1,36 +1,252 @@
 package pooldap
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/ldap.v2"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Client struct {
 	Config             LdapConfig
 	ClientCertificates []tls.Certificate // Adding client certificates
+	Dialer             Dialer            // nil dials with the ldap package
 	logger             *log.Logger
 	searchPool         Pool
 	bindPool           Pool
+	poolSettings       poolSettings
+	asyncWarmup        bool
+	warmupCtx          context.Context // stops the async warm-up, see NewClientContext
+	onOperation        func(OpStats)
+	onBind             func(BindEvent)
+	stopRefill         context.CancelFunc
+	registry           *PoolRegistry // set by WithPoolRegistry
+	shared             *sharedPools  // the pools acquired from registry
+	closeOnce          sync.Once
+	credMu             sync.RWMutex // guards bindDN and bindPassword
+	bindDN             string       // service account, from Config at init
+	bindPassword       string
+	groupCache         *groupCache
+	groupCacheOnce     sync.Once
+	rootDSEMu          sync.Mutex
+	rootDSE            *rootDSE // cached by readRootDSE
 }
 
-func NewClient(config LdapConfig, initialSearchConns, maxSearchConns, initialBindConns, maxBindConns int, refreshInterval time.Duration) (*Client, error) {
+// poolSettings records the arguments the pools were built with so that Clone
+// can build identical ones.
+type poolSettings struct {
+	initialSearchConns int
+	maxSearchConns     int
+	initialBindConns   int
+	maxBindConns       int
+	refreshInterval    time.Duration
+}
+
+// NewClientContext is NewClient that gives up waiting for the pools to fill
+// once ctx is done. The client is returned in any case: on ctx expiry with
+// ctx.Err(), holding the connections created so far, and no more initial
+// connections are created. Each pool's refill loop tops it up later. A
+// connection being dialed when ctx expires still joins the pool.
+func NewClientContext(ctx context.Context, config LdapConfig, initialSearchConns, maxSearchConns, initialBindConns, maxBindConns int, refreshInterval time.Duration, opts ...ClientOption) (*Client, error) {
+	// copied, so the caller's backing array is never written to
+	opts = append(opts[:len(opts):len(opts)], WithAsyncWarmup(), func(c *Client) { c.warmupCtx = ctx })
+	lc, err := NewClient(config, initialSearchConns, maxSearchConns, initialBindConns, maxBindConns, refreshInterval, opts...)
+	if err != nil {
+		return lc, err
+	}
+	select {
+	case <-lc.WarmupDone():
+	case <-ctx.Done():
+		return lc, ctx.Err()
+	}
+	for _, pool := range []Pool{lc.searchPool, lc.bindPool} {
+		if c, ok := pool.(*channelPool); ok && c.warmupErr != nil {
+			return lc, errors.Wrap(c.warmupErr, "factory is not able to fill the pool")
+		}
+	}
+	return lc, nil
+}
+
+func NewClient(config LdapConfig, initialSearchConns, maxSearchConns, initialBindConns, maxBindConns int, refreshInterval time.Duration, opts ...ClientOption) (*Client, error) {
 	ldapClient := &Client{
 		Config: config,
 	}
+	for _, opt := range opts {
+		opt(ldapClient)
+	}
 	err := ldapClient.InitClientPool(initialSearchConns, maxSearchConns, initialBindConns, maxBindConns, refreshInterval)
 	return ldapClient, err
 }
 
+// Clone returns a new Client built from a copy of this client's config with
+// overrides applied. The clone gets its own search and bind pools sized like
+// the originals; no pooled connections are shared unless the client uses a
+// PoolRegistry and the clone's connection settings still match. The logger
+// is shared.
+func (lc *Client) Clone(overrides ...ClientOption) (*Client, error) {
+	clone := &Client{
+		Config:             lc.Config,
+		ClientCertificates: append([]tls.Certificate(nil), lc.ClientCertificates...),
+		Dialer:             lc.Dialer,
+		logger:             lc.logger,
+		asyncWarmup:        lc.asyncWarmup,
+		onOperation:        lc.onOperation,
+		onBind:             lc.onBind,
+		registry:           lc.registry,
+	}
+	// the secret was read when this client was created; the clone starts from
+	// the credentials in use, which may since have been rotated
+	clone.Config.BindDN, clone.Config.BindPassword = lc.bindCredentials()
+	clone.Config.BindPasswordFile, clone.Config.BindPasswordEnv = "", ""
+	clone.Config.Attributes = append([]string(nil), lc.Config.Attributes...)
+	clone.Config.EmailAttributes = append([]string(nil), lc.Config.EmailAttributes...)
+	if lc.Config.AttributeMap != nil {
+		clone.Config.AttributeMap = make(map[string]string, len(lc.Config.AttributeMap))
+		for k, v := range lc.Config.AttributeMap {
+			clone.Config.AttributeMap[k] = v
+		}
+	}
+	for _, override := range overrides {
+		override(clone)
+	}
+
+	s := lc.poolSettings
+	err := clone.InitClientPool(s.initialSearchConns, s.maxSearchConns, s.initialBindConns, s.maxBindConns, s.refreshInterval)
+	return clone, err
+}
+
 func clientPoolFactory(lc *Client, poolType PoolType) (ldap.Client, error) {
-	var l *ldap.Conn
+	l, err := lc.dialWithRetries()
+	if err != nil {
+		return nil, err
+	}
+
+	if (poolType == SharedPool || lc.Config.BindPoolAsService) && !lc.Config.LazyBind {
+		if err = lc.serviceBind(l); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// dialWithRetries dials, retrying as configured by DialRetries and
+// DialBackoff, and applies RequestTimeout to the new connection.
+func (lc *Client) dialWithRetries() (ldap.Client, error) {
+	var l ldap.Client
+	err := retryWithBackoff(lc.Config.DialRetries, lc.Config.DialBackoff, func(attempt int) (err error) {
+		l, err = lc.dial()
+		if err != nil && attempt < lc.Config.DialRetries {
+			lc.GetLogger().Warnf("dial attempt %d failed, retrying: %s", attempt+1, err)
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lc.Config.RequestTimeout > 0 {
+		l.SetTimeout(lc.Config.RequestTimeout)
+	}
+	return l, nil
+}
+
+// serviceBind binds l as the service account, if one is configured.
+func (lc *Client) serviceBind(l ldap.Client) error {
+	dn, password := lc.bindCredentials()
+	if dn == "" || password == "" {
+		return nil
+	}
+	if err := lc.checkSecureBind(password); err != nil {
+		return err
+	}
+	if err := l.Bind(dn, password); err != nil {
+		return newBindError(err)
+	}
+	return nil
+}
+
+// bindCredentials returns the service account DN and password. They are
+// taken from Config.BindDN and Config.BindPassword when the pools are
+// created and changed by SetBindCredentials only.
+func (lc *Client) bindCredentials() (dn, password string) {
+	lc.credMu.RLock()
+	defer lc.credMu.RUnlock()
+	return lc.bindDN, lc.bindPassword
+}
+
+// setBindCredentials replaces the service account DN and password.
+func (lc *Client) setBindCredentials(dn, password string) {
+	lc.credMu.Lock()
+	lc.bindDN, lc.bindPassword = dn, password
+	lc.credMu.Unlock()
+}
+
+// SetBindCredentials rotates the service account without recreating the
+// Client. Idle pooled connections bound with the old credentials are closed
+// and replaced right away; checked-out ones finish their current work and are
+// replaced when they are returned. Config keeps the credentials the Client
+// was created with. A Client using a PoolRegistry fails with ErrSharedPools;
+// Clone it WithBindCredentials instead.
+func (lc *Client) SetBindCredentials(dn, password string) error {
+	if lc.registry != nil {
+		return ErrSharedPools
+	}
+	lc.setBindCredentials(dn, password)
+
+	lc.searchPool.Reset()
+	if lc.Config.BindPoolAsService {
+		lc.bindPool.Reset()
+	}
+	return nil
+}
+
+// RotateCredentials is SetBindCredentials that first checks the new
+// credentials on a separate connection, leaving the old ones in place if the
+// bind fails. Once it returns, no connection bound with the old credentials,
+// including one that was being dialed meanwhile, is handed out again. An
+// empty password, which many servers accept as an unauthenticated bind, is
+// refused with ErrInvalidCredentials unless Config.AllowEmptyPassword is set,
+// as with Authenticate.
+func (lc *Client) RotateCredentials(dn, password string) error {
+	if lc.registry != nil {
+		return ErrSharedPools
+	}
+	if password == "" && !lc.Config.AllowEmptyPassword {
+		return ErrInvalidCredentials
+	}
+	if err := lc.checkSecureBind(password); err != nil {
+		return err
+	}
+	conn, err := lc.dialWithRetries()
+	if err != nil {
+		return errors.Wrap(ErrUnreachable, err.Error())
+	}
+	defer conn.Close()
+	if err := conn.Bind(dn, password); err != nil {
+		return newBindError(err)
+	}
+	return lc.SetBindCredentials(dn, password)
+}
+
+// dial connects to the configured host using LDAPS, StartTLS or plaintext.
+func (lc *Client) dial() (ldap.Client, error) {
+	return lc.dialHost(lc.Config.Host)
+}
+
+// dialHost connects to host on the configured port, like dial.
+func (lc *Client) dialHost(host string) (ldap.Client, error) {
+	var l ldap.Client
 	var err error
-	address := fmt.Sprintf("%s:%d", lc.Config.Host, lc.Config.Port)
+	dialer := lc.dialer()
+	address := fmt.Sprintf("%s:%d", host, lc.Config.Port)
 	if !lc.Config.UseSSL {
-		l, err = ldap.Dial("tcp", address)
+		l, err = dialer.Dial("tcp", address)
 		if err != nil {
 			return nil, err
 		}
@@ -39,164 +255,794 @@ func clientPoolFactory(lc *Client, poolType PoolType) (ldap.Client, error) {
 		if !lc.Config.SkipTLS {
 			err = l.StartTLS(&tls.Config{InsecureSkipVerify: true})
 			if err != nil {
+				l.Close()
 				return nil, err
 			}
 		}
 	} else {
 		config := &tls.Config{
 			InsecureSkipVerify: lc.Config.InsecureSkipVerify,
-			ServerName:         lc.Config.ServerName,
+			ServerName:         lc.Config.serverName(host),
 		}
 		if lc.ClientCertificates != nil && len(lc.ClientCertificates) > 0 {
 			config.Certificates = lc.ClientCertificates
 		}
-		l, err = ldap.DialTLS("tcp", address, config)
+		l, err = dialer.DialTLS("tcp", address, config)
 		if err != nil {
 			return nil, err
 		}
 	}
-	if poolType == SharedPool {
-		if lc.Config.BindDN != "" && lc.Config.BindPassword != "" {
-			l.Bind(lc.Config.BindDN, lc.Config.BindPassword)
+	return l, nil
+}
+
+// retryWithBackoff calls fn until it succeeds or has been retried retries
+// times, sleeping backoff before the first retry and doubling it each time.
+func retryWithBackoff(retries int, backoff time.Duration, fn func(attempt int) error) (err error) {
+	if backoff <= 0 {
+		backoff = defaultDialBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		if err = fn(attempt); err == nil || attempt >= retries {
+			return
 		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	return l, nil
+}
+
+// checkSecureBind guards binds over connections that are neither LDAPS nor
+// upgraded with StartTLS. A password sent over such a connection is logged as
+// a warning, or refused with ErrInsecureBind when Config.RequireSecureBind is set.
+func (lc *Client) checkSecureBind(password string) error {
+	if password == "" || lc.Config.UseSSL || !lc.Config.SkipTLS {
+		return nil
+	}
+	if lc.Config.RequireSecureBind {
+		return ErrInsecureBind
+	}
+	lc.GetLogger().Warn("binding with a password over an unencrypted connection")
+	return nil
+}
+
+// loadClientCertificate adds the key pair configured by Config.ClientCertFile
+// and Config.ClientKeyFile to ClientCertificates, unless it is there already,
+// e.g. in a Clone.
+func (c *Client) loadClientCertificate() error {
+	cert, err := c.Config.clientCertificate()
+	if err != nil || cert == nil {
+		return err
+	}
+	for _, existing := range c.ClientCertificates {
+		if len(existing.Certificate) > 0 && bytes.Equal(existing.Certificate[0], cert.Certificate[0]) {
+			return nil
+		}
+	}
+	c.ClientCertificates = append(c.ClientCertificates, *cert)
+	return nil
 }
 
 func (c *Client) InitClientPool(initialSearchConns, maxSearchConns, initialBindConns, maxBindConns int, refreshInterval time.Duration) error {
-	var searchPool Pool
-	var bindPool Pool
 	var err error
 
-	searchPool, err = NewChannelPool(initialSearchConns, maxSearchConns, SharedPool, clientPoolFactory, c, []uint8{200}, refreshInterval)
+	if c.Config.GroupFilter != "" {
+		if _, err = groupFilterArgs(c.Config.GroupFilter); err != nil {
+			return err
+		}
+	}
+	if err = c.Config.checkAttributeMap(); err != nil {
+		return err
+	}
+	if err = c.loadClientCertificate(); err != nil {
+		return err
+	}
+	password, err := c.Config.bindPassword()
 	if err != nil {
 		return err
 	}
+	c.setBindCredentials(c.Config.BindDN, password)
+
+	c.poolSettings = poolSettings{initialSearchConns, maxSearchConns, initialBindConns, maxBindConns, refreshInterval}
+	if c.registry != nil {
+		if c.shared, err = c.registry.acquire(c); err != nil {
+			return err
+		}
+		c.searchPool, c.bindPool = c.shared.searchPool, c.shared.bindPool
+		return nil
+	}
+	c.searchPool, c.bindPool, c.stopRefill, err = c.openPools(c.poolSettings)
+	return err
+}
 
-	bindPool, err = NewChannelPool(initialBindConns, maxBindConns, BindPool, clientPoolFactory, c, []uint8{200}, refreshInterval)
+// openPools creates a search and a bind pool with c as their parent client
+// and starts their background refills, which stopRefill ends.
+func (c *Client) openPools(s poolSettings) (searchPool, bindPool Pool, stopRefill context.CancelFunc, err error) {
+	searchPool, err = NewChannelPool(s.initialSearchConns, s.maxSearchConns, SharedPool, clientPoolFactory, c, []uint8{200}, s.refreshInterval)
 	if err != nil {
-		return err
+		return
+	}
+	bindPool, err = NewChannelPool(s.initialBindConns, s.maxBindConns, BindPool, clientPoolFactory, c, []uint8{200}, s.refreshInterval)
+	if err != nil {
+		searchPool.Close()
+		return nil, nil, nil, err
 	}
 
-	c.searchPool = searchPool
-	go c.searchPool.RefillPool()
-	c.bindPool = bindPool
-	go c.bindPool.RefillPool()
+	ctx, cancel := context.WithCancel(context.Background())
+	go searchPool.RefillPoolContext(ctx)
+	go bindPool.RefillPoolContext(ctx)
+	return searchPool, bindPool, cancel, nil
+}
+
+// Close stops the background refills and closes both pools. The Client is
+// unusable afterwards. Pools shared through a PoolRegistry are only closed
+// with the last Client using them.
+func (c *Client) Close() {
+	if c.shared != nil {
+		c.closeOnce.Do(func() { c.registry.release(c.shared) })
+		return
+	}
+	if c.stopRefill != nil {
+		c.stopRefill()
+	}
+	if c.searchPool != nil {
+		c.searchPool.Close()
+	}
+	if c.bindPool != nil {
+		c.bindPool.Close()
+	}
+}
+
+// WarmupDone returns a channel that is closed once both pools have created
+// their initial connections. Without WithAsyncWarmup it is closed as soon as
+// NewClient returns.
+func (lc *Client) WarmupDone() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		<-lc.searchPool.WarmedUp()
+		<-lc.bindPool.WarmedUp()
+		close(done)
+	}()
+	return done
+}
+
+// CheckBind binds as the service account on a fresh connection that never
+// enters either pool. It returns an error wrapping ErrUnreachable if the
+// directory can't be dialed, or a *BindError if the credentials are rejected.
+func (lc *Client) CheckBind() error {
+	conn, err := lc.dialWithRetries()
+	if err != nil {
+		return errors.Wrap(ErrUnreachable, err.Error())
+	}
+	defer conn.Close()
+
+	dn, password := lc.bindCredentials()
+	if err := lc.checkSecureBind(password); err != nil {
+		return err
+	}
+	if err := conn.Bind(dn, password); err != nil {
+		return newBindError(err)
+	}
 	return nil
 }
 
+// GetUser looks up username and returns the configured Attributes of its
+// entry, plus the entry DN under Config.DNKey. Values are strings, except for
+// attributes listed in Config.BinaryAttributes, which are []byte, and
+// objectClass, which is always returned as a []string of every class. With
+// Config.PreferredLanguages set, a language-tagged value such as
+// displayName;lang-fr is returned under the base name when one exists.
+// Attributes the directory didn't return are listed under
+// MissingAttributesKey. Config.AttributeMap renames attributes in the result
+// and can convert their values, e.g. "whenCreated: created:time" stores a
+// time.Time under created; see TransformBool, TransformTime and TransformInt.
+// Attributes listed in Config.MultiValuedAttributes are returned with all
+// their values as a []string, [][]byte for binary ones or []interface{} with
+// a transform, like objectClass. Such slices keep the order in which the
+// server sent the values, e.g. to pick the primary SMTP: proxyAddresses
+// entry; LDAP itself doesn't promise any particular order.
 func (lc *Client) GetUser(username string) (userAttributes map[string]interface{}, err error) {
-	userAttributes = make(map[string]interface{})
-	attributes := append(lc.Config.Attributes, "dn")
-	// Search for the given username
-	searchRequest := ldap.NewSearchRequest(
-		lc.Config.Base,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf(lc.Config.UserFilter, username),
-		attributes,
-		nil,
-	)
-	conn, err := lc.searchPool.Get()
-	defer conn.Close()
+	sr, err := lc.GetUserRaw(username)
 	if err != nil {
-		conn.AutoClose(err)
-		return
+		return make(map[string]interface{}), err
 	}
+	return lc.userAttributes(username, sr)
+}
 
-	sr, err := conn.Search(searchRequest)
+// GetUserWithConn is GetUser on conn, a connection checked out with
+// SearchConn, instead of one from the pool.
+func (lc *Client) GetUserWithConn(conn *PoolConn, username string) (userAttributes map[string]interface{}, err error) {
+	timer := lc.startSearch(context.Background(), lc.Config.userBase())
+	timer.connAcquired()
+	sr, err := lc.getUserRaw(conn, username, timer)
 	if err != nil {
-		conn.AutoClose(err)
-		return
+		return make(map[string]interface{}), err
 	}
+	return lc.userAttributes(username, sr)
+}
 
+// userAttributes builds GetUser's result from the search for username.
+func (lc *Client) userAttributes(username string, sr *ldap.SearchResult) (userAttributes map[string]interface{}, err error) {
+	userAttributes = make(map[string]interface{})
 	if len(sr.Entries) < 1 {
 		err = ErrNotFound
 		return
 	}
 
+	entry := sr.Entries[0]
 	if len(sr.Entries) > 1 {
-		err = ErrNotUnique
-		return
+		if entry = lc.Config.multipleMatchEntry(sr.Entries); entry == nil {
+			err = ErrNotUnique
+			return
+		}
+		lc.GetLogger().Debugf("%d entries matched %s, using %s", len(sr.Entries), username, entry.DN)
 	}
 
 	for _, attr := range lc.Config.Attributes {
-		userAttributes[attr] = sr.Entries[0].GetAttributeValue(attr)
+		key, transform := lc.Config.attributeMapping(attr)
+		if lc.Config.isMultiValued(attr) {
+			if userAttributes[key], err = lc.Config.multipleValues(entry, attr, transform); err != nil {
+				return
+			}
+			continue
+		}
+		if lc.Config.isBinary(attr) {
+			userAttributes[key] = entry.GetRawAttributeValue(attr)
+			continue
+		}
+		value := languageValue(entry, attr, lc.Config.PreferredLanguages)
+		if transform == "" {
+			userAttributes[key] = value
+			continue
+		}
+		if userAttributes[key], err = transformValue(transform, attr, value); err != nil {
+			return
+		}
+	}
+	userAttributes["objectClass"] = attributeValues(entry, "objectClass")
+	userAttributes[lc.Config.dnKey()] = entry.DN
+	if missing := missingAttributes(entry, lc.Config.Attributes); len(missing) > 0 {
+		userAttributes[MissingAttributesKey] = missing
+	}
+
+	return
+}
+
+// MissingAttributesKey is the key under which GetUser lists, as a []string,
+// the configured Attributes that the directory did not return. LDAP doesn't
+// tell an attribute the entry lacks from one the service account may not
+// read, e.g. because of Active Directory ACLs; both end up here, while their
+// values in the result are empty. The key is absent when every attribute was
+// returned.
+const MissingAttributesKey = "_missingAttributes"
+
+// missingAttributes returns the attributes of which entry has no values,
+// counting option variants such as displayName;lang-fr as the attribute.
+func missingAttributes(entry *ldap.Entry, attributes []string) (missing []string) {
+	for _, attribute := range attributes {
+		found := false
+		for _, attr := range entry.Attributes {
+			name := attr.Name
+			if i := strings.IndexByte(name, ';'); i >= 0 {
+				name = name[:i]
+			}
+			if strings.EqualFold(name, attribute) && len(attr.Values) > 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, attribute)
+		}
+	}
+	return
+}
+
+// attributeValues returns every value of attribute, matched
+// case-insensitively, in the order the server sent them.
+func attributeValues(entry *ldap.Entry, attribute string) []string {
+	values := []string{}
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, attribute) {
+			values = append(values, attr.Values...)
+		}
+	}
+	return values
+}
+
+// multipleValues returns GetUser's value for a multi-valued attribute: its
+// values in server order, as raw bytes for binary attributes or converted by
+// transform.
+func (c LdapConfig) multipleValues(entry *ldap.Entry, attribute, transform string) (interface{}, error) {
+	if c.isBinary(attribute) {
+		values := [][]byte{}
+		for _, attr := range entry.Attributes {
+			if strings.EqualFold(attr.Name, attribute) {
+				values = append(values, attr.ByteValues...)
+			}
+		}
+		return values, nil
+	}
+	values := attributeValues(entry, attribute)
+	if transform == "" {
+		return values, nil
+	}
+	transformed := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		v, err := transformValue(transform, attribute, value)
+		if err != nil {
+			return nil, err
+		}
+		transformed = append(transformed, v)
+	}
+	return transformed, nil
+}
 
+// GetUserRaw runs the same search as GetUser and returns the result as is,
+// including every matching entry, referrals and response controls. A
+// referral in place of a result is returned as a *ReferralError.
+func (lc *Client) GetUserRaw(username string) (sr *ldap.SearchResult, err error) {
+	timer := lc.startSearch(context.Background(), lc.Config.userBase())
+	conn, err := lc.searchPool.Get()
+	timer.connAcquired()
+	if err != nil {
+		timer.getFailed(err)
+		return
 	}
-	userAttributes["dn"] = sr.Entries[0].DN
+	defer conn.Close()
+	return lc.getUserRaw(conn, username, timer)
+}
 
+// getUserRaw runs GetUserRaw's search on conn.
+func (lc *Client) getUserRaw(conn *PoolConn, username string, timer *opTimer) (sr *ldap.SearchResult, err error) {
+	return lc.searchUser(conn, fmt.Sprintf(lc.Config.UserFilter, EscapeValue(username)), timer)
+}
+
+// GetUserByEmail is GetUser for the user with the email address email, for
+// logins that accept either. The user is found with Config.EmailFilter,
+// which defaults to matching people, i.e. users on Active Directory, on any
+// of Config.EmailAttributes, or mail if there are none. ErrNotFound and
+// ErrNotUnique are returned as by GetUser.
+func (lc *Client) GetUserByEmail(email string) (userAttributes map[string]interface{}, err error) {
+	timer := lc.startSearch(context.Background(), lc.Config.userBase())
+	conn, err := lc.searchPool.Get()
+	timer.connAcquired()
+	if err != nil {
+		timer.getFailed(err)
+		return make(map[string]interface{}), err
+	}
+	defer conn.Close()
+	sr, err := lc.searchUser(conn, lc.Config.emailFilter(email), timer)
+	if err != nil {
+		return make(map[string]interface{}), err
+	}
+	return lc.userAttributes(email, sr)
+}
+
+// searchUser runs a user search with filter on conn, returning the
+// attributes GetUser needs.
+func (lc *Client) searchUser(conn *PoolConn, filter string, timer *opTimer) (sr *ldap.SearchResult, err error) {
+	attributes := append(append([]string(nil), lc.Config.Attributes...), "dn")
+	if !containsString(attributes, "objectClass") {
+		attributes = append(attributes, "objectClass")
+	}
+	searchRequest := ldap.NewSearchRequest(
+		lc.Config.userBase(),
+		searchScope(lc.Config.UserSearchScope), ldap.NeverDerefAliases, lc.Config.SizeLimit, lc.Config.timeLimit(), false,
+		filter,
+		attributes,
+		nil,
+	)
+	sr, err = conn.Search(searchRequest)
+	timer.done(err)
+	if err != nil {
+		conn.AutoClose(err)
+		err = newReferralError(err, sr)
+	}
 	return
 }
 
+// Authenticate looks up username and binds as it to check password. With
+// Config.TokenGroups set, the user's effective Active Directory groups are
+// read on the same connection while it is bound as the user and returned
+// under "tokenGroups" as a map of group name to group DN.
 func (lc *Client) Authenticate(username, password string) (valid bool, userAttributes map[string]interface{}, err error) {
+	valid, userAttributes, _, err = lc.authenticate(username, password, nil)
+	return
+}
+
+// AuthenticateWithControls is Authenticate with controls attached to the
+// simple bind request. The bind result is returned even when the bind fails,
+// so response controls describing the failure are available to the caller.
+func (lc *Client) AuthenticateWithControls(username, password string, controls ...ldap.Control) (valid bool, userAttributes map[string]interface{}, result *ldap.SimpleBindResult, err error) {
+	return lc.authenticate(username, password, controls)
+}
+
+// authenticate looks up username and binds as it with a simple bind carrying
+// controls.
+func (lc *Client) authenticate(username, password string, controls []ldap.Control) (valid bool, userAttributes map[string]interface{}, result *ldap.SimpleBindResult, err error) {
+	defer func() { lc.auditBind(username, "simple", userAttributes, err) }()
+	if password == "" && !lc.Config.AllowEmptyPassword {
+		// an empty password would be an unauthenticated bind, which succeeds
+		err = ErrInvalidCredentials
+		return
+	}
 	userAttributes, err = lc.GetUser(username)
 	if err != nil {
 		return
 	}
 
-	bindConn, err := lc.bindPool.Get()
+	timer := lc.startOp("bind", BindPool)
+	bindConn, borrowed, err := lc.getBindConn()
+	timer.connAcquired()
 	defer bindConn.Close()
 	if err != nil {
+		timer.getFailed(err)
 		return
 	}
-	userDistinguishedName, ok := userAttributes["dn"]
+	userDistinguishedName, ok := userAttributes[lc.Config.dnKey()]
 	if !ok {
 		err = ErrDnNotFound
 		return
 	}
+	if err = lc.checkSecureBind(password); err != nil {
+		return
+	}
 	// Bind as the user to verify their password
-	err = bindConn.Bind(userDistinguishedName.(string), password)
+	bindName := lc.bindName(userDistinguishedName.(string), username, userAttributes)
+	result, err = lc.bindWithFormats(bindConn, bindName, username, password, controls)
+	timer.done(err)
+	var groupsErr error
+	if err == nil && lc.Config.TokenGroups {
+		var groups map[string]string
+		if groups, groupsErr = lc.tokenGroups(bindConn, userDistinguishedName.(string)); groupsErr == nil {
+			userAttributes[tokenGroupsKey] = groups
+		}
+	}
+	if lc.mustChangePassword(userAttributes, result, err) {
+		userAttributes[MustChangePasswordKey] = true
+	}
+	if lc.Config.BindPoolAsService || borrowed {
+		// Return the connection to the pool as the service account
+		if rebindErr := bindConn.Bind(lc.bindCredentials()); rebindErr != nil {
+			lc.GetLogger().Errorf("could not rebind as service account: %s", rebindErr)
+			bindConn.MarkUnusable()
+		}
+	}
 	if err != nil {
 		//Close this connection if the
 		bindConn.AutoClose(err)
-		return false, userAttributes, err
+		return false, userAttributes, result, newBindError(err)
+	}
+	if groupsErr != nil {
+		bindConn.AutoClose(groupsErr)
+		return false, userAttributes, result, errors.Wrap(groupsErr, "reading tokenGroups")
 	}
 
 	valid = true
 	return
 }
 
+// MustChangePasswordKey is set to true in the attributes returned by
+// Authenticate when the user has to change their password before using the
+// account, e.g. after an administrator reset it. It is set whether or not the
+// bind succeeded: OpenLDAP's ppolicy lets the bind through, while Active
+// Directory rejects it. The key is absent otherwise.
+const MustChangePasswordKey = "_mustChangePassword"
+
+// mustChangePassword reports whether the bind result, its error or the
+// user's attributes say the password must be changed: a password policy
+// control with changeAfterReset, Active Directory's bind error data 773, or
+// pwdLastSet 0 when that attribute is among Config.Attributes, whatever its
+// AttributeMap name and transform.
+func (lc *Client) mustChangePassword(userAttributes map[string]interface{}, result *ldap.SimpleBindResult, err error) bool {
+	if result != nil {
+		if policy := passwordPolicyFromControls(result.Controls); policy != nil && policy.MustChangePassword {
+			return true
+		}
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) && adDataCode(err) == "773" {
+		return true
+	}
+	key, _ := lc.Config.attributeMapping(pwdLastSetAttribute)
+	value := userAttributes[key]
+	switch values := value.(type) {
+	case []string:
+		if len(values) > 0 {
+			value = values[0]
+		}
+	case []interface{}:
+		if len(values) > 0 {
+			value = values[0]
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v == "0"
+	case int64:
+		return v == 0
+	}
+	return false
+}
+
+// pwdLastSetAttribute holds when an Active Directory user last set their
+// password, 0 if they must change it at the next logon.
+const pwdLastSetAttribute = "pwdLastSet"
+
+// userPrincipalNameAttribute holds an Active Directory user's UPN.
+const userPrincipalNameAttribute = "userPrincipalName"
+
+// bindName returns the name Authenticate binds as. With Config.BindUPN set
+// that is the user's UPN, which Active Directory resolves across forests more
+// reliably than the DN: userPrincipalName when it is among Config.Attributes
+// and set, otherwise username@Config.Domain. A username that already
+// contains an @ is taken as a UPN. Without either it falls back to dn.
+func (lc *Client) bindName(dn, username string, userAttributes map[string]interface{}) string {
+	if !lc.Config.BindUPN {
+		return dn
+	}
+	key, _ := lc.Config.attributeMapping(userPrincipalNameAttribute)
+	if upn, ok := userAttributes[key].(string); ok && upn != "" {
+		return upn
+	}
+	switch {
+	case strings.Contains(username, "@"):
+		return username
+	case lc.Config.Domain != "":
+		return username + "@" + lc.Config.Domain
+	}
+	return dn
+}
+
+// maxBindFormats is how many of Config.BindFormats Authenticate tries after
+// the DN. Each attempt replays the password and counts as a failed login
+// toward the server's lockout threshold, commonly as low as five.
+const maxBindFormats = 2
+
+// bindWithFormats binds as dn and, while the directory answers with invalid
+// credentials, as each of the first maxBindFormats of Config.BindFormats
+// applied to username in turn. Every attempt counts as a failed login for
+// lockout purposes on the server.
+func (lc *Client) bindWithFormats(conn *PoolConn, dn, username, password string, controls []ldap.Control) (result *ldap.SimpleBindResult, err error) {
+	formats := lc.Config.BindFormats
+	if len(formats) > maxBindFormats {
+		formats = formats[:maxBindFormats]
+	}
+	result, err = conn.SimpleBind(ldap.NewSimpleBindRequest(dn, password, controls))
+	for _, format := range formats {
+		if err == nil || !retryableBindError(err) {
+			return
+		}
+		lc.GetLogger().Debugf("bind as %s rejected, trying format %s", dn, format)
+		result, err = conn.SimpleBind(ldap.NewSimpleBindRequest(fmt.Sprintf(format, username), password, controls))
+	}
+	return
+}
+
+// retryableBindError reports whether err means the credentials were wrong
+// for this bind name, so another name for the same user may succeed. Active
+// Directory also answers invalid credentials for locked, disabled and
+// expired accounts, telling them apart by the "data" code in the message;
+// only a bad password (52e) or unknown user (525) is retryable.
+func retryableBindError(err error) bool {
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false
+	}
+	code := adDataCode(err)
+	return code == "" || code == "52e" || code == "525"
+}
+
+// adDataCode returns the lower-cased "data" code Active Directory puts in bind
+// error messages, e.g. "52e" for a bad password, or "" if there is none.
+func adDataCode(err error) string {
+	msg := strings.ToLower(err.Error())
+	i := strings.Index(msg, "data ")
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(msg[i+len("data "):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimRight(fields[0], ",")
+}
+
+// getBindConn gets a connection for a user bind from the bind pool. With
+// Config.BorrowSearchConns set and the bind pool exhausted for longer than
+// Config.BindPoolTimeout, it borrows a search pool connection instead, which
+// the caller must rebind as the service account before closing.
+func (lc *Client) getBindConn() (conn *PoolConn, borrowed bool, err error) {
+	if !lc.Config.BorrowSearchConns || lc.Config.BindPoolTimeout <= 0 {
+		conn, err = lc.bindPool.Get()
+		return
+	}
+	conn, err = getWithin(lc.bindPool, lc.Config.BindPoolTimeout)
+	if err != errGetTimeout {
+		return
+	}
+	lc.GetLogger().Debug("bind pool exhausted, borrowing a search pool connection")
+	conn, err = lc.searchPool.Get()
+	return conn, true, err
+}
+
+// GetUserGroups returns the groups username is a member of, keyed by group
+// name with the normalized group DN as value. Groups are matched by
+// Config.GroupFilter against the user's Config.GroupMemberAttribute, usually
+// the DN, or with Config.GroupMembership "uid" against its Config.Uid
+// attribute, as POSIX groups list members by memberUid; of a multi-valued
+// member attribute, the first value is used. With Config.GroupCacheTTL set,
+// results are cached per username, compared under the matching rule of
+// Config.Uid; see InvalidateGroups. Groups are keyed by their names as
+// returned, so groups whose names differ only in case are all kept. Use
+// GroupDN to look a group up by name under the matching rule of
+// Config.GroupNameAttribute.
 func (lc *Client) GetUserGroups(username string) (groups map[string]string, err error) {
+	cache := lc.groups()
+	key := lc.Config.usernameKey(username)
+	if cache != nil {
+		if groups, ok := cache.get(key); ok {
+			return groups, nil
+		}
+	}
+	groups, err = lc.getUserGroups(username)
+	if err == nil && cache != nil {
+		cache.set(key, groups)
+	}
+	return
+}
+
+func (lc *Client) getUserGroups(username string) (groups map[string]string, err error) {
 	userAttributes, err := lc.GetUser(username)
 	if err != nil {
 		return
 	}
 
-	memberAttribute, ok := userAttributes[lc.Config.GroupMemberAttribute]
+	conn, err := lc.searchPool.Get()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return lc.searchUserGroups(conn, username, userAttributes)
+}
+
+// GetUserGroupsWithConn is GetUserGroups with both the user and the group
+// lookup on conn, a connection checked out with SearchConn, so they see the
+// same server. It bypasses the group cache.
+func (lc *Client) GetUserGroupsWithConn(conn *PoolConn, username string) (groups map[string]string, err error) {
+	userAttributes, err := lc.GetUserWithConn(conn, username)
+	if err != nil {
+		return
+	}
+	return lc.searchUserGroups(conn, username, userAttributes)
+}
+
+// SearchConn checks a connection out of the search pool so that several
+// operations, e.g. GetUserWithConn and GetUserGroupsWithConn, run on the
+// same connection. Close it to return it to the pool.
+func (lc *Client) SearchConn() (*PoolConn, error) {
+	return lc.searchPool.Get()
+}
+
+// Conn checks a connection out of the search pool for the lifetime of ctx,
+// like sql.DB.Conn: Close it to return it to the pool once done. If ctx ends
+// first, the connection is closed and replaced in the pool instead, failing
+// any operation still running on it, and Close does nothing. A ctx that is
+// never done costs nothing beyond the checkout itself.
+func (lc *Client) Conn(ctx context.Context) (*PoolConn, error) {
+	conn, err := lc.searchPool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.checkout = &ctxCheckout{}
+	conn.checkout.stop = context.AfterFunc(ctx, conn.retire)
+	return conn, nil
+}
+
+// searchUserGroups finds on conn the groups of username, whose GetUser
+// result is userAttributes.
+func (lc *Client) searchUserGroups(conn *PoolConn, username string, userAttributes map[string]interface{}) (groups map[string]string, err error) {
+	attribute, key := lc.Config.groupMember()
+	value, ok := userAttributes[key]
 	if !ok {
-		err = errors.Wrap(ErrAttributeNotFound, lc.Config.GroupMemberAttribute)
+		err = &AttributeError{Attribute: attribute}
+		return
+	}
+	member, ok := memberValue(value)
+	if !ok {
+		// binary or transformed, so there is no string to match groups by
+		err = &AttributeError{Attribute: attribute}
+		return
+	}
+	if member == "" {
+		// the attribute was fetched but the user has no value, so no groups
+		groups = make(map[string]string)
 		return
 	}
 
-	filter := fmt.Sprintf(lc.Config.GroupFilter, ldap.EscapeFilter(memberAttribute.(string)))
+	filter, err := lc.Config.groupFilter(member, username)
+	if err != nil {
+		return
+	}
 	searchRequest := ldap.NewSearchRequest(
-		lc.Config.Base,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		lc.Config.groupBase(),
+		searchScope(lc.Config.GroupSearchScope), ldap.NeverDerefAliases, lc.Config.SizeLimit, lc.Config.timeLimit(), false,
 		filter,
 		[]string{lc.Config.GroupNameAttribute}, // can it be something else than "cn"?
 		nil,
 	)
 
-	conn, err := lc.searchPool.Get()
-	defer conn.Close()
+	sr, err := conn.Search(searchRequest)
 	if err != nil {
 		conn.AutoClose(err)
 		return
 	}
 
+	groups = make(map[string]string)
+	for _, entry := range sr.Entries {
+		groupName := entry.GetAttributeValue(lc.Config.GroupNameAttribute)
+		groupDn, err := NormalizeDN(entry.DN)
+		if err != nil {
+			groupDn = entry.DN
+		}
+		groups[groupName] = groupDn
+	}
+
+	return
+}
+
+// memberValue returns the group member value from a GetUser value: the
+// string itself, or the first of a multi-valued attribute's values. ok is
+// false for binary and transformed values.
+func memberValue(value interface{}) (member string, ok bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []string:
+		if len(v) == 0 {
+			return "", true
+		}
+		return v[0], true
+	}
+	return "", false
+}
+
+// GetGroupMembers returns the DNs of all members of the group at groupDN.
+// Members are read from Config.GroupMembersAttribute, defaulting to "member".
+// Active Directory ranged retrieval is followed for groups with more members
+// than the server returns in a single response.
+func (lc *Client) GetGroupMembers(groupDN string) (members []string, err error) {
+	membersAttribute := lc.Config.GroupMembersAttribute
+	if membersAttribute == "" {
+		membersAttribute = "member"
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		groupDN,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, lc.Config.SizeLimit, lc.Config.timeLimit(), false,
+		"(objectClass=*)",
+		[]string{membersAttribute},
+		nil,
+	)
+
+	conn, err := lc.searchPool.Get()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
 	sr, err := conn.Search(searchRequest)
 	if err != nil {
 		conn.AutoClose(err)
 		return
 	}
 
-	groups = make(map[string]string)
-	for _, entry := range sr.Entries {
-		groupName := entry.GetAttributeValue(lc.Config.GroupNameAttribute)
-		groupDn := entry.DN
-		groups[groupName] = groupDn
+	if len(sr.Entries) < 1 {
+		err = ErrNotFound
+		return
 	}
 
+	members, err = rangedAttributeValues(conn, sr.Entries[0], membersAttribute)
+	if err != nil {
+		conn.AutoClose(err)
+	}
 	return
 }
 
@@ -0,0 +1,865 @@
+package pooldap
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+var fakeUser = &ldap.Entry{
+	DN: "uid=fry,ou=people,dc=example,dc=com",
+	Attributes: []*ldap.EntryAttribute{
+		{Name: "uid", Values: []string{"fry"}},
+		{Name: "cn", Values: []string{"Philip J. Fry"}},
+	},
+}
+
+func fakeUserConfig() LdapConfig {
+	return LdapConfig{
+		Base:                 "dc=example,dc=com",
+		UserFilter:           "(uid=%s)",
+		Attributes:           []string{"uid", "cn"},
+		GroupFilter:          "(member=%s)",
+		GroupMemberAttribute: "dn",
+		GroupNameAttribute:   "cn",
+	}
+}
+
+func TestClient_SearchScopes(t *testing.T) {
+	for scope, expected := range map[string]int{
+		"":     ldap.ScopeWholeSubtree,
+		"sub":  ldap.ScopeWholeSubtree,
+		"one":  ldap.ScopeSingleLevel,
+		"base": ldap.ScopeBaseObject,
+	} {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+		config := fakeUserConfig()
+		config.UserSearchScope = scope
+		config.GroupSearchScope = scope
+		lc := newFakeClient(t, config, conn)
+
+		_, err := lc.GetUserGroups("fry")
+		require.NoError(t, err)
+		require.Len(t, conn.searches, 2)
+		assert.Equal(t, expected, conn.searches[0].Scope, "user scope %q", scope)
+		assert.Equal(t, expected, conn.searches[1].Scope, "group scope %q", scope)
+	}
+}
+
+func TestClient_SearchBases(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	lc := newFakeClient(t, config, conn)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Equal(t, config.Base, conn.searches[0].BaseDN)
+	assert.Equal(t, config.Base, conn.searches[1].BaseDN)
+
+	conn = &fakeConn{searchFn: entriesResult(fakeUser)}
+	config.UserBase = "ou=people,dc=example,dc=com"
+	config.GroupBase = "ou=groups,dc=example,dc=com"
+	lc = newFakeClient(t, config, conn)
+
+	_, err = lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Equal(t, config.UserBase, conn.searches[0].BaseDN)
+	assert.Equal(t, config.GroupBase, conn.searches[1].BaseDN)
+}
+
+func TestClient_DNKey(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.DNKey = "distinguishedName"
+	lc := newFakeClient(t, config, conn)
+
+	valid, user, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, fakeUser.DN, user["distinguishedName"])
+	assert.NotContains(t, user, "dn")
+	assert.Equal(t, []string{fakeUser.DN}, conn.binds)
+}
+
+func TestClient_InsecureBindWarning(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.SkipTLS = true
+	lc := newFakeClient(t, config, conn)
+	logger, hook := test.NewNullLogger()
+	lc.SetLogger(logger)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, log.WarnLevel, hook.LastEntry().Level)
+}
+
+func TestClient_RequireSecureBind(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.SkipTLS = true
+	config.RequireSecureBind = true
+	lc := newFakeClient(t, config, conn)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	assert.Equal(t, ErrInsecureBind, err)
+	assert.False(t, valid)
+	assert.Empty(t, conn.binds)
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var attempts []time.Time
+	err := retryWithBackoff(3, 10*time.Millisecond, func(attempt int) error {
+		attempts = append(attempts, time.Now())
+		if attempt < 2 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, attempts, 3)
+	assert.True(t, attempts[1].Sub(attempts[0]) >= 10*time.Millisecond)
+	assert.True(t, attempts[2].Sub(attempts[1]) >= 20*time.Millisecond)
+}
+
+func TestRetryWithBackoffGivesUp(t *testing.T) {
+	calls := 0
+	err := retryWithBackoff(2, time.Millisecond, func(int) error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestClient_AuthenticateWithControls(t *testing.T) {
+	var sent []ldap.Control
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			sent = req.Controls
+			return &ldap.SimpleBindResult{Controls: req.Controls}, nil
+		},
+	}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	control := ldap.NewControlBeheraPasswordPolicy()
+	valid, _, result, err := lc.AuthenticateWithControls("fry", "fry", control)
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []ldap.Control{control}, sent)
+	require.NotNil(t, result)
+	assert.Len(t, result.Controls, 1)
+	assert.Equal(t, []string{fakeUser.DN}, conn.binds)
+}
+
+func TestClient_GetUserGroupsMissingAttribute(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.GroupMemberAttribute = "memberUid"
+	lc := newFakeClient(t, config, conn)
+
+	_, err := lc.GetUserGroups("fry")
+	assert.True(t, errors.Is(err, ErrAttributeNotFound))
+	var attrErr *AttributeError
+	require.True(t, errors.As(err, &attrErr))
+	assert.Equal(t, "memberUid", attrErr.Attribute)
+}
+
+func TestClient_GetUserGroupsEmptyAttribute(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.Attributes = append(config.Attributes, "memberUid")
+	config.GroupMemberAttribute = "memberUid"
+	lc := newFakeClient(t, config, conn)
+
+	groups, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+	assert.Len(t, conn.searches, 1)
+}
+
+func TestClient_GetUserGroupsMappedMember(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.DNKey = "distinguishedName"
+	lc := newFakeClient(t, config, conn)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 2)
+	assert.Equal(t, "(member=uid=fry,ou=people,dc=example,dc=com)", conn.searches[1].Filter)
+
+	conn = &fakeConn{searchFn: entriesResult(fakeUser)}
+	config = fakeUserConfig()
+	config.GroupFilter = "(memberUid=%s)"
+	config.GroupMemberAttribute = "uid"
+	config.AttributeMap = map[string]string{"uid": "username"}
+	lc = newFakeClient(t, config, conn)
+
+	_, err = lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 2)
+	assert.Equal(t, "(memberUid=fry)", conn.searches[1].Filter)
+}
+
+func TestClient_GetUserGroupsByUid(t *testing.T) {
+	crew := &ldap.Entry{
+		DN:         "cn=crew,ou=groups,dc=example,dc=com",
+		Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"crew"}}},
+	}
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.HasPrefix(req.Filter, "(memberUid=") {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{crew}}, nil
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+	}}
+	config := fakeUserConfig()
+	config.UserFilter = "(mail=%s)"
+	config.GroupFilter = "(memberUid=%s)"
+	config.GroupMembership = "uid"
+	config.AttributeMap = map[string]string{"uid": "username"}
+	lc := newFakeClient(t, config, conn)
+
+	groups, err := lc.GetUserGroups("fry@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"crew": "cn=crew,ou=groups,dc=example,dc=com"}, groups)
+	require.Len(t, conn.searches, 2)
+	assert.Equal(t, "(memberUid=fry)", conn.searches[1].Filter)
+
+	config.Host, config.Port = "localhost", 389
+	config.Attributes = []string{"cn"}
+	assert.EqualError(t, config.Validate(), "group_membership uid needs uid in attributes")
+	config.GroupMembership = "posix"
+	assert.EqualError(t, config.Validate(), `group_membership "posix" is not one of dn or uid`)
+}
+
+func TestClient_GetUserGroupsMultiValuedUid(t *testing.T) {
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "uid", Values: []string{"fry", "pjfry"}},
+			{Name: "cn", Values: []string{"Philip J. Fry"}},
+		},
+	}
+	conn := &fakeConn{searchFn: entriesResult(user)}
+	config := fakeUserConfig()
+	config.GroupFilter = "(memberUid=%s)"
+	config.GroupMembership = "uid"
+	config.MultiValuedAttributes = []string{"uid"}
+	lc := newFakeClient(t, config, conn)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 2)
+	assert.Equal(t, "(memberUid=fry)", conn.searches[1].Filter)
+
+	// a transformed value can't be matched against, but doesn't panic
+	conn = &fakeConn{searchFn: entriesResult(&ldap.Entry{DN: fakeUser.DN, Attributes: []*ldap.EntryAttribute{{Name: "uid", Values: []string{"1000"}}}})}
+	config.MultiValuedAttributes = nil
+	config.AttributeMap = map[string]string{"uid": "uid:int"}
+	lc = newFakeClient(t, config, conn)
+
+	_, err = lc.GetUserGroups("fry")
+	var attrErr *AttributeError
+	require.True(t, errors.As(err, &attrErr))
+	assert.Equal(t, "uid", attrErr.Attribute)
+	assert.Len(t, conn.searches, 1)
+}
+
+func TestClient_GetUserByEmail(t *testing.T) {
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(fakeUser.Attributes,
+			&ldap.EntryAttribute{Name: "mail", Values: []string{"fry@example.com"}},
+			&ldap.EntryAttribute{Name: "proxyAddresses", Values: []string{"SMTP:fry@example.com", "smtp:philip.fry@planetexpress.com"}},
+		),
+	}
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.Contains(req.Filter, "(proxyAddresses=smtp:philip.fry@planetexpress.com)") {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{user}}, nil
+		}
+		return &ldap.SearchResult{}, nil
+	}}
+	config := fakeUserConfig()
+	config.EmailAttributes = []string{"mail", "proxyAddresses"}
+	lc := newFakeClient(t, config, conn)
+
+	attrs, err := lc.GetUserByEmail("philip.fry@planetexpress.com")
+	require.NoError(t, err)
+	assert.Equal(t, "fry", attrs["uid"])
+	assert.Equal(t, fakeUser.DN, attrs["dn"])
+	assert.Equal(t, "(&(objectCategory=person)(objectClass=user)(|(mail=philip.fry@planetexpress.com)(proxyAddresses=smtp:philip.fry@planetexpress.com)))", conn.searches[0].Filter)
+
+	_, err = lc.GetUserByEmail("*@planetexpress.com")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, `(&(objectCategory=person)(objectClass=user)(|(mail=\2a@planetexpress.com)(proxyAddresses=smtp:\2a@planetexpress.com)))`, conn.searches[1].Filter)
+
+	conn.searchFn = entriesResult(user, &ldap.Entry{DN: "uid=fry2,ou=people,dc=example,dc=com"})
+	_, err = lc.GetUserByEmail("fry@example.com")
+	assert.Equal(t, ErrNotUnique, err)
+
+	lc.Config.EmailFilter = "(&(objectClass=person)(mail=%s))"
+	conn.searchFn = entriesResult(user)
+	_, err = lc.GetUserByEmail("fry@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "(&(objectClass=person)(mail=fry@example.com))", conn.searches[3].Filter)
+
+	lc.Config.EmailFilter = ""
+	lc.Config.EmailAttributes = nil
+	_, err = lc.GetUserByEmail("fry@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "(&(objectClass=person)(mail=fry@example.com))", conn.searches[4].Filter)
+}
+
+func TestClient_GetUserByEmailSkipsContacts(t *testing.T) {
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(fakeUser.Attributes,
+			&ldap.EntryAttribute{Name: "objectClass", Values: []string{"top", "person", "organizationalPerson", "user"}},
+			&ldap.EntryAttribute{Name: "proxyAddresses", Values: []string{"SMTP:fry@example.com"}},
+		),
+	}
+	// Active Directory contacts are people too, and may carry the address of
+	// a user, e.g. one synchronized from another forest
+	contact := &ldap.Entry{
+		DN: "cn=Fry,ou=contacts,dc=example,dc=com",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "objectClass", Values: []string{"top", "person", "organizationalPerson", "contact"}},
+			{Name: "proxyAddresses", Values: []string{"SMTP:fry@example.com"}},
+		},
+	}
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.Contains(req.Filter, "(objectClass=user)") {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{user}}, nil
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{user, contact}}, nil
+	}}
+	config := fakeUserConfig()
+	config.ServerType = "ad"
+	lc := newFakeClient(t, config, conn)
+
+	attrs, err := lc.GetUserByEmail("fry@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, fakeUser.DN, attrs["dn"])
+	assert.Equal(t, "(&(objectCategory=person)(objectClass=user)(mail=fry@example.com))", conn.searches[0].Filter)
+}
+
+func TestClient_OnMultipleMatch(t *testing.T) {
+	replica := &ldap.Entry{
+		DN: "uid=fry,ou=replica,dc=example,dc=com",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "uid", Values: []string{"fry"}},
+			{Name: "cn", Values: []string{"Philip J. Fry"}},
+		},
+	}
+	for mode, expected := range map[string]string{
+		"first": fakeUser.DN,
+		"last":  replica.DN,
+	} {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser, replica)}
+		config := fakeUserConfig()
+		config.OnMultipleMatch = mode
+		lc := newFakeClient(t, config, conn)
+
+		user, err := lc.GetUser("fry")
+		require.NoError(t, err, mode)
+		assert.Equal(t, expected, user["dn"], mode)
+	}
+
+	for _, mode := range []string{"", "error"} {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser, replica)}
+		config := fakeUserConfig()
+		config.OnMultipleMatch = mode
+		lc := newFakeClient(t, config, conn)
+
+		_, err := lc.GetUser("fry")
+		assert.Equal(t, ErrNotUnique, err, mode)
+	}
+}
+
+func TestClient_BinaryAttributes(t *testing.T) {
+	guid := []byte{0x3f, 0x9a, 0x00, 0xff, 0xfe, 0x10, 0x80, 0xc3, 0x28, 0x01, 0x02, 0xa0, 0xa1, 0x7f, 0xed, 0xa0}
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(fakeUser.Attributes, &ldap.EntryAttribute{
+			Name:       "objectGUID",
+			Values:     []string{string(guid)},
+			ByteValues: [][]byte{guid},
+		}),
+	}
+	conn := &fakeConn{searchFn: entriesResult(user)}
+	config := fakeUserConfig()
+	config.Attributes = append(config.Attributes, "objectGUID")
+	config.BinaryAttributes = []string{"objectguid"}
+	lc := newFakeClient(t, config, conn)
+
+	attrs, err := lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, guid, attrs["objectGUID"])
+	assert.Equal(t, "fry", attrs["uid"])
+}
+
+func TestClient_BorrowSearchConns(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	config.BorrowSearchConns = true
+	config.BindPoolTimeout = 20 * time.Millisecond
+	lc := newFakeClient(t, config, conn)
+
+	held, err := lc.bindPool.Get()
+	require.NoError(t, err)
+	defer held.Close()
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []string{fakeUser.DN, config.BindDN}, conn.binds)
+	assert.Equal(t, 1, lc.searchPool.Len())
+	assert.Equal(t, 0, lc.bindPool.Len())
+}
+
+func TestClient_GetUserRaw(t *testing.T) {
+	control := ldap.NewControlString("1.2.840.113556.1.4.841", false, "cookie")
+	conn := &fakeConn{searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		return &ldap.SearchResult{
+			Entries:   []*ldap.Entry{fakeUser},
+			Referrals: []string{"ldap://replica.example.com/dc=example,dc=com"},
+			Controls:  []ldap.Control{control},
+		}, nil
+	}}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	sr, err := lc.GetUserRaw("fry")
+	require.NoError(t, err)
+	assert.Equal(t, []*ldap.Entry{fakeUser}, sr.Entries)
+	assert.Equal(t, []ldap.Control{control}, sr.Controls)
+	assert.Len(t, sr.Referrals, 1)
+	assert.Equal(t, "(uid=fry)", conn.searches[0].Filter)
+}
+
+func TestClient_GetUserObjectClass(t *testing.T) {
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(fakeUser.Attributes, &ldap.EntryAttribute{
+			Name:   "objectClass",
+			Values: []string{"top", "person", "organizationalPerson", "inetOrgPerson"},
+		}),
+	}
+	conn := &fakeConn{searchFn: entriesResult(user)}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	attrs, err := lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"top", "person", "organizationalPerson", "inetOrgPerson"}, attrs["objectClass"])
+	assert.Contains(t, conn.searches[0].Attributes, "objectClass")
+	assert.Equal(t, []string{"uid", "cn"}, lc.Config.Attributes)
+}
+
+func TestClient_BindFormats(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			if req.Username != "fry@example.com" {
+				return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 52e, v3839"))
+			}
+			return &ldap.SimpleBindResult{}, nil
+		},
+	}
+	config := fakeUserConfig()
+	config.BindFormats = []string{"%s@example.com", `EXAMPLE\%s`}
+	lc := newFakeClient(t, config, conn)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []string{fakeUser.DN, "fry@example.com"}, conn.binds)
+}
+
+func TestClient_BindFormatsLockout(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(*ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839"))
+		},
+	}
+	config := fakeUserConfig()
+	config.BindFormats = []string{"%s@example.com", `EXAMPLE\%s`}
+	lc := newFakeClient(t, config, conn)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	assert.Error(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{fakeUser.DN}, conn.binds)
+}
+
+func TestClient_BindFormatsCapped(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(*ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 52e, v3839"))
+		},
+	}
+	config := fakeUserConfig()
+	config.BindFormats = []string{"%s@example.com", `EXAMPLE\%s`, "%s@legacy.example.com"}
+	lc := newFakeClient(t, config, conn)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	assert.Error(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, []string{fakeUser.DN, "fry@example.com", `EXAMPLE\fry`}, conn.binds)
+
+	config.Host, config.Port = "localhost", 389
+	assert.EqualError(t, config.Validate(), "bind_formats takes at most 2 formats, as every bind attempt counts toward account lockout")
+}
+
+func TestADDataCode(t *testing.T) {
+	for msg, expected := range map[string]string{
+		"AcceptSecurityContext error, data 52e, v3839": "52e",
+		"AcceptSecurityContext error, data 773":        "773",
+		"AcceptSecurityContext error, data ":           "",
+		"invalid credentials":                          "",
+	} {
+		err := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New(msg))
+		assert.Equal(t, expected, adDataCode(err), msg)
+		assert.NotPanics(t, func() { (&Client{}).mustChangePassword(nil, nil, err) }, msg)
+	}
+}
+
+func TestClient_BindUPN(t *testing.T) {
+	config := fakeUserConfig()
+	config.BindUPN = true
+	config.Domain = "example.com"
+
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	lc := newFakeClient(t, config, conn)
+	valid, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []string{"fry@example.com"}, conn.binds)
+
+	// userPrincipalName from the entry wins over the domain
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(fakeUser.Attributes, &ldap.EntryAttribute{
+			Name:   "userPrincipalName",
+			Values: []string{"philip.fry@corp.example.com"},
+		}),
+	}
+	config.Attributes = append(config.Attributes, "userPrincipalName")
+	conn = &fakeConn{searchFn: entriesResult(user)}
+	lc = newFakeClient(t, config, conn)
+	valid, _, err = lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []string{"philip.fry@corp.example.com"}, conn.binds)
+
+	config.Domain = ""
+	config.Attributes = []string{"uid", "cn"}
+	config.Host, config.Port = "localhost", 389
+	assert.EqualError(t, config.Validate(), "bind_upn needs a domain or userPrincipalName in attributes")
+}
+
+func TestClient_GroupFilterTwoValues(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.GroupFilter = "(|(member=%s)(memberUid=%s))"
+	lc := newFakeClient(t, config, conn)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 2)
+	assert.Equal(t, "(|(member=uid=fry,ou=people,dc=example,dc=com)(memberUid=fry))", conn.searches[1].Filter)
+}
+
+func TestGroupFilterArgs(t *testing.T) {
+	for filter, expected := range map[string]int{
+		"(member=%s)":                    1,
+		"(|(member=%s)(memberUid=%s))":   2,
+		"(&(memberUid=%[2]s)(cn=100%%))": 2,
+		"(|(member=%[1]s)(owner=%[1]s))": 1,
+	} {
+		n, err := groupFilterArgs(filter)
+		require.NoError(t, err, filter)
+		assert.Equal(t, expected, n, filter)
+	}
+	for _, filter := range []string{
+		"(objectClass=group)",
+		"(member=%d)",
+		"(|(member=%s)(memberUid=%s)(owner=%s))",
+		"(member=%[3]s)",
+		"(member=%[1s)",
+	} {
+		_, err := groupFilterArgs(filter)
+		assert.Error(t, err, filter)
+	}
+}
+
+func TestClient_GetUserMissingAttributes(t *testing.T) {
+	// the directory withholds mail, e.g. because of an ACL
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.Attributes = append(config.Attributes, "mail")
+	lc := newFakeClient(t, config, conn)
+
+	attrs, err := lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, "", attrs["mail"])
+	assert.Equal(t, []string{"mail"}, attrs[MissingAttributesKey])
+	assert.Contains(t, conn.searches[0].Attributes, "mail")
+
+	lc = newFakeClient(t, fakeUserConfig(), &fakeConn{searchFn: entriesResult(fakeUser)})
+	attrs, err = lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.NotContains(t, attrs, MissingAttributesKey)
+}
+
+func TestClient_EmptyPassword(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	valid, _, err := lc.Authenticate("fry", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	assert.False(t, valid)
+	assert.Empty(t, conn.searches)
+	assert.Empty(t, conn.binds)
+
+	config := fakeUserConfig()
+	config.AllowEmptyPassword = true
+	lc = newFakeClient(t, config, conn)
+	valid, _, err = lc.Authenticate("fry", "")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []string{fakeUser.DN}, conn.binds)
+}
+
+func TestClient_GetUserReferral(t *testing.T) {
+	conn := &fakeConn{searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		sr := &ldap.SearchResult{Referrals: []string{"ldap://replica.example.com/ou=people,dc=example,dc=com"}}
+		return sr, ldap.NewError(ldap.LDAPResultReferral, errors.New("Referral:\nldap://master.example.com/dc=example,dc=com"))
+	}}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	_, err := lc.GetUser("fry")
+	assert.True(t, errors.Is(err, ErrReferral))
+	var referralErr *ReferralError
+	require.True(t, errors.As(err, &referralErr))
+	assert.Equal(t, []string{
+		"ldap://replica.example.com/ou=people,dc=example,dc=com",
+		"ldap://master.example.com/dc=example,dc=com",
+	}, referralErr.URLs)
+
+	// a referral is an answer, the connection stays pooled
+	assert.Equal(t, 1, lc.searchPool.Len())
+}
+
+func TestClient_GetUserGroupsWithConn(t *testing.T) {
+	group := &ldap.Entry{
+		DN:         "cn=crew,ou=groups,dc=example,dc=com",
+		Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"crew"}}},
+	}
+	search := func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.HasPrefix(req.Filter, "(member=") {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{group}}, nil
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+	}
+	var conns []*fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{searchFn: search}
+		conns = append(conns, conn)
+		return conn
+	}}
+	lc, err := NewClient(dialerTestConfig(), 2, 2, 0, 1, time.Hour, WithDialer(dialer), WithConfig(func(c *LdapConfig) {
+		config := fakeUserConfig()
+		c.Base, c.UserFilter, c.Attributes = config.Base, config.UserFilter, config.Attributes
+		c.GroupFilter, c.GroupMemberAttribute, c.GroupNameAttribute = config.GroupFilter, config.GroupMemberAttribute, config.GroupNameAttribute
+	}))
+	require.NoError(t, err)
+	defer lc.Close()
+	lc.searchPool.(*channelPool).AliveChecks(false)
+
+	conn, err := lc.SearchConn()
+	require.NoError(t, err)
+	attrs, err := lc.GetUserWithConn(conn, "fry")
+	require.NoError(t, err)
+	assert.Equal(t, fakeUser.DN, attrs["dn"])
+	groups, err := lc.GetUserGroupsWithConn(conn, "fry")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"crew": group.DN}, groups)
+	conn.Close()
+
+	// every search ran on the checked out connection
+	used := conn.Conn.(*fakeConn)
+	assert.Len(t, used.searches, 3)
+	for _, other := range conns {
+		if other != used {
+			assert.Empty(t, other.searches)
+		}
+	}
+}
+
+func TestClient_GetUserMultiValuedOrder(t *testing.T) {
+	addresses := []string{"smtp:fry@planetexpress.com", "SMTP:philip.fry@example.com", "x500:/o=PlanetExpress/cn=fry", "smtp:pjf@example.com"}
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: append(append([]*ldap.EntryAttribute(nil), fakeUser.Attributes...),
+			&ldap.EntryAttribute{Name: "proxyAddresses", Values: addresses},
+			&ldap.EntryAttribute{Name: "badPwdCount", Values: []string{"3", "1", "2"}},
+		),
+	}
+	config := fakeUserConfig()
+	config.Attributes = append(config.Attributes, "proxyaddresses", "badPwdCount")
+	config.MultiValuedAttributes = []string{"proxyAddresses", "badPwdCount"}
+	config.AttributeMap = map[string]string{"badPwdCount": ":int"}
+	lc := newFakeClient(t, config, &fakeConn{searchFn: entriesResult(user)})
+
+	for i := 0; i < 5; i++ {
+		attrs, err := lc.GetUser("fry")
+		require.NoError(t, err)
+		assert.Equal(t, addresses, attrs["proxyaddresses"])
+		assert.Equal(t, []interface{}{int64(3), int64(1), int64(2)}, attrs["badPwdCount"])
+		assert.Equal(t, "fry", attrs["uid"])
+	}
+}
+
+// newConnClient returns a Client with one search pool connection, recording
+// every connection its dialer creates.
+func newConnClient(t *testing.T) (*Client, *fakeDialer, func() []*fakeConn) {
+	var conns []*fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+		conns = append(conns, conn)
+		return conn
+	}}
+	lc, err := NewClient(dialerTestConfig(), 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	t.Cleanup(lc.Close)
+	lc.searchPool.(*channelPool).AliveChecks(false)
+	return lc, dialer, func() []*fakeConn {
+		dialer.mu.Lock()
+		defer dialer.mu.Unlock()
+		return append([]*fakeConn(nil), conns...)
+	}
+}
+
+func TestClient_Conn(t *testing.T) {
+	lc, dialer, created := newConnClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn, err := lc.Conn(ctx)
+	require.NoError(t, err)
+	_, err = lc.GetUserWithConn(conn, "fry")
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, 1, lc.searchPool.Len())
+
+	// the context ending after Close changes nothing
+	cancel()
+	conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, lc.searchPool.Len())
+	assert.Equal(t, 1, lc.searchPool.Stats().Open)
+	assert.Equal(t, 1, dialer.dialCount())
+	assert.False(t, created()[0].isClosed())
+
+	// contexts that never end don't leave goroutines behind
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		conn, err := lc.Conn(context.WithoutCancel(ctx))
+		require.NoError(t, err)
+		conn.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		conn, err = lc.Conn(ctx)
+		require.NoError(t, err)
+		conn.Close()
+		cancel()
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before+5)
+}
+
+func TestClient_ConnContextCancel(t *testing.T) {
+	lc, dialer, created := newConnClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn, err := lc.Conn(ctx)
+	require.NoError(t, err)
+	cancel()
+
+	// retired and replaced without Close
+	assert.Eventually(t, func() bool { return lc.searchPool.Len() == 1 }, time.Second, time.Millisecond)
+	assert.True(t, created()[0].isClosed())
+	assert.Equal(t, 2, dialer.dialCount())
+	assert.Equal(t, 1, lc.searchPool.Stats().Open)
+
+	// closing it afterwards doesn't return the dead connection
+	conn.Close()
+	assert.Equal(t, 1, lc.searchPool.Len())
+	assert.Equal(t, 1, lc.searchPool.Stats().Open)
+	again, err := lc.SearchConn()
+	require.NoError(t, err)
+	defer again.Close()
+	assert.Same(t, created()[1], again.Conn)
+}
+
+func TestClient_ConnContextCancelRetry(t *testing.T) {
+	var conns []*fakeConn
+	started := make(chan struct{})
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+		if len(conns) == 0 {
+			// the first search runs until the connection is closed under it
+			conn.searchFn = func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+				close(started)
+				for !conn.isClosed() {
+					time.Sleep(time.Millisecond)
+				}
+				return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed"))
+			}
+		}
+		conns = append(conns, conn)
+		return conn
+	}}
+	config := dialerTestConfig()
+	config.RetryOnNetworkError = true
+	lc, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+	lc.searchPool.(*channelPool).AliveChecks(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := lc.Conn(ctx)
+	require.NoError(t, err)
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	// the search isn't retried on a connection the pool has lost track of
+	_, err = lc.GetUserWithConn(conn, "fry")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.ErrorNetwork))
+	conn.Close()
+	assert.Eventually(t, func() bool { return lc.searchPool.Len() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, 1, lc.searchPool.Stats().Open)
+	idle, err := lc.SearchConn()
+	require.NoError(t, err)
+	defer idle.Close()
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	for _, created := range conns {
+		assert.Equal(t, created != idle.Conn, created.isClosed())
+	}
+}
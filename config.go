@@ -1,22 +1,435 @@
 package pooldap
 
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/ldap.v2"
+)
+
 type LdapConfig struct {
-	Host                 string            `mapstructure:"host"`
-	Port                 int               `mapstructure:"port"`
-	Attributes           []string          `mapstructure:"attributes"`
-	AttributeMap         map[string]string `mapstructure:"attribute_map"`
-	EmailAttributes      []string          `mapstructure:"email_attributes"`
-	Base                 string            `mapstructure:"base"`
-	BindDN               string            `mapstructure:"bind_dn"`
-	BindPassword         string            `mapstructure:"bind_password"`
-	GroupFilter          string            `mapstructure:"group_filter"`
-	GroupNameAttribute   string            `mapstructure:"group_name_attribute"`
-	GroupMemberAttribute string            `mapstructure:"group_member_attribute"`
-	ServerName           string            `mapstructure:"server_name"`
-	UserFilter           string            `mapstructure:"user_filter"`
-	Uid                  string            `mapstructure:"uid"`
-	UseSSL               bool              `mapstructure:"use_ssl"`
-	InsecureSkipVerify   bool              `mapstructure:"insecure_skip_verify"`
-	SkipTLS              bool              `mapstructure:"skip_tls"`
-	LogLevel             string            `mapstructure:"log_level"`
+	Host                     string            `mapstructure:"host"`
+	Hosts                    []string          `mapstructure:"hosts"`
+	Port                     int               `mapstructure:"port"`
+	Attributes               []string          `mapstructure:"attributes"`
+	AttributeMap             map[string]string `mapstructure:"attribute_map"` // LDAP attribute to "name" or "name:transform"
+	EmailAttributes          []string          `mapstructure:"email_attributes"`
+	Base                     string            `mapstructure:"base"`
+	UserBase                 string            `mapstructure:"user_base"`
+	GroupBase                string            `mapstructure:"group_base"`
+	BindDN                   string            `mapstructure:"bind_dn"`
+	BindPassword             string            `mapstructure:"bind_password"`
+	BindPasswordFile         string            `mapstructure:"bind_password_file"`
+	BindPasswordEnv          string            `mapstructure:"bind_password_env"`
+	BindPoolAsService        bool              `mapstructure:"bind_pool_as_service"`
+	GroupFilter              string            `mapstructure:"group_filter"`
+	GroupNameAttribute       string            `mapstructure:"group_name_attribute"`
+	GroupMemberAttribute     string            `mapstructure:"group_member_attribute"`
+	GroupMembersAttribute    string            `mapstructure:"group_members_attribute"`
+	ServerName               string            `mapstructure:"server_name"`
+	UserFilter               string            `mapstructure:"user_filter"`
+	Uid                      string            `mapstructure:"uid"`
+	UseSSL                   bool              `mapstructure:"use_ssl"`
+	InsecureSkipVerify       bool              `mapstructure:"insecure_skip_verify"`
+	SkipTLS                  bool              `mapstructure:"skip_tls"`
+	RequireSecureBind        bool              `mapstructure:"require_secure_bind"`
+	LogLevel                 string            `mapstructure:"log_level"`
+	DialRetries              int               `mapstructure:"dial_retries"`
+	DialBackoff              time.Duration     `mapstructure:"dial_backoff"`
+	ReadOnly                 bool              `mapstructure:"read_only"`
+	FairQueue                bool              `mapstructure:"fair_queue"`
+	AllowOverflow            bool              `mapstructure:"allow_overflow"`
+	MaxUsesPerConn           int               `mapstructure:"max_uses_per_conn"`
+	MaxConnLifetime          time.Duration     `mapstructure:"max_conn_lifetime"`
+	MaxConnIdleTime          time.Duration     `mapstructure:"max_conn_idle_time"`
+	DNKey                    string            `mapstructure:"dn_key"`
+	UserSearchScope          string            `mapstructure:"user_search_scope"`
+	GroupSearchScope         string            `mapstructure:"group_search_scope"`
+	OnMultipleMatch          string            `mapstructure:"on_multiple_match"`
+	BinaryAttributes         []string          `mapstructure:"binary_attributes"`
+	BorrowSearchConns        bool              `mapstructure:"borrow_search_conns"`
+	BindPoolTimeout          time.Duration     `mapstructure:"bind_pool_timeout"`
+	GroupCacheTTL            time.Duration     `mapstructure:"group_cache_ttl"`
+	GroupCacheSize           int               `mapstructure:"group_cache_size"`
+	RefillProbe              bool              `mapstructure:"refill_probe"`
+	PreferredLanguages       []string          `mapstructure:"preferred_languages"`
+	SizeLimit                int               `mapstructure:"size_limit"`
+	TimeLimit                time.Duration     `mapstructure:"time_limit"`
+	DetectLeaks              bool              `mapstructure:"detect_leaks"`
+	LeakThreshold            time.Duration     `mapstructure:"leak_threshold"`
+	BindFormats              []string          `mapstructure:"bind_formats"` // at most maxBindFormats, each try counts toward lockout
+	MaxOpenConns             int               `mapstructure:"max_open_conns"`
+	MaxIdleConns             int               `mapstructure:"max_idle_conns"`
+	TokenGroups              bool              `mapstructure:"token_groups"`
+	LazyBind                 bool              `mapstructure:"lazy_bind"`
+	RequestTimeout           time.Duration     `mapstructure:"request_timeout"`
+	RetryOnNetworkError      bool              `mapstructure:"retry_on_network_error"`
+	AllowEmptyPassword       bool              `mapstructure:"allow_empty_password"`
+	RequireInitialConnection bool              `mapstructure:"require_initial_connection"`
+	ClientCertFile           string            `mapstructure:"client_cert_file"`
+	ClientKeyFile            string            `mapstructure:"client_key_file"`
+	BusyRetries              int               `mapstructure:"busy_retries"`
+	BusyBackoff              time.Duration     `mapstructure:"busy_backoff"`
+	MultiValuedAttributes    []string          `mapstructure:"multi_valued_attributes"`
+	BindUPN                  bool              `mapstructure:"bind_upn"`
+	Domain                   string            `mapstructure:"domain"`
+	GroupMembership          string            `mapstructure:"group_membership"`
+	ServerType               string            `mapstructure:"server_type"`
+	EmailFilter              string            `mapstructure:"email_filter"`
+	CaseExactAttributes      []string          `mapstructure:"case_exact_attributes"`
+	WarmupConcurrency        int               `mapstructure:"warmup_concurrency"`
+}
+
+// LoadConfig reads an LdapConfig from the file at path, in any format viper
+// understands, e.g. YAML. Keys that don't match a field are an error rather
+// than being ignored, and the result must pass Validate.
+func LoadConfig(path string) (config LdapConfig, err error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err = v.ReadInConfig(); err != nil {
+		return config, errors.Wrapf(err, "reading config %s", path)
+	}
+	if err = v.UnmarshalExact(&config); err != nil {
+		return config, errors.Wrapf(err, "decoding config %s", path)
+	}
+	if err = config.Validate(); err != nil {
+		return config, errors.Wrapf(err, "config %s", path)
+	}
+	return config, nil
+}
+
+// Validate reports the first required setting that is missing or setting
+// that has a value the client doesn't understand. Settings are named by
+// their config file keys.
+func (c LdapConfig) Validate() error {
+	switch {
+	case c.Host == "":
+		return errors.New("host is required")
+	case c.Port <= 0:
+		return errors.New("port is required")
+	case c.userBase() == "":
+		return errors.New("base or user_base is required")
+	case !strings.Contains(c.UserFilter, "%s"):
+		return errors.New("user_filter is required and must contain %s for the username")
+	case c.DialRetries < 0 || c.BusyRetries < 0 || c.SizeLimit < 0 || c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.WarmupConcurrency < 0:
+		return errors.New("dial_retries, busy_retries, size_limit, max_open_conns, max_idle_conns and warmup_concurrency can't be negative")
+	case (c.ClientCertFile == "") != (c.ClientKeyFile == ""):
+		return errors.New("client_cert_file and client_key_file must be set together")
+	case c.EmailFilter != "" && !strings.Contains(c.EmailFilter, "%s"):
+		return errors.New("email_filter must contain %s for the email address")
+	case c.BindUPN && c.Domain == "" && !containsFold(c.Attributes, userPrincipalNameAttribute):
+		return errors.New("bind_upn needs a domain or userPrincipalName in attributes")
+	case len(c.BindFormats) > maxBindFormats:
+		return errors.Errorf("bind_formats takes at most %d formats, as every bind attempt counts toward account lockout", maxBindFormats)
+	}
+	// in order, so the same config always fails with the same error
+	for _, setting := range []struct{ key, scope string }{
+		{"user_search_scope", c.UserSearchScope},
+		{"group_search_scope", c.GroupSearchScope},
+	} {
+		if !containsString([]string{"", "sub", "one", "base"}, strings.ToLower(setting.scope)) {
+			return errors.Errorf("%s %q is not one of sub, one or base", setting.key, setting.scope)
+		}
+	}
+	if !containsString([]string{"", "ad", "openldap", "389ds"}, strings.ToLower(c.ServerType)) {
+		return errors.Errorf("server_type %q is not one of ad, openldap or 389ds", c.ServerType)
+	}
+	if !containsString([]string{"", "error", "first", "last"}, strings.ToLower(c.OnMultipleMatch)) {
+		return errors.Errorf("on_multiple_match %q is not one of error, first or last", c.OnMultipleMatch)
+	}
+	if c.GroupFilter != "" {
+		if _, err := groupFilterArgs(c.GroupFilter); err != nil {
+			return err
+		}
+	}
+	switch strings.ToLower(c.GroupMembership) {
+	case "", "dn":
+	case "uid":
+		if !containsFold(c.Attributes, c.uid()) {
+			return errors.Errorf("group_membership uid needs %s in attributes", c.uid())
+		}
+	default:
+		return errors.Errorf("group_membership %q is not one of dn or uid", c.GroupMembership)
+	}
+	return c.checkAttributeMap()
+}
+
+// bindPassword returns the service account password from BindPasswordFile or
+// the environment variable named by BindPasswordEnv, in that order, so it can
+// come from a mounted Kubernetes or Vault secret instead of the config file.
+// Without either it returns BindPassword. Trailing newlines in the file are
+// dropped. The secret is read once, when the Client is created; Clone and
+// SetBindCredentials don't read it again.
+func (c LdapConfig) bindPassword() (string, error) {
+	if c.BindPasswordFile != "" {
+		b, err := os.ReadFile(c.BindPasswordFile)
+		if err != nil {
+			return "", errors.Wrap(err, "reading bind_password_file")
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if c.BindPasswordEnv != "" {
+		password, ok := os.LookupEnv(c.BindPasswordEnv)
+		if !ok {
+			return "", errors.Errorf("bind_password_env: %s is not set", c.BindPasswordEnv)
+		}
+		return password, nil
+	}
+	return c.BindPassword, nil
+}
+
+// clientCertificate loads the key pair in ClientCertFile and ClientKeyFile.
+// It returns nil if neither is set.
+func (c LdapConfig) clientCertificate() (*tls.Certificate, error) {
+	if c.ClientCertFile == "" && c.ClientKeyFile == "" {
+		return nil, nil
+	}
+	if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+		return nil, errors.New("client_cert_file and client_key_file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading client certificate")
+	}
+	return &cert, nil
+}
+
+// defaultDialBackoff is the delay before the first dial retry when
+// DialRetries is set without a DialBackoff.
+const defaultDialBackoff = 100 * time.Millisecond
+
+// searchScope maps a configured scope name ("sub", "one" or "base") to the
+// ldap scope constant. Anything else, including "", is a subtree search.
+func searchScope(scope string) int {
+	switch strings.ToLower(scope) {
+	case "one":
+		return ldap.ScopeSingleLevel
+	case "base":
+		return ldap.ScopeBaseObject
+	default:
+		return ldap.ScopeWholeSubtree
+	}
+}
+
+// userBase returns the base DN for user searches, falling back to Base.
+func (c LdapConfig) userBase() string {
+	if c.UserBase != "" {
+		return c.UserBase
+	}
+	return c.Base
+}
+
+// groupBase returns the base DN for group searches, falling back to Base.
+func (c LdapConfig) groupBase() string {
+	if c.GroupBase != "" {
+		return c.GroupBase
+	}
+	return c.Base
+}
+
+// serverName returns the name used to verify the certificate of host,
+// falling back to host itself.
+func (c LdapConfig) serverName(host string) string {
+	if c.ServerName != "" {
+		return c.ServerName
+	}
+	return host
+}
+
+// hosts returns Host followed by the replicas in Hosts, without duplicates.
+func (c LdapConfig) hosts() []string {
+	hosts := []string{c.Host}
+	for _, host := range c.Hosts {
+		if host != "" && !containsString(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// multipleMatchEntry picks the entry GetUser uses when more than one matched,
+// following OnMultipleMatch: "first", "last", or "error" (the default), in
+// which case it returns nil.
+func (c LdapConfig) multipleMatchEntry(entries []*ldap.Entry) *ldap.Entry {
+	switch strings.ToLower(c.OnMultipleMatch) {
+	case "first":
+		return entries[0]
+	case "last":
+		return entries[len(entries)-1]
+	default:
+		return nil
+	}
+}
+
+// isBinary reports whether attribute is listed in BinaryAttributes.
+func (c LdapConfig) isBinary(attribute string) bool {
+	for _, binary := range c.BinaryAttributes {
+		if strings.EqualFold(binary, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMultiValued reports whether attribute is listed in MultiValuedAttributes.
+func (c LdapConfig) isMultiValued(attribute string) bool {
+	for _, multi := range c.MultiValuedAttributes {
+		if strings.EqualFold(multi, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeLimit returns TimeLimit in whole seconds, rounded up, as sent in search
+// requests. Zero leaves the limit to the server.
+func (c LdapConfig) timeLimit() int {
+	return int((c.TimeLimit + time.Second - 1) / time.Second)
+}
+
+// dnKey returns the key under which GetUser stores the entry DN.
+func (c LdapConfig) dnKey() string {
+	if c.DNKey != "" {
+		return c.DNKey
+	}
+	return "dn"
+}
+
+// emailFilter returns the filter GetUserByEmail searches with: EmailFilter
+// with every %s replaced by the escaped email, or by default a match of
+// email on any of EmailAttributes, or mail without them, limited to people.
+// Active Directory's proxyAddresses is matched as an smtp: address, covering
+// secondary addresses; the comparison is case-insensitive, so the primary
+// SMTP: one matches too. On Active Directory, i.e. with ServerType ad or
+// proxyAddresses among EmailAttributes, people are user objects, leaving out
+// the contacts and mail-enabled groups that may share an address.
+func (c LdapConfig) emailFilter(email string) string {
+	value := EscapeValue(email)
+	if c.EmailFilter != "" {
+		return strings.ReplaceAll(c.EmailFilter, "%s", value)
+	}
+	attributes := c.EmailAttributes
+	if len(attributes) == 0 {
+		attributes = []string{"mail"}
+	}
+	var filter strings.Builder
+	for _, attr := range attributes {
+		if strings.EqualFold(attr, "proxyAddresses") {
+			fmt.Fprintf(&filter, "(%s=smtp:%s)", attr, value)
+			continue
+		}
+		fmt.Fprintf(&filter, "(%s=%s)", attr, value)
+	}
+	match := filter.String()
+	if len(attributes) > 1 {
+		match = "(|" + match + ")"
+	}
+	person := "(objectClass=person)"
+	if strings.EqualFold(c.ServerType, string(ServerTypeActiveDirectory)) || containsFold(attributes, "proxyAddresses") {
+		person = "(objectCategory=person)(objectClass=user)"
+	}
+	return "(&" + person + match + ")"
+}
+
+// uid returns the attribute holding a user's POSIX uid, "uid" by default.
+func (c LdapConfig) uid() string {
+	if c.Uid != "" {
+		return c.Uid
+	}
+	return "uid"
+}
+
+// groupMember returns the user attribute whose value GroupFilter matches
+// group members against, and the key GetUser stores it under. That is
+// GroupMemberAttribute, typically the DN, or with GroupMembership "uid" the
+// Uid attribute, for POSIX groups listing members by memberUid. The DN is
+// stored under dnKey, other attributes under their AttributeMap name.
+func (c LdapConfig) groupMember() (attribute, key string) {
+	attribute = c.GroupMemberAttribute
+	if strings.EqualFold(c.GroupMembership, "uid") {
+		attribute = c.uid()
+	}
+	if strings.EqualFold(attribute, "dn") {
+		return attribute, c.dnKey()
+	}
+	key, _ = c.attributeMapping(attribute)
+	return attribute, key
+}
+
+// groupFilterArgs returns how many values GroupFilter takes. The first %s is
+// the user's group member value, see groupMember, and the second, if any, the username,
+// e.g. "(|(member=%s)(memberUid=%s))". Explicit indexes such as %[2]s may
+// reorder or repeat them.
+func groupFilterArgs(filter string) (int, error) {
+	n, next := 0, 1
+	for i := 0; i < len(filter); i++ {
+		if filter[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(filter) && filter[i] == '%' {
+			continue
+		}
+		arg := next
+		if i < len(filter) && filter[i] == '[' {
+			end := strings.IndexByte(filter[i:], ']')
+			if end < 0 {
+				return 0, errors.Errorf("group filter %q: unterminated argument index", filter)
+			}
+			var err error
+			if arg, err = strconv.Atoi(filter[i+1 : i+end]); err != nil {
+				return 0, errors.Errorf("group filter %q: bad argument index", filter)
+			}
+			i += end + 1
+		}
+		if i >= len(filter) || filter[i] != 's' {
+			return 0, errors.Errorf("group filter %q: only %%s verbs are supported", filter)
+		}
+		if arg < 1 || arg > 2 {
+			return 0, errors.Errorf("group filter %q: takes at most two values, the member and the username", filter)
+		}
+		if arg > n {
+			n = arg
+		}
+		next = arg + 1
+	}
+	if n == 0 {
+		return 0, errors.Errorf("group filter %q: has no %%s for the member value", filter)
+	}
+	return n, nil
+}
+
+// groupFilter fills GroupFilter in with the escaped member value and
+// username.
+func (c LdapConfig) groupFilter(member, username string) (string, error) {
+	n, err := groupFilterArgs(c.GroupFilter)
+	if err != nil {
+		return "", err
+	}
+	args := []interface{}{EscapeValue(member), EscapeValue(username)}
+	return fmt.Sprintf(c.GroupFilter, args[:n]...), nil
 }
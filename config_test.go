@@ -0,0 +1,200 @@
+package pooldap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validConfigYAML = `
+host: ldap.example.com
+port: 636
+use_ssl: true
+base: "dc=example,dc=com"
+attributes:
+  - uid
+  - cn
+user_filter: (uid=%s)
+group_filter: "(member=%s)"
+group_name_attribute: cn
+time_limit: 5s
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "ldap.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, validConfigYAML))
+	require.NoError(t, err)
+	assert.Equal(t, "ldap.example.com", config.Host)
+	assert.Equal(t, 636, config.Port)
+	assert.True(t, config.UseSSL)
+	assert.Equal(t, []string{"uid", "cn"}, config.Attributes)
+	assert.Equal(t, 5*time.Second, config.TimeLimit)
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, validConfigYAML+"group_fliter: (memberUid=%s)\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "group_fliter")
+}
+
+func TestLoadConfigMissingRequired(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, "host: ldap.example.com\nport: 389\nuser_filter: (uid=%s)\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "base")
+}
+
+func TestLdapConfig_Validate(t *testing.T) {
+	valid := LdapConfig{Host: "ldap.example.com", Port: 389, Base: "dc=example,dc=com", UserFilter: "(uid=%s)"}
+	require.NoError(t, valid.Validate())
+
+	for name, change := range map[string]func(*LdapConfig){
+		"host":         func(c *LdapConfig) { c.Host = "" },
+		"port":         func(c *LdapConfig) { c.Port = 0 },
+		"user filter":  func(c *LdapConfig) { c.UserFilter = "(uid=fry)" },
+		"scope":        func(c *LdapConfig) { c.GroupSearchScope = "children" },
+		"match":        func(c *LdapConfig) { c.OnMultipleMatch = "any" },
+		"group filter": func(c *LdapConfig) { c.GroupFilter = "(member=%d)" },
+		"size limit":   func(c *LdapConfig) { c.SizeLimit = -1 },
+	} {
+		config := valid
+		change(&config)
+		assert.Error(t, config.Validate(), name)
+	}
+}
+
+func TestLdapConfig_ValidateScopeOrder(t *testing.T) {
+	config := LdapConfig{Host: "ldap.example.com", Port: 389, Base: "dc=example,dc=com", UserFilter: "(uid=%s)",
+		UserSearchScope: "children", GroupSearchScope: "subordinate"}
+	for i := 0; i < 20; i++ {
+		err := config.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "user_search_scope")
+	}
+}
+
+func TestLdapConfig_BindPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bind_password")
+	require.NoError(t, os.WriteFile(path, []byte("s3cret\n"), 0600))
+
+	var bound string
+	conn := func() *fakeConn {
+		return &fakeConn{bindFn: func(username, password string) error {
+			bound = password
+			return nil
+		}}
+	}
+	config := dialerTestConfig()
+	config.BindDN = "cn=service"
+	config.BindPassword = "inline"
+	config.BindPasswordFile = path
+	lc, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(&fakeDialer{conn: conn}))
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Equal(t, "s3cret", bound)
+	_, password := lc.bindCredentials()
+	assert.Equal(t, "s3cret", password)
+}
+
+func TestLdapConfig_BindPasswordFileClone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bind_password")
+	require.NoError(t, os.WriteFile(path, []byte("s3cret\n"), 0600))
+
+	config := dialerTestConfig()
+	config.BindDN = "cn=service"
+	config.BindPasswordFile = path
+	dialer := WithDialer(&fakeDialer{conn: func() *fakeConn { return &fakeConn{} }})
+	lc, err := NewClient(config, 0, 1, 0, 1, time.Hour, dialer)
+	require.NoError(t, err)
+	defer lc.Close()
+
+	// an explicit password wins over the file
+	clone, err := lc.Clone(WithBindCredentials("cn=other", "explicit"))
+	require.NoError(t, err)
+	defer clone.Close()
+	dn, password := clone.bindCredentials()
+	assert.Equal(t, "cn=other", dn)
+	assert.Equal(t, "explicit", password)
+
+	explicit, err := NewClient(config, 0, 1, 0, 1, time.Hour, dialer, WithBindCredentials("cn=service", "explicit"))
+	require.NoError(t, err)
+	defer explicit.Close()
+	_, password = explicit.bindCredentials()
+	assert.Equal(t, "explicit", password)
+
+	// a rotated password is kept, the file isn't read again
+	require.NoError(t, lc.SetBindCredentials("cn=service", "rotated"))
+	require.NoError(t, os.Remove(path))
+	clone, err = lc.Clone()
+	require.NoError(t, err)
+	defer clone.Close()
+	_, password = clone.bindCredentials()
+	assert.Equal(t, "rotated", password)
+}
+
+func TestLdapConfig_BindPasswordFileMissing(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindPasswordFile = filepath.Join(t.TempDir(), "missing")
+	_, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(&fakeDialer{}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bind_password_file")
+}
+
+func TestLdapConfig_BindPasswordEnv(t *testing.T) {
+	t.Setenv("POOLDAP_TEST_BIND_PASSWORD", "from-env")
+	config := LdapConfig{BindPassword: "inline", BindPasswordEnv: "POOLDAP_TEST_BIND_PASSWORD"}
+	password, err := config.bindPassword()
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", password)
+
+	config.BindPasswordEnv = "POOLDAP_TEST_UNSET"
+	_, err = config.bindPassword()
+	assert.Error(t, err)
+
+	config.BindPasswordEnv = ""
+	password, err = config.bindPassword()
+	require.NoError(t, err)
+	assert.Equal(t, "inline", password)
+}
+
+func TestLdapConfig_ClientCertificate(t *testing.T) {
+	config := dialerTestConfig()
+	config.UseSSL = true
+	config.ClientCertFile = "testdata/client.crt"
+	config.ClientKeyFile = "testdata/client.key"
+	dialer := &fakeDialer{}
+	lc, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+	require.Len(t, lc.ClientCertificates, 1)
+	require.NotNil(t, dialer.tlsConfig)
+	assert.Len(t, dialer.tlsConfig.Certificates, 1)
+
+	// a clone doesn't load the pair a second time
+	clone, err := lc.Clone()
+	require.NoError(t, err)
+	defer clone.Close()
+	assert.Len(t, clone.ClientCertificates, 1)
+}
+
+func TestLdapConfig_ClientCertificateErrors(t *testing.T) {
+	config := dialerTestConfig()
+	config.ClientCertFile = "testdata/client.crt"
+	_, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(&fakeDialer{}))
+	assert.EqualError(t, err, "client_cert_file and client_key_file must be set together")
+
+	config.ClientKeyFile = "testdata/missing.key"
+	_, err = NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(&fakeDialer{}))
+	assert.Error(t, err)
+
+	valid := LdapConfig{Host: "ldap", Port: 636, Base: "dc=example,dc=com", UserFilter: "(uid=%s)", ClientKeyFile: "client.key"}
+	assert.Error(t, valid.Validate())
+}
@@ -1,17 +1,77 @@
 package pooldap
 
 import (
+	"context"
+	"crypto/tls"
+	"sync"
+
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/ldap.v2"
 	"time"
 )
 
+var _ ldap.Client = (*PoolConn)(nil)
+
 // PoolConn implements Client to override the Close() method
 type PoolConn struct {
 	Conn     ldap.Client
 	c        *channelPool
 	unusable bool
-	closeAt  []uint8
+	// set once Unbind was sent, so closing doesn't send another
+	unbound bool
+	// set by SetTimeout, so Close restores the pool's timeout
+	timeoutSet bool
+	closeAt    []uint8
+	// operations served during this checkout
+	uses int
+	// set when Config.DetectLeaks is on
+	leak *leakCheck
+	// DN bound as by Rebind or RebindService during this checkout
+	identity string
+	// set by Rebind, so Close restores the service account
+	rebound bool
+	// set once a bind left the connection bound as another identity than
+	// the pool's, so operations aren't retried on a fresh connection
+	bound bool
+	// set for connections checked out with Client.Conn
+	checkout *ctxCheckout
+}
+
+// ctxCheckout ties a connection from Client.Conn to its context, so that
+// whichever of Close and the context's end comes first releases it.
+type ctxCheckout struct {
+	mu   sync.Mutex
+	done bool
+	stop func() bool
+}
+
+// finish reports whether the checkout was still open, marking it done.
+func (c *ctxCheckout) finish() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	open := !c.done
+	c.done = true
+	return open
+}
+
+// retire closes a connection whose context ended before it was returned and
+// replaces it in the pool. Operations running on it fail. Only fields that
+// don't change during the checkout are read, and Conn under the checkout's
+// lock, which reconnect swaps it under, as the holder may still be using the
+// connection.
+func (p *PoolConn) retire() {
+	p.checkout.mu.Lock()
+	if p.checkout.done {
+		p.checkout.mu.Unlock()
+		return
+	}
+	p.checkout.done = true
+	conn := p.Conn
+	p.checkout.mu.Unlock()
+	p.GetLogger().Debugf("Retiring connection whose context ended before it was closed")
+	p.closeLeak()
+	p.c.closeConn(conn)
+	p.c.replace()
 }
 
 func (p *PoolConn) Start() {
@@ -25,24 +85,122 @@ func (p *PoolConn) Close() {
 			log.Errorf("Recovered while closing LDAP Connection %s", r)
 		}
 	}()
+	if p.checkout != nil {
+		p.checkout.stop()
+		if !p.checkout.finish() {
+			// retired when its context ended
+			return
+		}
+	}
+	p.closeLeak()
+	if p.c.release(p.Conn, p.uses) && !p.unusable {
+		p.GetLogger().Debugf("Retiring connection that reached its use or lifetime limit")
+		p.unusable = true
+	}
+	if !p.unusable && p.c.stale(p.Conn) {
+		p.GetLogger().Debugf("Retiring connection created before the pool was reset")
+		p.unusable = true
+	}
+	if p.rebound && !p.unusable {
+		if err := p.RebindService(); err != nil {
+			p.GetLogger().Errorf("could not rebind as service account: %s", err)
+			p.unusable = true
+		}
+	}
+	if p.timeoutSet && !p.unusable {
+		p.Conn.SetTimeout(p.c.requestTimeout())
+		p.timeoutSet = false
+	}
 	if p.unusable {
-		p.GetLogger().Infof("Closing unusable connection")
-		if p.Conn != nil {
+		p.GetLogger().Debugf("Closing unusable connection")
+		if p.unbound {
+			p.c.forget(p.Conn)
 			p.Conn.Close()
+		} else if p.Conn != nil {
+			p.c.closeConn(p.Conn)
 		}
-		conn, _ := p.c.NewConn()
-		p.c.put(conn.Conn)
+		p.c.replace()
 		return
 	}
 	p.c.put(p.Conn)
 }
 
-func (p *PoolConn) SimpleBind(simpleBindRequest *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
-	return p.Conn.SimpleBind(simpleBindRequest)
+func (p *PoolConn) StartTLS(config *tls.Config) error {
+	p.uses++
+	return p.Conn.StartTLS(config)
+}
+
+// TLSConnectionState returns the TLS state of the connection, e.g. the
+// negotiated version and cipher suite. ok is false if the connection isn't
+// encrypted or its Dialer's connections don't implement TLSStater.
+func (p *PoolConn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	if s, isStater := p.Conn.(TLSStater); isStater {
+		return s.TLSConnectionState()
+	}
+	return state, false
+}
+
+// Unbind ends the LDAP session. The connection can't be reused afterwards,
+// so it is closed instead of returning to the pool on Close. The Unbind
+// request itself is only sent if the underlying connection supports it.
+func (p *PoolConn) Unbind() error {
+	p.unusable = true
+	if u, ok := p.Conn.(unbinder); ok {
+		p.unbound = true
+		return u.Unbind()
+	}
+	return nil
+}
+
+func (p *PoolConn) SimpleBind(simpleBindRequest *ldap.SimpleBindRequest) (result *ldap.SimpleBindResult, err error) {
+	err = p.retryBind(func() (err error) {
+		p.uses++
+		result, err = p.Conn.SimpleBind(simpleBindRequest)
+		return
+	})
+	return
 }
 
 func (p *PoolConn) Bind(username, password string) error {
-	return p.Conn.Bind(username, password)
+	return p.retryBind(func() error {
+		p.uses++
+		return p.Conn.Bind(username, password)
+	})
+}
+
+// Rebind binds the connection as dn, e.g. to act as a user for a while.
+// Close binds it as the service account again before returning it to the
+// pool, as RebindService does, even if this bind failed.
+func (p *PoolConn) Rebind(dn, password string) error {
+	p.rebound = true
+	p.identity = ""
+	if err := p.Bind(dn, password); err != nil {
+		return err
+	}
+	p.identity = dn
+	return nil
+}
+
+// RebindService binds the connection as the Client's service account, see
+// SetBindCredentials, or anonymously if there is none.
+func (p *PoolConn) RebindService() error {
+	dn, password := p.c.parentClient.bindCredentials()
+	if err := p.c.parentClient.checkSecureBind(password); err != nil {
+		return err
+	}
+	if err := p.Bind(dn, password); err != nil {
+		return err
+	}
+	p.rebound = false
+	p.bound = !p.c.serviceBound()
+	p.identity = dn
+	return nil
+}
+
+// Identity returns the DN the connection was last bound as with Rebind or
+// RebindService during this checkout, or "" if neither succeeded since.
+func (p *PoolConn) Identity() string {
+	return p.identity
 }
 
 // MarkUnusable() marks the connection not usable any more, to let the pool close it
@@ -66,35 +224,208 @@ func (p *PoolConn) AutoClose(err error) {
 	}
 }
 
+// SetTimeout sets the request timeout for the rest of this checkout. Close
+// restores Config.RequestTimeout before the connection is reused.
 func (p *PoolConn) SetTimeout(t time.Duration) {
+	p.timeoutSet = true
 	p.Conn.SetTimeout(t)
 }
 
 func (p *PoolConn) Add(addRequest *ldap.AddRequest) error {
+	if p.readOnly() {
+		return ErrReadOnly
+	}
+	p.uses++
 	return p.Conn.Add(addRequest)
 }
 
 func (p *PoolConn) Del(delRequest *ldap.DelRequest) error {
+	if p.readOnly() {
+		return ErrReadOnly
+	}
+	p.uses++
 	return p.Conn.Del(delRequest)
 }
 
 func (p *PoolConn) Modify(modifyRequest *ldap.ModifyRequest) error {
+	if p.readOnly() {
+		return ErrReadOnly
+	}
+	p.uses++
 	return p.Conn.Modify(modifyRequest)
 }
 
-func (p *PoolConn) Compare(dn, attribute, value string) (bool, error) {
-	return p.Conn.Compare(dn, attribute, value)
+// ModifyWithControls is Modify with request controls. The ldap package's
+// ModifyRequest can't carry controls, so unless controls is empty the
+// underlying connection must implement ControlModifier, as those of the
+// built-in dialers do; otherwise ErrNoControls is returned.
+func (p *PoolConn) ModifyWithControls(modifyRequest *ldap.ModifyRequest, controls []ldap.Control) error {
+	if p.readOnly() {
+		return ErrReadOnly
+	}
+	if len(controls) == 0 {
+		p.uses++
+		return p.Conn.Modify(modifyRequest)
+	}
+	modifier, ok := p.Conn.(ControlModifier)
+	if !ok {
+		return ErrNoControls
+	}
+	p.uses++
+	return modifier.ModifyWithControls(modifyRequest, controls)
+}
+
+// ModifyDN renames or moves an entry. The underlying connection must
+// implement DNModifier; otherwise ErrNoModifyDN is returned.
+func (p *PoolConn) ModifyDN(modifyDNRequest *ldap.ModifyDNRequest) error {
+	if p.readOnly() {
+		return ErrReadOnly
+	}
+	modifier, ok := p.Conn.(DNModifier)
+	if !ok {
+		return ErrNoModifyDN
+	}
+	p.uses++
+	return modifier.ModifyDN(modifyDNRequest)
+}
+
+func (p *PoolConn) Compare(dn, attribute, value string) (matched bool, err error) {
+	err = p.retry(func() (err error) {
+		p.uses++
+		matched, err = p.Conn.Compare(dn, attribute, value)
+		return
+	})
+	return
 }
 
 func (p *PoolConn) PasswordModify(passwordModifyRequest *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
+	if p.readOnly() {
+		return nil, ErrReadOnly
+	}
+	p.uses++
 	return p.Conn.PasswordModify(passwordModifyRequest)
 }
 
-func (p *PoolConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
-	return p.Conn.Search(searchRequest)
+func (p *PoolConn) Search(searchRequest *ldap.SearchRequest) (sr *ldap.SearchResult, err error) {
+	err = p.retry(func() (err error) {
+		p.uses++
+		sr, err = p.Conn.Search(searchRequest)
+		return
+	})
+	return
+}
+
+// SearchContext is Search that cancels the search on the server when ctx is
+// done first, if the connection implements ContextSearcher. Otherwise ctx is
+// ignored. A connection closed because the server wouldn't cancel doesn't
+// go back to the pool.
+func (p *PoolConn) SearchContext(ctx context.Context, searchRequest *ldap.SearchRequest) (sr *ldap.SearchResult, err error) {
+	searcher, ok := p.Conn.(ContextSearcher)
+	if !ok {
+		return p.Search(searchRequest)
+	}
+	err = p.retry(func() (err error) {
+		p.uses++
+		sr, err = searcher.SearchContext(ctx, searchRequest)
+		return
+	})
+	if c, ok := p.Conn.(interface{ closed() bool }); ok && err != nil && c.closed() {
+		p.unusable = true
+	}
+	return
 }
-func (p *PoolConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
-	return p.Conn.SearchWithPaging(searchRequest, pagingSize)
+
+func (p *PoolConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (sr *ldap.SearchResult, err error) {
+	err = p.retry(func() (err error) {
+		p.uses++
+		sr, err = p.Conn.SearchWithPaging(searchRequest, pagingSize)
+		return
+	})
+	return
+}
+
+// retry runs op and, with Config.RetryOnNetworkError set, runs it once more
+// on a fresh connection if it failed with a network error, e.g. because the
+// connection died after the alive check. Only reads and binds are retried;
+// a write that failed this way may still have been applied. Reads on a
+// connection bound as another identity, e.g. by Rebind or Authenticate,
+// aren't retried either, as the fresh connection would run them as the
+// pool's identity instead.
+func (p *PoolConn) retry(op func() error) error {
+	return p.retryIf(!p.bound, op)
+}
+
+// retryBind is retry for binds, which set the identity of the fresh
+// connection themselves. Whatever the outcome, the connection is no longer
+// bound as the pool's identity afterwards.
+func (p *PoolConn) retryBind(op func() error) error {
+	err := p.retryIf(true, op)
+	p.bound = true
+	return err
+}
+
+func (p *PoolConn) retryIf(retry bool, op func() error) error {
+	err := op()
+	if err == nil || !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || !p.retryOnNetworkError() {
+		return err
+	}
+	if !retry {
+		p.GetLogger().Infof("not retrying on a fresh connection after %s, as it isn't bound as the pool's identity", err)
+		p.unusable = true
+		return err
+	}
+	p.GetLogger().Infof("retrying on a fresh connection after %s", err)
+	if reconnectErr := p.reconnect(); reconnectErr != nil {
+		if reconnectErr != errRetired {
+			p.GetLogger().Errorf("could not replace dead connection: %s", reconnectErr)
+		}
+		p.unusable = true
+		return err
+	}
+	return op()
+}
+
+// reconnect replaces the connection with a new one from the pool's factory
+// and closes the old one. It fails with errRetired once the connection was
+// retired, which closed the old one, so the new one isn't used outside the
+// pool.
+func (p *PoolConn) reconnect() error {
+	conn, err := p.c.openConn(false)
+	if err != nil {
+		return err
+	}
+	if p.c.lazyBind {
+		if err := p.c.serviceBind(conn); err != nil {
+			p.c.closeConn(conn)
+			return err
+		}
+	}
+	old := p.Conn
+	if p.checkout == nil {
+		p.Conn = conn
+	} else {
+		p.checkout.mu.Lock()
+		retired := p.checkout.done
+		if !retired {
+			p.Conn = conn
+		}
+		p.checkout.mu.Unlock()
+		if retired {
+			p.c.closeConn(conn)
+			return errRetired
+		}
+	}
+	p.c.closeConn(old)
+	return nil
+}
+
+func (p *PoolConn) retryOnNetworkError() bool {
+	return p.c != nil && p.c.parentClient != nil && p.c.parentClient.Config.RetryOnNetworkError
+}
+
+// readOnly reports whether the parent client forbids write operations.
+func (p *PoolConn) readOnly() bool {
+	return p.c != nil && p.c.parentClient != nil && p.c.parentClient.Config.ReadOnly
 }
 
 func (p *PoolConn) GetLogger() *log.Logger {
@@ -0,0 +1,215 @@
+package pooldap
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func newFakePoolConn(config LdapConfig, conn *fakeConn) *PoolConn {
+	pool := &channelPool{parentClient: &Client{Config: config}}
+	return pool.wrapConn(conn, nil)
+}
+
+func TestPoolConn_ReadOnly(t *testing.T) {
+	fake := &fakeConn{}
+	conn := newFakePoolConn(LdapConfig{ReadOnly: true}, fake)
+
+	assert.Equal(t, ErrReadOnly, conn.Add(ldap.NewAddRequest("cn=new,dc=example,dc=com")))
+	assert.Equal(t, ErrReadOnly, conn.Del(ldap.NewDelRequest("cn=old,dc=example,dc=com", nil)))
+	assert.Equal(t, ErrReadOnly, conn.Modify(ldap.NewModifyRequest("cn=old,dc=example,dc=com")))
+	assert.Equal(t, ErrReadOnly, conn.ModifyDN(ldap.NewModifyDNRequest("cn=old,dc=example,dc=com", "cn=new", true, "")))
+	_, err := conn.PasswordModify(ldap.NewPasswordModifyRequest("cn=old,dc=example,dc=com", "old", "new"))
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Empty(t, fake.writes)
+}
+
+func TestPoolConn_ReadWrite(t *testing.T) {
+	fake := &fakeConn{}
+	conn := newFakePoolConn(LdapConfig{}, fake)
+
+	assert.NoError(t, conn.Add(ldap.NewAddRequest("cn=new,dc=example,dc=com")))
+	assert.NoError(t, conn.Del(ldap.NewDelRequest("cn=old,dc=example,dc=com", nil)))
+	assert.NoError(t, conn.ModifyDN(ldap.NewModifyDNRequest("cn=old,dc=example,dc=com", "cn=new", true, "")))
+	assert.Equal(t, []string{"add", "del", "moddn"}, fake.writes)
+
+	// the built-in dialers' connections can, others needn't
+	assert.Implements(t, (*DNModifier)(nil), &stateConn{})
+	pool := &channelPool{parentClient: &Client{}}
+	bare := pool.wrapConn(struct{ ldap.Client }{fake}, nil)
+	assert.Equal(t, ErrNoModifyDN, bare.ModifyDN(ldap.NewModifyDNRequest("cn=old,dc=example,dc=com", "cn=new", true, "")))
+}
+
+func TestPoolConn_ImplementsClient(t *testing.T) {
+	assert.Implements(t, (*ldap.Client)(nil), newFakePoolConn(LdapConfig{}, &fakeConn{}))
+}
+
+func TestPoolConn_Unbind(t *testing.T) {
+	var created []*unbindConn
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		conn := &unbindConn{}
+		created = append(created, conn)
+		return conn, nil
+	}
+	pool, err := NewChannelPool(1, 1, SharedPool, factory, &Client{}, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	require.NoError(t, conn.Unbind())
+	conn.Close()
+
+	assert.Equal(t, []string{"unbind", "close"}, created[0].calls)
+	require.Len(t, created, 2)
+	assert.Equal(t, 1, pool.Len())
+}
+
+func TestPoolConn_SetTimeoutIsPerCheckout(t *testing.T) {
+	fake := &fakeConn{}
+	pool, err := NewChannelPool(1, 1, SharedPool, func(*Client, PoolType) (ldap.Client, error) { return fake, nil },
+		&Client{Config: LdapConfig{RequestTimeout: 30 * time.Second}}, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	conn.SetTimeout(time.Millisecond)
+	assert.Equal(t, time.Millisecond, fake.timeout)
+	conn.Close()
+
+	conn, err = pool.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 30*time.Second, fake.timeout)
+}
+
+func TestPoolConn_RebindRestoresService(t *testing.T) {
+	const service = "cn=service,dc=example,dc=com"
+	fake := &fakeConn{bindFn: func(username, password string) error {
+		if password != "secret" && password != "fry" {
+			return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+		}
+		return nil
+	}}
+	client := &Client{Config: LdapConfig{BindPoolAsService: true, SkipTLS: true}}
+	client.setBindCredentials(service, "secret")
+	pool, err := NewChannelPool(1, 1, BindPool, func(*Client, PoolType) (ldap.Client, error) { return fake, nil }, client, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	require.NoError(t, conn.Rebind(fakeUser.DN, "fry"))
+	assert.Equal(t, fakeUser.DN, conn.Identity())
+	conn.Close()
+	assert.Equal(t, []string{fakeUser.DN, service}, fake.binds)
+
+	// a failed rebind leaves the connection anonymous, so it is restored too
+	conn, err = pool.Get()
+	require.NoError(t, err)
+	assert.Empty(t, conn.Identity())
+	assert.Error(t, conn.Rebind(fakeUser.DN, "wrong"))
+	assert.Empty(t, conn.Identity())
+	conn.Close()
+	assert.Equal(t, []string{fakeUser.DN, service, fakeUser.DN, service}, fake.binds)
+
+	// connections that weren't rebound go back as they are
+	conn, err = pool.Get()
+	require.NoError(t, err)
+	conn.Close()
+	assert.Len(t, fake.binds, 4)
+	assert.False(t, fake.isClosed())
+}
+
+func TestPoolConn_RetryOnNetworkError(t *testing.T) {
+	var created []*fakeConn
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+		if len(created) == 0 {
+			// the first connection dies right after the alive check
+			conn.searchFn = func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+				return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset by peer"))
+			}
+		}
+		created = append(created, conn)
+		return conn, nil
+	}
+	pool, err := NewChannelPool(1, 1, SharedPool, factory, &Client{Config: LdapConfig{RetryOnNetworkError: true}}, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	sr, err := conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil))
+	require.NoError(t, err)
+	assert.Equal(t, []*ldap.Entry{fakeUser}, sr.Entries)
+	require.Len(t, created, 2)
+	assert.True(t, created[0].isClosed())
+
+	conn.Close()
+	assert.Equal(t, 1, pool.Len())
+	assert.Equal(t, 1, pool.Stats().Open)
+}
+
+func TestPoolConn_RetryAfterRebind(t *testing.T) {
+	networkErr := ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset by peer"))
+	var created []*fakeConn
+	factory := func(*Client, PoolType) (ldap.Client, error) {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+		if len(created) == 0 {
+			conn.searchFn = func(*ldap.SearchRequest) (*ldap.SearchResult, error) { return nil, networkErr }
+		}
+		if len(created) == 1 {
+			conn.bindFn = func(string, string) error { return networkErr }
+		}
+		created = append(created, conn)
+		return conn, nil
+	}
+	client := &Client{Config: LdapConfig{RetryOnNetworkError: true}}
+	client.setBindCredentials("cn=service,dc=example,dc=com", "secret")
+	pool, err := NewChannelPool(1, 1, SharedPool, factory, client, nil, time.Hour)
+	require.NoError(t, err)
+	defer pool.Close()
+	pool.(*channelPool).AliveChecks(false)
+
+	// a search as the rebound user isn't retried as the service account
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	require.NoError(t, conn.Rebind(fakeUser.DN, "fry"))
+	_, err = conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil))
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.ErrorNetwork))
+	assert.Len(t, created[0].searches, 1)
+	conn.Close()
+	require.Len(t, created, 2)
+	assert.True(t, created[0].isClosed())
+	assert.Empty(t, created[1].binds)
+
+	// a rebind that fails this way binds the fresh connection as the user
+	conn, err = pool.Get()
+	require.NoError(t, err)
+	require.NoError(t, conn.Rebind(fakeUser.DN, "fry"))
+	require.Len(t, created, 3)
+	assert.Equal(t, []string{fakeUser.DN}, created[2].binds)
+	assert.Equal(t, fakeUser.DN, conn.Identity())
+	conn.Close()
+	assert.Equal(t, []string{fakeUser.DN, "cn=service,dc=example,dc=com"}, created[2].binds)
+}
+
+func TestPoolConn_NoRetryForWrites(t *testing.T) {
+	fake := &fakeConn{delFn: func(*ldap.DelRequest) error {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset by peer"))
+	}}
+	conn := newFakePoolConn(LdapConfig{RetryOnNetworkError: true}, fake)
+
+	assert.Error(t, conn.Del(ldap.NewDelRequest("uid=fry,ou=people,dc=example,dc=com", nil)))
+	assert.Len(t, fake.dels, 1)
+}
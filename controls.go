@@ -0,0 +1,179 @@
+package pooldap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	// ControlTypeSubtreeDelete is the Active Directory tree delete control.
+	ControlTypeSubtreeDelete = "1.2.840.113556.1.4.805"
+	// ControlTypeProxiedAuthorization is the proxied authorization control (RFC 4370).
+	ControlTypeProxiedAuthorization = "2.16.840.1.113730.3.4.18"
+)
+
+// ControlSubtreeDelete asks the server to delete an entry together with all of
+// its subordinates. It carries no value.
+type ControlSubtreeDelete struct{}
+
+// NewControlSubtreeDelete returns a critical subtree delete control.
+func NewControlSubtreeDelete() *ControlSubtreeDelete {
+	return &ControlSubtreeDelete{}
+}
+
+func (c *ControlSubtreeDelete) GetControlType() string {
+	return ControlTypeSubtreeDelete
+}
+
+func (c *ControlSubtreeDelete) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeSubtreeDelete, "Control Type (Subtree Delete)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	return packet
+}
+
+func (c *ControlSubtreeDelete) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: true", "Subtree Delete", ControlTypeSubtreeDelete)
+}
+
+// NewControlProxiedAuthorization returns a control that makes the server
+// evaluate the operation as authzID, e.g. "dn:uid=fry,ou=people,dc=example,dc=com"
+// or "u:fry", instead of the bound identity. Pass it to Client.Search or
+// Client.Modify. The server must allow the service account to proxy, e.g.
+// through authzTo in OpenLDAP, otherwise the operation fails.
+func NewControlProxiedAuthorization(authzID string) *ldap.ControlString {
+	return ldap.NewControlString(ControlTypeProxiedAuthorization, true, authzID)
+}
+
+// ControlTypeDontUseCopy is the Don't-Use-Copy control (RFC 6171).
+const ControlTypeDontUseCopy = "1.3.6.1.1.22"
+
+// ControlDontUseCopy makes the server answer a read from the original entry
+// rather than a copy such as a replica or cache, failing if it can't. It
+// carries no value and is always critical.
+type ControlDontUseCopy struct{}
+
+// NewControlDontUseCopy returns a Don't-Use-Copy control. Pass it to
+// Client.Search, together with ldap.NewControlManageDsaIT(true) to read
+// referral objects themselves instead of following them.
+func NewControlDontUseCopy() *ControlDontUseCopy {
+	return &ControlDontUseCopy{}
+}
+
+func (c *ControlDontUseCopy) GetControlType() string {
+	return ControlTypeDontUseCopy
+}
+
+func (c *ControlDontUseCopy) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeDontUseCopy, "Control Type (Don't Use Copy)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	return packet
+}
+
+func (c *ControlDontUseCopy) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: true", "Don't Use Copy", ControlTypeDontUseCopy)
+}
+
+// ControlTypeMatchedValues is the matched values control (RFC 3876).
+const ControlTypeMatchedValues = "1.2.826.0.1.3344810.2.3"
+
+// ControlMatchedValues limits the values returned for each attribute to
+// those matching Filter, e.g. only the proxyAddresses starting with SMTP:.
+// Entries are still selected by the search filter alone.
+type ControlMatchedValues struct {
+	Filter string
+	items  []*ber.Packet
+}
+
+// NewControlMatchedValues returns a critical matched values control for
+// filter, one or more simple filter items such as
+// "(proxyAddresses=SMTP:*)(mail=*@example.com)". And, or and not are not
+// allowed.
+func NewControlMatchedValues(filter string) (*ControlMatchedValues, error) {
+	var items []*ber.Packet
+	for rest := filter; rest != ""; {
+		end := strings.IndexByte(rest, ')')
+		if rest[0] != '(' || end < 0 {
+			return nil, ldap.NewError(ldap.ErrorFilterCompile, errors.New("ldap: malformed matched values filter "+filter))
+		}
+		item, err := ldap.CompileFilter(rest[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		if item.Tag == ldap.FilterAnd || item.Tag == ldap.FilterOr || item.Tag == ldap.FilterNot {
+			return nil, ldap.NewError(ldap.ErrorFilterCompile, errors.New("ldap: matched values filter items must be simple "+filter))
+		}
+		items = append(items, item)
+		rest = rest[end+1:]
+	}
+	if len(items) == 0 {
+		return nil, ldap.NewError(ldap.ErrorFilterCompile, errors.New("ldap: empty matched values filter"))
+	}
+	return &ControlMatchedValues{Filter: filter, items: items}, nil
+}
+
+func (c *ControlMatchedValues) GetControlType() string {
+	return ControlTypeMatchedValues
+}
+
+func (c *ControlMatchedValues) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeMatchedValues, "Control Type (Matched Values)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Matched Values)")
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Values Return Filter")
+	for _, item := range c.items {
+		seq.AppendChild(item)
+	}
+	value.AppendChild(seq)
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *ControlMatchedValues) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: true  Filter: %s", "Matched Values", ControlTypeMatchedValues, c.Filter)
+}
+
+// ControlTypeAssertion is the assertion control (RFC 4528).
+const ControlTypeAssertion = "1.3.6.1.1.12"
+
+// ControlAssertion makes the server apply an update only if the target entry
+// still matches Filter, failing with LDAPResultAssertionFailed otherwise.
+type ControlAssertion struct {
+	Filter string
+	filter *ber.Packet
+}
+
+// NewControlAssertion returns a critical assertion control for filter.
+func NewControlAssertion(filter string) (*ControlAssertion, error) {
+	compiled, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlAssertion{Filter: filter, filter: compiled}, nil
+}
+
+func (c *ControlAssertion) GetControlType() string {
+	return ControlTypeAssertion
+}
+
+func (c *ControlAssertion) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeAssertion, "Control Type (Assertion)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Assertion)")
+	value.AppendChild(c.filter)
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *ControlAssertion) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: true  Filter: %s", "Assertion", ControlTypeAssertion, c.Filter)
+}
@@ -0,0 +1,166 @@
+package pooldap
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ldap.v2"
+)
+
+// Dialer opens connections to the directory. It is the seam through which
+// tests inject dial failures, delays and fake connections.
+type Dialer interface {
+	Dial(network, addr string) (ldap.Client, error)
+	DialTLS(network, addr string, config *tls.Config) (ldap.Client, error)
+}
+
+// TLSStater is implemented by connections that can report the state of
+// their TLS session. The connections DefaultDialer and NetDialer return
+// implement it, for LDAPS as well as after StartTLS.
+type TLSStater interface {
+	TLSConnectionState() (state tls.ConnectionState, ok bool)
+}
+
+// DefaultDialer dials like ldap.Dial and ldap.DialTLS.
+type DefaultDialer struct{}
+
+func (DefaultDialer) Dial(network, addr string) (ldap.Client, error) {
+	c, err := net.DialTimeout(network, addr, ldap.DefaultTimeout)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return newStateConn(c, addr), nil
+}
+
+func (DefaultDialer) DialTLS(network, addr string, config *tls.Config) (ldap.Client, error) {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: ldap.DefaultTimeout}, network, addr, config)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return newStateConn(c, addr), nil
+}
+
+// NetDialer dials with a caller supplied net.Dialer, e.g. to set LocalAddr,
+// KeepAlive or a Control func that sets socket options. A zero Timeout means
+// ldap.DefaultTimeout, as with DefaultDialer.
+type NetDialer struct {
+	Dialer *net.Dialer
+}
+
+func (d NetDialer) netDialer() *net.Dialer {
+	dialer := *d.Dialer
+	if dialer.Timeout == 0 {
+		dialer.Timeout = ldap.DefaultTimeout
+	}
+	return &dialer
+}
+
+func (d NetDialer) Dial(network, addr string) (ldap.Client, error) {
+	c, err := d.netDialer().Dial(network, addr)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return newStateConn(c, addr), nil
+}
+
+func (d NetDialer) DialTLS(network, addr string, config *tls.Config) (ldap.Client, error) {
+	c, err := tls.DialWithDialer(d.netDialer(), network, addr, config)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return newStateConn(c, addr), nil
+}
+
+// stateConn is an *ldap.Conn that remembers its TLS state, which ldap.v2
+// keeps to itself. It talks to the server through a muxConn, to send the
+// requests ldap.v2 can't, e.g. a Cancel for SearchContext.
+type stateConn struct {
+	*ldap.Conn
+	mux *muxConn
+	// host is the server's host name, as dialed
+	host string
+	// searchMu serializes SearchContext, see muxConn.watchSearch
+	searchMu sync.Mutex
+	mu       sync.Mutex
+	state    *tls.ConnectionState
+	timeout  time.Duration
+}
+
+// newStateConn starts an LDAP connection over c, dialed to addr, which is
+// TLS if it is a *tls.Conn that completed its handshake.
+func newStateConn(c net.Conn, addr string) *stateConn {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tc, isTLS := c.(*tls.Conn)
+	mux := newMuxConn(c)
+	conn := &stateConn{Conn: ldap.NewConn(mux, isTLS), mux: mux, host: host}
+	if isTLS {
+		state := tc.ConnectionState()
+		conn.state = &state
+	}
+	conn.Start()
+	return conn
+}
+
+// StartTLS upgrades the connection. The handshake happens underneath the
+// *ldap.Conn, so that the muxConn keeps seeing plain LDAP messages.
+func (c *stateConn) StartTLS(config *tls.Config) error {
+	if _, ok := c.TLSConnectionState(); ok {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: already encrypted"))
+	}
+	conn, err := c.mux.startTLS(config, c.requestTimeout())
+	if err != nil {
+		return err
+	}
+	state := conn.ConnectionState()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = &state
+	return nil
+}
+
+// SetTimeout sets the request timeout, for requests the muxConn sends too.
+func (c *stateConn) SetTimeout(t time.Duration) {
+	c.mu.Lock()
+	c.timeout = t
+	c.mu.Unlock()
+	c.Conn.SetTimeout(t)
+}
+
+// requestTimeout returns the timeout of requests the muxConn sends:
+// SetTimeout's, or ldap.DefaultTimeout.
+func (c *stateConn) requestTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return ldap.DefaultTimeout
+}
+
+// closed reports whether the connection was closed, e.g. because the
+// server didn't cancel a search.
+func (c *stateConn) closed() bool {
+	return c.mux.isClosed()
+}
+
+func (c *stateConn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == nil {
+		return state, false
+	}
+	return *c.state, true
+}
+
+func (lc *Client) dialer() Dialer {
+	if lc.Dialer != nil {
+		return lc.Dialer
+	}
+	return DefaultDialer{}
+}
@@ -0,0 +1,629 @@
+package pooldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+func dialerTestConfig() LdapConfig {
+	return LdapConfig{Host: "ldap.example.com", Port: 389, SkipTLS: true}
+}
+
+func TestDialer_Error(t *testing.T) {
+	dialer := &fakeDialer{failures: 1}
+	_, err := NewClient(dialerTestConfig(), 1, 1, 1, 1, time.Hour, WithDialer(dialer))
+	assert.Error(t, err)
+	assert.Equal(t, 1, dialer.dialCount())
+}
+
+func TestDialer_RetriesWithBackoff(t *testing.T) {
+	config := dialerTestConfig()
+	config.DialRetries = 2
+	config.DialBackoff = time.Millisecond
+	dialer := &fakeDialer{failures: 2}
+
+	lc, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	assert.Equal(t, 3, dialer.dialCount())
+	assert.Equal(t, 1, lc.searchPool.Len())
+}
+
+func TestDialer_Delay(t *testing.T) {
+	dialer := &fakeDialer{delay: 30 * time.Millisecond}
+
+	start := time.Now()
+	lc, err := NewClient(dialerTestConfig(), 2, 2, 0, 1, time.Hour, WithDialer(dialer), WithAsyncWarmup())
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 30*time.Millisecond)
+
+	<-lc.WarmupDone()
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+	assert.Equal(t, 2, lc.searchPool.Len())
+}
+
+func TestClient_BindPoolAsService(t *testing.T) {
+	config := fakeUserConfig()
+	config.Host = "ldap.example.com"
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	config.BindPoolAsService = true
+	searchConn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	bindConn := &fakeConn{}
+	conns := []*fakeConn{searchConn, bindConn}
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := conns[0]
+		conns = conns[1:]
+		return conn
+	}}
+
+	lc, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	assert.Equal(t, []string{config.BindDN}, bindConn.binds)
+
+	valid, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []string{config.BindDN, fakeUser.DN, config.BindDN}, bindConn.binds)
+}
+
+func TestDialer_ServerNameDefaultsToHost(t *testing.T) {
+	config := dialerTestConfig()
+	config.UseSSL = true
+	dialer := &fakeDialer{}
+
+	_, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	require.NotNil(t, dialer.tlsConfig)
+	assert.Equal(t, "ldap.example.com", dialer.tlsConfig.ServerName)
+	assert.False(t, dialer.tlsConfig.InsecureSkipVerify)
+
+	config.ServerName = "ldap-01.example.com"
+	_, err = NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	assert.Equal(t, "ldap-01.example.com", dialer.tlsConfig.ServerName)
+}
+
+func TestClient_SetBindCredentials(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "old"
+	var (
+		mu    sync.Mutex
+		conns []*fakeConn
+	)
+	passwords := map[*fakeConn][]string{}
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{}
+		conn.bindFn = func(username, password string) error {
+			mu.Lock()
+			passwords[conn] = append(passwords[conn], password)
+			mu.Unlock()
+			return nil
+		}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return conn
+	}}
+	lc, err := NewClient(config, 1, 2, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	inFlight, err := lc.searchPool.Get()
+	require.NoError(t, err)
+
+	require.NoError(t, lc.SetBindCredentials("cn=rotated,dc=example,dc=com", "new"))
+	dn, _ := lc.bindCredentials()
+	assert.Equal(t, "cn=rotated,dc=example,dc=com", dn)
+	assert.Equal(t, "cn=service,dc=example,dc=com", lc.Config.BindDN)
+	require.Len(t, conns, 2)
+	assert.Equal(t, []string{"new"}, passwords[conns[1]])
+	assert.Equal(t, []string{"cn=rotated,dc=example,dc=com"}, conns[1].binds)
+
+	// the in-flight connection keeps working until it is returned
+	_, err = inFlight.Search(&ldap.SearchRequest{})
+	assert.NoError(t, err)
+	assert.False(t, conns[0].isClosed())
+	inFlight.Close()
+	assert.True(t, conns[0].isClosed())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, conn := range conns[1:] {
+		assert.Equal(t, []string{"new"}, passwords[conn])
+	}
+}
+
+func TestClient_CheckBind(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	config.BindPoolAsService = true
+	var last *fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		last = &fakeConn{bindFn: func(username, password string) error {
+			if password != "secret" {
+				return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+			}
+			return nil
+		}}
+		return last
+	}}
+	lc, err := NewClient(config, 0, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	require.NoError(t, lc.CheckBind())
+	assert.Equal(t, 1, dialer.dialCount())
+	assert.Equal(t, []string{config.BindDN}, last.binds)
+	assert.True(t, last.isClosed())
+
+	require.NoError(t, lc.SetBindCredentials(config.BindDN, "wrong"))
+	err = lc.CheckBind()
+	var bindErr *BindError
+	assert.True(t, errors.As(err, &bindErr))
+	assert.False(t, errors.Is(err, ErrUnreachable))
+	assert.Equal(t, []string{config.BindDN}, last.binds)
+
+	dialer.failures = dialer.dialCount() + 1
+	assert.True(t, errors.Is(lc.CheckBind(), ErrUnreachable))
+}
+
+func TestDialer_FactoryErrorStats(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "wrong"
+	dialer := &fakeDialer{failures: 1, conn: func() *fakeConn {
+		return &fakeConn{bindFn: func(string, string) error {
+			return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+		}}
+	}}
+	lc, err := NewClient(config, 0, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	pool := lc.searchPool.(*channelPool)
+
+	_, err = pool.openConn(true)
+	assert.Error(t, err)
+	search, _ := lc.PoolStats()
+	assert.Equal(t, PoolStats{DialErrors: 1}, search)
+
+	_, err = pool.openConn(true)
+	var bindErr *BindError
+	require.True(t, errors.As(err, &bindErr))
+	search, bind := lc.PoolStats()
+	assert.Equal(t, PoolStats{DialErrors: 1, BindErrors: 1}, search)
+	assert.Equal(t, PoolStats{}, bind)
+}
+
+func TestDialer_RejectsBadGroupFilter(t *testing.T) {
+	config := dialerTestConfig()
+	config.GroupFilter = "(|(member=%s)(memberUid=%s)(owner=%s))"
+	dialer := &fakeDialer{}
+
+	_, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer))
+	assert.Error(t, err)
+	assert.Equal(t, 0, dialer.dialCount())
+}
+
+func TestDialer_NetDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	dialer := &net.Dialer{
+		KeepAlive: 15 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			mu.Lock()
+			defer mu.Unlock()
+			dialed = append(dialed, address)
+			return nil
+		},
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	config := LdapConfig{Host: "127.0.0.1", Port: addr.Port, SkipTLS: true}
+
+	lc, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithNetDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{addr.String(), addr.String()}, dialed)
+}
+
+// tlsListener accepts connections and completes a TLS 1.3 handshake on them,
+// after answering a StartTLS request if startTLS is set.
+func tlsListener(t *testing.T, startTLS bool) net.Listener {
+	cert, err := tls.LoadX509KeyPair("testdata/client.crt", "testdata/client.key")
+	require.NoError(t, err)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if startTLS {
+					request, err := ber.ReadPacket(conn)
+					if err != nil {
+						return
+					}
+					response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+					response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, request.Children[0].Value, "MessageID"))
+					extended := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedResponse, nil, "Extended Response")
+					extended.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.LDAPResultSuccess, "resultCode"))
+					extended.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+					extended.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+					response.AppendChild(extended)
+					if _, err := conn.Write(response.Bytes()); err != nil {
+						return
+					}
+				}
+				tlsConn := tls.Server(conn, config)
+				if tlsConn.Handshake() == nil {
+					_, _ = tlsConn.Read(make([]byte, 1))
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestDialer_TLSConnectionState(t *testing.T) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	for name, dialer := range map[string]Dialer{
+		"default": DefaultDialer{},
+		"net":     NetDialer{Dialer: &net.Dialer{}},
+	} {
+		conn, err := dialer.DialTLS("tcp", tlsListener(t, false).Addr().String(), config)
+		require.NoError(t, err, name)
+		state, ok := (&PoolConn{Conn: conn}).TLSConnectionState()
+		assert.True(t, ok, name)
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version, name)
+		assert.NotZero(t, state.CipherSuite, name)
+		conn.Close()
+
+		conn, err = dialer.Dial("tcp", tlsListener(t, true).Addr().String())
+		require.NoError(t, err, name)
+		_, ok = (&PoolConn{Conn: conn}).TLSConnectionState()
+		assert.False(t, ok, name)
+		require.NoError(t, conn.StartTLS(config), name)
+		state, ok = (&PoolConn{Conn: conn}).TLSConnectionState()
+		assert.True(t, ok, name)
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version, name)
+		conn.Close()
+	}
+
+	_, ok := (&PoolConn{Conn: &fakeConn{}}).TLSConnectionState()
+	assert.False(t, ok)
+}
+
+func TestDialer_LazyBind(t *testing.T) {
+	config := fakeUserConfig()
+	config.Host = "ldap.example.com"
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	config.LazyBind = true
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	dialer := &fakeDialer{conn: func() *fakeConn { return conn }}
+
+	lc, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	lc.searchPool.(*channelPool).AliveChecks(false)
+	assert.Empty(t, conn.binds)
+
+	_, err = lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, []string{config.BindDN}, conn.binds)
+
+	_, err = lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, []string{config.BindDN}, conn.binds)
+}
+
+func TestDialer_LazyBindFailure(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "wrong"
+	config.LazyBind = true
+	var conns []*fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{bindFn: func(string, string) error {
+			return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+		}}
+		conns = append(conns, conn)
+		return conn
+	}}
+
+	lc, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	lc.searchPool.(*channelPool).AliveChecks(false)
+
+	_, err = lc.searchPool.Get()
+	var bindErr *BindError
+	require.True(t, errors.As(err, &bindErr))
+	require.Len(t, conns, 1)
+	assert.True(t, conns[0].isClosed())
+	assert.Equal(t, 0, lc.searchPool.Stats().Open)
+}
+
+func TestNewClientContext_Deadline(t *testing.T) {
+	dialer := &fakeDialer{delay: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	lc, err := NewClientContext(ctx, dialerTestConfig(), 5, 5, 0, 1, time.Hour, WithDialer(dialer))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 150*time.Millisecond)
+	require.NotNil(t, lc)
+	defer lc.Close()
+
+	// the dial in flight at the deadline finishes, then the warm-up stops
+	<-lc.WarmupDone()
+	assert.Equal(t, 2, dialer.dialCount())
+	assert.Equal(t, 2, lc.searchPool.Len())
+}
+
+func TestNewClientContext(t *testing.T) {
+	lc, err := NewClientContext(context.Background(), dialerTestConfig(), 2, 2, 1, 1, time.Hour, WithDialer(&fakeDialer{}))
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Equal(t, 2, lc.searchPool.Len())
+	assert.Equal(t, 1, lc.bindPool.Len())
+
+	_, err = NewClientContext(context.Background(), dialerTestConfig(), 1, 1, 0, 1, time.Hour, WithDialer(&fakeDialer{failures: 1}))
+	assert.Error(t, err)
+
+	// spare capacity in the caller's options is left alone
+	opts := make([]ClientOption, 1, 3)
+	opts[0] = WithDialer(&fakeDialer{})
+	spare := opts[:3]
+	lc, err = NewClientContext(context.Background(), dialerTestConfig(), 1, 1, 0, 1, time.Hour, opts...)
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Nil(t, spare[1])
+	assert.Nil(t, spare[2])
+}
+
+func TestRequireInitialConnection(t *testing.T) {
+	config := dialerTestConfig()
+	config.RequireInitialConnection = true
+
+	t.Run("all fail", func(t *testing.T) {
+		_, err := NewClient(config, 3, 3, 1, 1, time.Hour, WithDialer(&fakeDialer{failures: 10}))
+		assert.Error(t, err)
+	})
+
+	t.Run("bind fails", func(t *testing.T) {
+		config := config
+		config.BindDN, config.BindPassword, config.LazyBind = "cn=service", "wrong", true
+		conn := func() *fakeConn {
+			return &fakeConn{bindFn: func(string, string) error {
+				return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+			}}
+		}
+		_, err := NewClient(config, 2, 2, 0, 1, time.Hour, WithDialer(&fakeDialer{conn: conn}))
+		assert.Error(t, err)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		lc, err := NewClient(config, 3, 3, 1, 1, time.Hour, WithDialer(&fakeDialer{failures: 2}))
+		require.NoError(t, err)
+		defer lc.Close()
+		assert.Equal(t, 1, lc.searchPool.Len())
+		assert.Equal(t, 1, lc.bindPool.Len())
+	})
+
+	t.Run("all succeed", func(t *testing.T) {
+		lc, err := NewClient(config, 3, 3, 0, 1, time.Hour, WithDialer(&fakeDialer{}))
+		require.NoError(t, err)
+		defer lc.Close()
+		assert.Equal(t, 3, lc.searchPool.Len())
+		// one connection is opened even without an initial capacity
+		assert.Equal(t, 1, lc.bindPool.Len())
+	})
+}
+
+// peakDialer is a fakeDialer whose dials take delay and that records how
+// many ran at once.
+type peakDialer struct {
+	fakeDialer
+	delay    time.Duration
+	inflight int32
+	peak     int32
+}
+
+func (d *peakDialer) Dial(network, addr string) (ldap.Client, error) {
+	n := atomic.AddInt32(&d.inflight, 1)
+	for peak := atomic.LoadInt32(&d.peak); n > peak && !atomic.CompareAndSwapInt32(&d.peak, peak, n); {
+		peak = atomic.LoadInt32(&d.peak)
+	}
+	time.Sleep(d.delay)
+	atomic.AddInt32(&d.inflight, -1)
+	return d.fakeDialer.Dial(network, addr)
+}
+
+func TestWarmupConcurrency(t *testing.T) {
+	config := dialerTestConfig()
+	config.WarmupConcurrency = 3
+
+	t.Run("bounded", func(t *testing.T) {
+		dialer := &peakDialer{delay: 20 * time.Millisecond}
+		start := time.Now()
+		lc, err := NewClient(config, 9, 9, 0, 1, time.Hour, WithDialer(dialer))
+		require.NoError(t, err)
+		defer lc.Close()
+		assert.Equal(t, 9, lc.searchPool.Len())
+		assert.Equal(t, 9, dialer.dialCount())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&dialer.peak))
+		assert.Less(t, time.Since(start), 9*dialer.delay)
+	})
+
+	t.Run("serial by default", func(t *testing.T) {
+		config := dialerTestConfig()
+		dialer := &peakDialer{delay: time.Millisecond}
+		lc, err := NewClient(config, 4, 4, 0, 1, time.Hour, WithDialer(dialer))
+		require.NoError(t, err)
+		defer lc.Close()
+		assert.Equal(t, 4, lc.searchPool.Len())
+		assert.Equal(t, int32(1), atomic.LoadInt32(&dialer.peak))
+	})
+
+	t.Run("failure aborts", func(t *testing.T) {
+		dialer := &peakDialer{delay: 5 * time.Millisecond, fakeDialer: fakeDialer{failures: 1}}
+		_, err := NewClient(config, 9, 9, 0, 1, time.Hour, WithDialer(dialer))
+		assert.Error(t, err)
+		assert.Less(t, dialer.dialCount(), 9)
+	})
+
+	t.Run("partial with RequireInitialConnection", func(t *testing.T) {
+		config := config
+		config.RequireInitialConnection = true
+		dialer := &peakDialer{delay: 5 * time.Millisecond, fakeDialer: fakeDialer{failures: 2}}
+		lc, err := NewClient(config, 3, 3, 0, 1, time.Hour, WithDialer(dialer))
+		require.NoError(t, err)
+		defer lc.Close()
+		assert.Equal(t, 1, lc.searchPool.Len())
+	})
+}
+
+func TestBusyRetries(t *testing.T) {
+	var mu sync.Mutex
+	busy := 0
+	conn := func() *fakeConn {
+		return &fakeConn{bindFn: func(string, string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if busy > 0 {
+				busy--
+				return ldap.NewError(ldap.LDAPResultBusy, errors.New("server is busy"))
+			}
+			return nil
+		}}
+	}
+	config := dialerTestConfig()
+	config.BindDN, config.BindPassword = "cn=service", "secret"
+	config.BusyBackoff = time.Millisecond
+
+	busy = 3
+	_, err := NewClient(config, 2, 2, 0, 1, time.Hour, WithDialer(&fakeDialer{conn: conn}))
+	assert.Error(t, err)
+
+	busy = 3
+	config.BusyRetries = 3
+	dialer := &fakeDialer{conn: conn}
+	lc, err := NewClient(config, 2, 2, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Equal(t, 2, lc.searchPool.Len())
+	assert.Equal(t, 5, dialer.dialCount())
+	assert.Equal(t, PoolStats{Idle: 2, Open: 2, BindErrors: 3}, lc.searchPool.Stats())
+}
+
+func TestClient_RotateCredentials(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "old"
+	config.AllowOverflow = true
+	var mu sync.Mutex
+	passwords := map[*fakeConn]string{}
+	dialer := &fakeDialer{delay: time.Millisecond, conn: func() *fakeConn {
+		conn := &fakeConn{}
+		conn.bindFn = func(username, password string) error {
+			if password == "bad" {
+				return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+			}
+			mu.Lock()
+			passwords[conn] = password
+			mu.Unlock()
+			return nil
+		}
+		return conn
+	}}
+	lc, err := NewClient(config, 2, 4, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	var rotated, stale, searches int32
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				after := atomic.LoadInt32(&rotated) == 1
+				conn, err := lc.SearchConn()
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				password := passwords[conn.Conn.(*fakeConn)]
+				mu.Unlock()
+				if after && password == "old" {
+					atomic.AddInt32(&stale, 1)
+				}
+				conn.Search(&ldap.SearchRequest{})
+				atomic.AddInt32(&searches, 1)
+				conn.Close()
+				// reads Config while the credentials rotate
+				lc.GetUser("fry")
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	var bindErr *BindError
+	assert.True(t, errors.As(lc.RotateCredentials("cn=rotated,dc=example,dc=com", "bad"), &bindErr))
+	// an unauthenticated bind would pass the check
+	assert.Equal(t, ErrInvalidCredentials, lc.RotateCredentials("cn=rotated,dc=example,dc=com", ""))
+	dn, _ := lc.bindCredentials()
+	assert.Equal(t, "cn=service,dc=example,dc=com", dn)
+
+	require.NoError(t, lc.RotateCredentials("cn=rotated,dc=example,dc=com", "new"))
+	atomic.StoreInt32(&rotated, 1)
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	dn, _ = lc.bindCredentials()
+	assert.Equal(t, "cn=rotated,dc=example,dc=com", dn)
+	assert.NotZero(t, atomic.LoadInt32(&searches))
+	assert.Zero(t, atomic.LoadInt32(&stale))
+}
@@ -0,0 +1,114 @@
+package pooldap
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// ControlTypeDirSync is the Active Directory DirSync control.
+const ControlTypeDirSync = "1.2.840.113556.1.4.841"
+
+// dirSyncMaxBytes is the MaxBytes sent with DirSync requests. Active
+// Directory caps it at its own limit, so asking for a lot is harmless.
+const dirSyncMaxBytes = 1 << 30
+
+// ControlDirSync asks Active Directory for the entries that changed since the
+// state described by Cookie. An empty cookie returns every matching entry.
+type ControlDirSync struct {
+	Flags    int64
+	MaxBytes int64
+	Cookie   []byte
+}
+
+// NewControlDirSync returns a DirSync request control resuming from cookie.
+func NewControlDirSync(cookie []byte) *ControlDirSync {
+	return &ControlDirSync{MaxBytes: dirSyncMaxBytes, Cookie: cookie}
+}
+
+func (c *ControlDirSync) GetControlType() string {
+	return ControlTypeDirSync
+}
+
+func (c *ControlDirSync) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeDirSync, "Control Type (DirSync)"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (DirSync)")
+	value.AppendChild(encodeDirSyncValue(c.Flags, c.MaxBytes, c.Cookie))
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *ControlDirSync) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: true  Flags: %d  MaxBytes: %d  Cookie: %q",
+		"DirSync", ControlTypeDirSync, c.Flags, c.MaxBytes, c.Cookie)
+}
+
+// encodeDirSyncValue encodes the value shared by the DirSync request and
+// response controls.
+func encodeDirSyncValue(flags, maxBytes int64, cookie []byte) *ber.Packet {
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "DirSync Value")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, flags, "Flags"))
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, maxBytes, "MaxBytes"))
+	seq.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(cookie), "Cookie"))
+	return seq
+}
+
+// decodeDirSyncResponse reads the flags and cookie from a DirSync response
+// control. The ldap package doesn't know the control, so it arrives as an
+// *ldap.ControlString holding the encoded value.
+func decodeDirSyncResponse(control ldap.Control) (moreData bool, cookie []byte, err error) {
+	c, ok := control.(*ldap.ControlString)
+	if !ok {
+		return false, nil, errors.Errorf("unexpected DirSync response control %T", control)
+	}
+	packet, err := ber.DecodePacketErr([]byte(c.ControlValue))
+	if err != nil {
+		return false, nil, errors.Wrap(err, "decoding DirSync response control")
+	}
+	if len(packet.Children) != 3 {
+		return false, nil, errors.New("malformed DirSync response control")
+	}
+	flags, _ := packet.Children[0].Value.(int64)
+	return flags != 0, packet.Children[2].Data.Bytes(), nil
+}
+
+// DirSync returns the entries under Config.Base matching filter that changed
+// since cookie, and the cookie to pass to the next call. Pass a nil cookie to
+// start with every matching entry. Only the changed attributes are returned.
+// The DirSync control is Active Directory specific and needs the service
+// account to hold the "Replicating Directory Changes" right.
+func (lc *Client) DirSync(cookie []byte, filter string) (entries []*ldap.Entry, nextCookie []byte, err error) {
+	nextCookie = cookie
+	for {
+		searchRequest := ldap.NewSearchRequest(
+			lc.Config.Base,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			nil,
+			nil,
+		)
+		sr, err := lc.Search(searchRequest, NewControlDirSync(nextCookie))
+		if err != nil {
+			return nil, cookie, err
+		}
+		entries = append(entries, sr.Entries...)
+
+		control := ldap.FindControl(sr.Controls, ControlTypeDirSync)
+		if control == nil {
+			return nil, cookie, errors.New("server did not return a DirSync response control")
+		}
+		moreData, responseCookie, err := decodeDirSyncResponse(control)
+		if err != nil {
+			return nil, cookie, err
+		}
+		nextCookie = responseCookie
+		if !moreData {
+			return entries, nextCookie, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package pooldap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// fakeDirSync serves a change log pageSize changes at a time.
+type fakeDirSync struct {
+	changes []*ldap.Entry
+	// pageSize is the number of changes returned per response
+	pageSize int
+}
+
+func (d *fakeDirSync) search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	control := ldap.FindControl(req.Controls, ControlTypeDirSync).(*ControlDirSync)
+
+	// the cookie is the index of the next change, as a single byte
+	next := 0
+	if len(control.Cookie) > 0 {
+		next = int(control.Cookie[0])
+	}
+	end := next + d.pageSize
+	if end > len(d.changes) {
+		end = len(d.changes)
+	}
+	var flags int64
+	if end < len(d.changes) {
+		flags = 1
+	}
+
+	response := encodeDirSyncValue(flags, 0, []byte{byte(end)})
+	return &ldap.SearchResult{
+		Entries:  d.changes[next:end],
+		Controls: []ldap.Control{ldap.NewControlString(ControlTypeDirSync, false, string(response.Bytes()))},
+	}, nil
+}
+
+func TestControlDirSync_Encode(t *testing.T) {
+	packet := NewControlDirSync([]byte("cookie")).Encode()
+	require.Len(t, packet.Children, 3)
+	assert.Equal(t, ControlTypeDirSync, packet.Children[0].Value)
+
+	decoded := ber.DecodePacket(packet.Bytes())
+	value := ber.DecodePacket(decoded.Children[2].Data.Bytes())
+	require.Len(t, value.Children, 3)
+	assert.Equal(t, int64(dirSyncMaxBytes), value.Children[1].Value)
+	assert.True(t, bytes.Equal([]byte("cookie"), value.Children[2].Data.Bytes()))
+}
+
+func TestClient_DirSync(t *testing.T) {
+	dirSync := &fakeDirSync{pageSize: 2, changes: []*ldap.Entry{
+		{DN: "uid=fry,ou=people,dc=example,dc=com"},
+		{DN: "uid=leela,ou=people,dc=example,dc=com"},
+		{DN: "uid=bender,ou=people,dc=example,dc=com"},
+	}}
+	conn := &fakeConn{searchFn: dirSync.search}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	entries, cookie, err := lc.DirSync(nil, "(objectClass=person)")
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, []byte{3}, cookie)
+	assert.Len(t, conn.searches, 2)
+
+	// a change made after the first sync is the only one returned next time
+	dirSync.changes = append(dirSync.changes, &ldap.Entry{DN: "uid=zoidberg,ou=people,dc=example,dc=com"})
+	entries, cookie, err = lc.DirSync(cookie, "(objectClass=person)")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "uid=zoidberg,ou=people,dc=example,dc=com", entries[0].DN)
+	assert.Equal(t, []byte{4}, cookie)
+
+	entries, cookie, err = lc.DirSync(cookie, "(objectClass=person)")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, []byte{4}, cookie)
+}
+
+func TestClient_DirSyncMissingControl(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	_, cookie, err := lc.DirSync([]byte("cookie"), "(objectClass=person)")
+	assert.Error(t, err)
+	assert.Equal(t, []byte("cookie"), cookie)
+}
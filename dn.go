@@ -0,0 +1,45 @@
+package pooldap
+
+import (
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// NormalizeDN returns dn in a canonical form so that DNs differing only in
+// case or in spacing around separators compare equal: attribute types and
+// values are lower-cased, surrounding spaces dropped and special characters
+// re-escaped. Values are compared case-insensitively, which matches the
+// matching rules of the attributes commonly used in DNs (cn, ou, dc, uid).
+func NormalizeDN(dn string) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attributes := make([]string, 0, len(rdn.Attributes))
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(strings.TrimSpace(attribute.Type))+"="+
+				escapeDNValue(strings.ToLower(strings.TrimSpace(attribute.Value))))
+		}
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+	return strings.Join(rdns, ","), nil
+}
+
+// escapeDNValue escapes an attribute value for use in a DN string (RFC 4514).
+func escapeDNValue(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(value)-1 && r == ' ':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,35 @@
+package pooldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeDN(t *testing.T) {
+	expected, err := NormalizeDN("cn=admins,ou=x,dc=example,dc=com")
+	require.NoError(t, err)
+	assert.Equal(t, "cn=admins,ou=x,dc=example,dc=com", expected)
+
+	for _, dn := range []string{
+		"CN=Admins,OU=X,DC=Example,DC=com",
+		"cn=admins, ou=x, dc=example, dc=com",
+		"Cn=ADMINS , Ou=x,dc=EXAMPLE,dc=Com",
+	} {
+		normalized, err := NormalizeDN(dn)
+		require.NoError(t, err)
+		assert.Equal(t, expected, normalized, dn)
+	}
+}
+
+func TestNormalizeDNEscapes(t *testing.T) {
+	normalized, err := NormalizeDN(`CN=Fry\, Philip J.,OU=People,DC=example,DC=com`)
+	require.NoError(t, err)
+	assert.Equal(t, `cn=fry\, philip j.,ou=people,dc=example,dc=com`, normalized)
+}
+
+func TestNormalizeDNInvalid(t *testing.T) {
+	_, err := NormalizeDN("not a dn")
+	assert.Error(t, err)
+}
@@ -1,10 +1,142 @@
 package pooldap
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ldap.v2"
+)
 
 var (
 	ErrNotFound          = errors.New("object not found")
 	ErrNotUnique         = errors.New("too many entries returned")
 	ErrDnNotFound        = errors.New("user 'dn' not found in attributes")
 	ErrAttributeNotFound = errors.New("attribute not found")
+	ErrReadOnly          = errors.New("write operation refused in read-only mode")
+	ErrUnreachable       = errors.New("directory unreachable")
+	ErrInsecureBind      = errors.New("refusing to send bind password over an unencrypted connection")
+	ErrAssertionFailed   = errors.New("assertion control filter did not match the entry")
+	ErrNoControls        = errors.New("connection does not support controls on this operation")
+	ErrNoModifyDN        = errors.New("connection does not support ModifyDN")
+	ErrReferral          = errors.New("server returned a referral")
+	// ErrConstraintViolation is returned by SetAttribute, AddAttributeValues
+	// and RemoveAttributeValues when the directory rejects the values, e.g.
+	// for a single-valued attribute or a password quality rule.
+	ErrConstraintViolation = errors.New("constraint violation")
+	// ErrInvalidCredentials is returned by Authenticate for an empty password,
+	// which many directories would accept as an unauthenticated bind.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrSharedPools is returned by SetBindCredentials and RotateCredentials
+	// for a Client using a PoolRegistry, whose pools other Clients share.
+	ErrSharedPools = errors.New("pools shared through a PoolRegistry can't change credentials")
+
+	// errRetired is returned by PoolConn.reconnect for a connection from
+	// Client.Conn whose context ended.
+	errRetired = errors.New("connection retired as its context ended")
 )
+
+// LDAPResultAssertionFailed is the result code for a failed assertion
+// control (RFC 4528), which the ldap package does not define.
+const LDAPResultAssertionFailed = 122
+
+// BindError is returned by Authenticate when the directory rejects the bind.
+// Code is the LDAP result code, e.g. ldap.LDAPResultInvalidCredentials.
+type BindError struct {
+	Code uint16
+	Msg  string
+	err  error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("bind failed with LDAP result code %d: %s", e.Code, e.Msg)
+}
+
+func (e *BindError) Unwrap() error { return e.err }
+
+// newBindError converts a bind failure into a *BindError. Errors that do not
+// carry an LDAP result code are returned unchanged.
+func newBindError(err error) error {
+	ldapErr, ok := err.(*ldap.Error)
+	if !ok {
+		return err
+	}
+	msg := ldap.LDAPResultCodeMap[ldapErr.ResultCode]
+	if ldapErr.Err != nil {
+		msg = ldapErr.Err.Error()
+	}
+	return &BindError{Code: uint16(ldapErr.ResultCode), Msg: msg, err: err}
+}
+
+// SortError is returned by Client.Search when the server could not honour a
+// ControlServerSideSort. Code is the LDAP result code, e.g.
+// ldap.LDAPResultInappropriateMatching, and Attribute the sort key at fault
+// if the server named one. The unsorted result is returned alongside it.
+type SortError struct {
+	Code      uint16
+	Attribute string
+}
+
+func (e *SortError) Error() string {
+	msg := fmt.Sprintf("server-side sort failed with LDAP result code %d (%s)", e.Code, ldap.LDAPResultCodeMap[uint8(e.Code)])
+	if e.Attribute != "" {
+		msg += " on attribute " + e.Attribute
+	}
+	return msg
+}
+
+// ReferralError is returned by searches when the server answers with
+// LDAPResultReferral instead of a result: the entries live on another server.
+// URLs are the LDAP URLs to retry at, gathered from the search result
+// references and the diagnostic message. The ldap package drops the referral
+// field of the final result, so URLs may be empty for servers that only send
+// it there. It matches ErrReferral with errors.Is.
+type ReferralError struct {
+	URLs []string
+	Msg  string
+}
+
+func (e *ReferralError) Error() string {
+	if len(e.URLs) == 0 {
+		return fmt.Sprintf("%s: %s", ErrReferral, e.Msg)
+	}
+	return fmt.Sprintf("%s to %s", ErrReferral, strings.Join(e.URLs, ", "))
+}
+
+func (e *ReferralError) Unwrap() error { return ErrReferral }
+
+// newReferralError converts a LDAPResultReferral search failure into a
+// *ReferralError. Other errors are returned unchanged.
+func newReferralError(err error, sr *ldap.SearchResult) error {
+	ldapErr, ok := err.(*ldap.Error)
+	if !ok || ldapErr.ResultCode != ldap.LDAPResultReferral {
+		return err
+	}
+	referralErr := &ReferralError{}
+	if sr != nil {
+		referralErr.URLs = append(referralErr.URLs, sr.Referrals...)
+	}
+	if ldapErr.Err != nil {
+		referralErr.Msg = ldapErr.Err.Error()
+		for _, field := range strings.Fields(referralErr.Msg) {
+			field = strings.Trim(field, "'\"")
+			lower := strings.ToLower(field)
+			if (strings.HasPrefix(lower, "ldap://") || strings.HasPrefix(lower, "ldaps://")) && !containsString(referralErr.URLs, field) {
+				referralErr.URLs = append(referralErr.URLs, field)
+			}
+		}
+	}
+	return referralErr
+}
+
+// AttributeError reports a configured attribute missing from a user entry.
+// It matches ErrAttributeNotFound with errors.Is.
+type AttributeError struct {
+	Attribute string
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrAttributeNotFound, e.Attribute)
+}
+
+func (e *AttributeError) Unwrap() error { return ErrAttributeNotFound }
@@ -0,0 +1,207 @@
+package pooldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gopkg.in/ldap.v2"
+)
+
+// fakeConn is an in-memory ldap.Client used to exercise code paths that are
+// hard to reproduce against a real directory.
+type fakeConn struct {
+	mu       sync.Mutex
+	closed   bool
+	searches []*ldap.SearchRequest
+	binds    []string
+	writes   []string
+	dels     []*ldap.DelRequest
+	modifies []*ldap.ModifyRequest
+	timeout  time.Duration
+
+	searchFn func(*ldap.SearchRequest) (*ldap.SearchResult, error)
+	// pagingFn overrides SearchWithPaging, which otherwise behaves as Search
+	pagingFn func(*ldap.SearchRequest, uint32) (*ldap.SearchResult, error)
+	bindFn   func(username, password string) error
+	// simpleBindFn overrides SimpleBind, e.g. to return response controls
+	simpleBindFn func(*ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error)
+	delFn        func(*ldap.DelRequest) error
+	modifyFn     func(*ldap.ModifyRequest) error
+}
+
+func (f *fakeConn) Start()                            {}
+func (f *fakeConn) StartTLS(config *tls.Config) error { return nil }
+
+func (f *fakeConn) SetTimeout(t time.Duration) {
+	f.mu.Lock()
+	f.timeout = t
+	f.mu.Unlock()
+}
+
+func (f *fakeConn) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+}
+
+func (f *fakeConn) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeConn) Bind(username, password string) error {
+	f.mu.Lock()
+	f.binds = append(f.binds, username)
+	f.mu.Unlock()
+	if f.bindFn != nil {
+		return f.bindFn(username, password)
+	}
+	return nil
+}
+
+func (f *fakeConn) SimpleBind(simpleBindRequest *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+	if f.simpleBindFn != nil {
+		f.mu.Lock()
+		f.binds = append(f.binds, simpleBindRequest.Username)
+		f.mu.Unlock()
+		return f.simpleBindFn(simpleBindRequest)
+	}
+	return &ldap.SimpleBindResult{}, f.Bind(simpleBindRequest.Username, simpleBindRequest.Password)
+}
+
+func (f *fakeConn) write(op string) {
+	f.mu.Lock()
+	f.writes = append(f.writes, op)
+	f.mu.Unlock()
+}
+
+func (f *fakeConn) Add(addRequest *ldap.AddRequest) error {
+	f.write("add")
+	return nil
+}
+
+func (f *fakeConn) ModifyDN(modifyDNRequest *ldap.ModifyDNRequest) error {
+	f.write("moddn")
+	return nil
+}
+
+func (f *fakeConn) Del(delRequest *ldap.DelRequest) error {
+	f.write("del")
+	f.mu.Lock()
+	f.dels = append(f.dels, delRequest)
+	f.mu.Unlock()
+	if f.delFn != nil {
+		return f.delFn(delRequest)
+	}
+	return nil
+}
+
+func (f *fakeConn) Modify(modifyRequest *ldap.ModifyRequest) error {
+	f.write("modify")
+	f.mu.Lock()
+	f.modifies = append(f.modifies, modifyRequest)
+	f.mu.Unlock()
+	if f.modifyFn != nil {
+		return f.modifyFn(modifyRequest)
+	}
+	return nil
+}
+
+func (f *fakeConn) Compare(dn, attribute, value string) (bool, error) { return false, nil }
+
+func (f *fakeConn) PasswordModify(passwordModifyRequest *ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
+	f.write("passwordModify")
+	return &ldap.PasswordModifyResult{}, nil
+}
+
+func (f *fakeConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	f.mu.Lock()
+	f.searches = append(f.searches, searchRequest)
+	f.mu.Unlock()
+	if f.searchFn != nil {
+		return f.searchFn(searchRequest)
+	}
+	return &ldap.SearchResult{}, nil
+}
+
+func (f *fakeConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	if f.pagingFn != nil {
+		f.mu.Lock()
+		f.searches = append(f.searches, searchRequest)
+		f.mu.Unlock()
+		return f.pagingFn(searchRequest, pagingSize)
+	}
+	return f.Search(searchRequest)
+}
+
+// newFakeClient returns a Client whose search and bind pools hand out conn.
+func newFakeClient(t *testing.T, config LdapConfig, conn *fakeConn) *Client {
+	lc := &Client{Config: config}
+	lc.setBindCredentials(config.BindDN, config.BindPassword)
+	factory := func(*Client, PoolType) (ldap.Client, error) { return conn, nil }
+
+	searchPool, err := NewChannelPool(1, 1, SharedPool, factory, lc, nil, time.Hour)
+	require.NoError(t, err)
+	bindPool, err := NewChannelPool(1, 1, BindPool, factory, lc, nil, time.Hour)
+	require.NoError(t, err)
+
+	// alive checks would show up as extra searches on conn
+	searchPool.(*channelPool).AliveChecks(false)
+	bindPool.(*channelPool).AliveChecks(false)
+
+	lc.searchPool = searchPool
+	lc.bindPool = bindPool
+	return lc
+}
+
+// entriesResult answers every search with the given entries.
+func entriesResult(entries ...*ldap.Entry) func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		return &ldap.SearchResult{Entries: entries}, nil
+	}
+}
+
+// fakeDialer hands out fakeConns, failing the first failures dials and
+// sleeping delay before each one.
+type fakeDialer struct {
+	mu       sync.Mutex
+	dials    int
+	failures int
+	delay    time.Duration
+	conn     func() *fakeConn
+	// tlsConfig is the config passed to the last DialTLS
+	tlsConfig *tls.Config
+}
+
+func (d *fakeDialer) Dial(network, addr string) (ldap.Client, error) {
+	time.Sleep(d.delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.dials <= d.failures {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+	}
+	if d.conn != nil {
+		return d.conn(), nil
+	}
+	return &fakeConn{}, nil
+}
+
+func (d *fakeDialer) DialTLS(network, addr string, config *tls.Config) (ldap.Client, error) {
+	d.mu.Lock()
+	d.tlsConfig = config
+	d.mu.Unlock()
+	return d.Dial(network, addr)
+}
+
+func (d *fakeDialer) dialCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
@@ -0,0 +1,99 @@
+package pooldap
+
+// EscapeValue escapes value for use as an assertion value in a search filter,
+// e.g. fmt.Sprintf("(cn=%s)", EscapeValue(input)), so that user input can't
+// add wildcards or change the filter's structure. Like ldap.EscapeFilter it
+// escapes the filter specials ( ) * \ and NUL, and every byte above 0x7f, which
+// also keeps invalid UTF-8 from reaching the server's filter parser raw. It
+// additionally escapes the other control characters so the filter stays
+// printable in logs.
+func EscapeValue(value string) string {
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c < 0x20, c >= 0x7f, c == '(', c == ')', c == '*', c == '\\':
+			buf = append(buf, '\\', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// Filter is a search filter built from escaped parts, e.g.
+//
+//	Equal("objectClass", "person").And(Or(Equal("uid", input), Equal("mail", input)))
+//
+// Values are escaped with EscapeValue; attribute names are used as given and
+// must not come from user input. Convert a trusted filter string with
+// Filter(s). Pass f.String() as the filter of a search request.
+type Filter string
+
+// Equal matches entries where attribute has value.
+func Equal(attribute, value string) Filter {
+	return Filter("(" + attribute + "=" + EscapeValue(value) + ")")
+}
+
+// Present matches entries that have attribute.
+func Present(attribute string) Filter {
+	return Filter("(" + attribute + "=*)")
+}
+
+// Prefix matches entries where a value of attribute starts with value.
+func Prefix(attribute, value string) Filter {
+	return Filter("(" + attribute + "=" + EscapeValue(value) + "*)")
+}
+
+// Contains matches entries where a value of attribute contains value.
+func Contains(attribute, value string) Filter {
+	return Filter("(" + attribute + "=*" + EscapeValue(value) + "*)")
+}
+
+// GreaterOrEqual matches entries where attribute orders at or after value.
+func GreaterOrEqual(attribute, value string) Filter {
+	return Filter("(" + attribute + ">=" + EscapeValue(value) + ")")
+}
+
+// LessOrEqual matches entries where attribute orders at or before value.
+func LessOrEqual(attribute, value string) Filter {
+	return Filter("(" + attribute + "<=" + EscapeValue(value) + ")")
+}
+
+// And matches entries matched by every one of filters.
+func And(filters ...Filter) Filter {
+	return join("&", filters)
+}
+
+// Or matches entries matched by any of filters.
+func Or(filters ...Filter) Filter {
+	return join("|", filters)
+}
+
+// Not matches entries that f doesn't match.
+func Not(f Filter) Filter {
+	return "(!" + f + ")"
+}
+
+func join(op string, filters []Filter) Filter {
+	f := Filter("(" + op)
+	for _, filter := range filters {
+		f += filter
+	}
+	return f + ")"
+}
+
+// And matches entries matched by f and every one of filters.
+func (f Filter) And(filters ...Filter) Filter {
+	return And(append([]Filter{f}, filters...)...)
+}
+
+// Or matches entries matched by f or any of filters.
+func (f Filter) Or(filters ...Filter) Filter {
+	return Or(append([]Filter{f}, filters...)...)
+}
+
+func (f Filter) String() string {
+	return string(f)
+}
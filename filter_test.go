@@ -0,0 +1,68 @@
+package pooldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
+)
+
+func TestEscapeValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"fry":              "fry",
+		"*":                `\2a`,
+		"fry)(uid=*":       `fry\29\28uid=\2a`,
+		`a\b`:              `a\5cb`,
+		"nul\x00":          `nul\00`,
+		"tab\tnewline\n":   `tab\09newline\0a`,
+		"Zoë":              `Zo\c3\ab`,
+		"bad\xffutf8":      `bad\ffutf8`,
+		"(|(uid=*)(cn=*))": `\28|\28uid=\2a\29\28cn=\2a\29\29`,
+	} {
+		assert.Equal(t, expected, EscapeValue(value), value)
+	}
+}
+
+func FuzzEscapeValue(f *testing.F) {
+	for _, seed := range []string{"fry", "*", "fry)(uid=*", `\`, "\x00", "Zoë", "\xff\xfe", "(|(a=b))"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		filter := "(&(objectClass=person)(cn=" + EscapeValue(value) + "))"
+		packet, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Fatalf("%q: escaped filter %q does not compile: %s", value, filter, err)
+		}
+		if packet.Tag != ldap.FilterAnd || len(packet.Children) != 2 {
+			t.Fatalf("%q: escaped filter %q changed the filter structure", value, filter)
+		}
+		match := packet.Children[1]
+		if match.Tag != ldap.FilterEqualityMatch || len(match.Children) != 2 {
+			t.Fatalf("%q: escaped filter %q is no longer an equality match", value, filter)
+		}
+		if got := match.Children[1].Data.String(); got != value {
+			t.Fatalf("%q: escaped filter %q matches %q instead", value, filter, got)
+		}
+	})
+}
+
+func TestFilter(t *testing.T) {
+	input := "fry)(uid=*"
+	for expected, f := range map[string]Filter{
+		`(uid=fry\29\28uid=\2a)`: Equal("uid", input),
+		`(mail=*)`:               Present("mail"),
+		`(cn=Phil\2a*)`:          Prefix("cn", "Phil*"),
+		`(cn=*J. Fry*)`:          Contains("cn", "J. Fry"),
+		`(!(uid=fry))`:           Not(Equal("uid", "fry")),
+		`(&(objectClass=person)(|(uid=fry)(mail=fry@example.com)))`: Equal("objectClass", "person").And(
+			Or(Equal("uid", "fry"), Equal("mail", "fry@example.com"))),
+		`(|(&(uidNumber>=1000)(uidNumber<=1999))(cn=admin))`: GreaterOrEqual("uidNumber", "1000").And(
+			LessOrEqual("uidNumber", "1999")).Or(Equal("cn", "admin")),
+		`(&(objectClass=group)(member=uid=fry,ou=people,dc=example,dc=com))`: Filter("(objectClass=group)").And(
+			Equal("member", "uid=fry,ou=people,dc=example,dc=com")),
+	} {
+		assert.Equal(t, expected, f.String())
+		_, err := ldap.CompileFilter(f.String())
+		assert.NoError(t, err, expected)
+	}
+}
@@ -0,0 +1,72 @@
+package pooldap
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// healthCheckTimeout bounds how long HealthHandler waits for a pooled
+// connection before reporting the client unhealthy.
+const healthCheckTimeout = 5 * time.Second
+
+// healthReport is the body HealthHandler answers with.
+type healthReport struct {
+	Status     string      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	SearchPool *poolStatus `json:"search_pool,omitempty"`
+	BindPool   *poolStatus `json:"bind_pool,omitempty"`
+}
+
+type poolStatus struct {
+	Idle int `json:"idle"`
+}
+
+// HealthHandler returns a handler suitable for readiness probes. It answers
+// 200 with the pool sizes as JSON when both pools can serve a connection and
+// the service account can bind, and 503 with the error otherwise.
+func (lc *Client) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := lc.healthCheck(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(healthReport{Status: "unavailable", Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(healthReport{
+			Status:     "ok",
+			SearchPool: &poolStatus{Idle: lc.searchPool.Len()},
+			BindPool:   &poolStatus{Idle: lc.bindPool.Len()},
+		})
+	}
+}
+
+// healthCheck takes a connection from each pool and binds the search
+// connection as the service account.
+func (lc *Client) healthCheck() error {
+	conn, err := getWithin(lc.searchPool, healthCheckTimeout)
+	if err != nil {
+		return errors.Wrap(err, "search pool")
+	}
+	defer conn.Close()
+
+	if dn, password := lc.bindCredentials(); dn != "" {
+		if err := lc.checkSecureBind(password); err != nil {
+			return err
+		}
+		if err := conn.Bind(dn, password); err != nil {
+			conn.AutoClose(err)
+			return newBindError(err)
+		}
+	}
+
+	bindConn, err := getWithin(lc.bindPool, healthCheckTimeout)
+	if err != nil {
+		return errors.Wrap(err, "bind pool")
+	}
+	bindConn.Close()
+	return nil
+}
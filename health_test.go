@@ -0,0 +1,87 @@
+package pooldap
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func healthStatus(lc *Client) (int, string) {
+	rec := httptest.NewRecorder()
+	lc.HealthHandler()(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestClient_HealthHandler(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	lc, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(&fakeDialer{}))
+	require.NoError(t, err)
+
+	code, body := healthStatus(lc)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"status":"ok","search_pool":{"idle":1},"bind_pool":{"idle":1}}`, body)
+
+	lc.Close()
+	code, body = healthStatus(lc)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, ErrClosed.Error())
+}
+
+func TestClient_HealthHandlerBindFailure(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "rotated"
+	var conns []*fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{}
+		conns = append(conns, conn)
+		return conn
+	}}
+	lc, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	for _, conn := range conns {
+		conn.bindFn = func(username, password string) error {
+			return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials \x00 for \"cn=service\" ü"))
+		}
+	}
+	code, body := healthStatus(lc)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	var report healthReport
+	require.NoError(t, json.Unmarshal([]byte(body), &report))
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Contains(t, report.Error, "invalid credentials \x00 for \"cn=service\" ü")
+}
+
+func TestClient_HealthHandlerInsecureBind(t *testing.T) {
+	config := dialerTestConfig()
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	config.LazyBind = true
+	config.RequireSecureBind = true
+	var binds int
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		return &fakeConn{bindFn: func(username, password string) error {
+			binds++
+			return nil
+		}}
+	}}
+	lc, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	code, body := healthStatus(lc)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, ErrInsecureBind.Error())
+	assert.Zero(t, binds)
+}
@@ -0,0 +1,23 @@
+package pooldap
+
+import (
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// languageValue returns the first value of attribute tagged with the first
+// of languages the entry has a value for, e.g. displayName;lang-fr, falling
+// back to the untagged value. Directories return the tagged variants when
+// the base attribute is requested.
+func languageValue(entry *ldap.Entry, attribute string, languages []string) string {
+	for _, language := range languages {
+		tagged := attribute + ";lang-" + language
+		for _, attr := range entry.Attributes {
+			if strings.EqualFold(attr.Name, tagged) && len(attr.Values) > 0 {
+				return attr.Values[0]
+			}
+		}
+	}
+	return entry.GetAttributeValue(attribute)
+}
@@ -0,0 +1,41 @@
+package pooldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_PreferredLanguages(t *testing.T) {
+	user := &ldap.Entry{
+		DN: fakeUser.DN,
+		Attributes: []*ldap.EntryAttribute{
+			{Name: "uid", Values: []string{"fry"}},
+			{Name: "cn", Values: []string{"Philip J. Fry"}},
+			{Name: "cn;lang-de", Values: []string{"Philipp J. Fry"}},
+			{Name: "cn;lang-fr", Values: []string{"Philippe J. Fry"}},
+		},
+	}
+	for _, tc := range []struct {
+		languages []string
+		expected  string
+	}{
+		{nil, "Philip J. Fry"},
+		{[]string{"fr", "de"}, "Philippe J. Fry"},
+		{[]string{"es", "de"}, "Philipp J. Fry"},
+		{[]string{"FR"}, "Philippe J. Fry"},
+		{[]string{"es"}, "Philip J. Fry"},
+	} {
+		conn := &fakeConn{searchFn: entriesResult(user)}
+		config := fakeUserConfig()
+		config.PreferredLanguages = tc.languages
+		lc := newFakeClient(t, config, conn)
+
+		attrs, err := lc.GetUser("fry")
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, attrs["cn"], "%v", tc.languages)
+		assert.Equal(t, "fry", attrs["uid"])
+	}
+}
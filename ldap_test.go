@@ -1,10 +1,12 @@
 package pooldap_test
 
 import (
+	"errors"
 	"github.com/dimitertodorov/pooldap"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
 	"sync"
 	"testing"
 	"time"
@@ -72,6 +74,13 @@ func TestClient_AuthenticateBadPassword(t *testing.T) {
 	assert.Regexp(t, "(?i)John A. Zoidberg", user["cn"])
 }
 
+func TestClient_AuthenticateBindErrorCode(t *testing.T) {
+	_, _, err := testClient.Authenticate("zoidberg", "evil")
+	var bindErr *pooldap.BindError
+	assert.True(t, errors.As(err, &bindErr))
+	assert.Equal(t, uint16(ldap.LDAPResultInvalidCredentials), bindErr.Code)
+}
+
 func TestClient_GetUserGroups(t *testing.T) {
 	groups, err := testClient.GetUserGroups("fry")
 	assert.NoError(t, err)
@@ -108,3 +117,56 @@ func TestClient_GetUser_Threaded(t *testing.T) {
 		assert.Equal(t, tr["user"], tr["model"].(map[string]interface{})["uid"])
 	}
 }
+
+func TestClient_GetGroupMembers(t *testing.T) {
+	members, err := testClient.GetGroupMembers("cn=ship_crew,ou=people,dc=planetexpress,dc=com")
+	assert.NoError(t, err)
+	assert.Contains(t, members, "cn=Philip J. Fry,ou=people,dc=planetexpress,dc=com")
+	assert.Len(t, members, 3)
+}
+
+func TestClient_GetGroupMembersNotFound(t *testing.T) {
+	_, err := testClient.GetGroupMembers("cn=no_such_group,ou=people,dc=planetexpress,dc=com")
+	assert.Error(t, err)
+}
+
+func TestClient_CheckBind(t *testing.T) {
+	assert.NoError(t, testClient.CheckBind())
+}
+
+func TestClient_CheckBindBadCredentials(t *testing.T) {
+	config := testConfig
+	config.BindPassword = "BadNewsEveryone"
+	client, err := pooldap.NewClient(config, 0, 1, 0, 1, time.Minute)
+	assert.NoError(t, err)
+
+	var bindErr *pooldap.BindError
+	assert.True(t, errors.As(client.CheckBind(), &bindErr))
+	assert.Equal(t, uint16(ldap.LDAPResultInvalidCredentials), bindErr.Code)
+}
+
+func TestClient_CheckBindUnreachable(t *testing.T) {
+	config := testConfig
+	config.Host = "127.0.0.1"
+	config.Port = 1
+	client, err := pooldap.NewClient(config, 0, 1, 0, 1, time.Minute)
+	assert.NoError(t, err)
+
+	assert.True(t, errors.Is(client.CheckBind(), pooldap.ErrUnreachable))
+}
+
+func TestClient_Clone(t *testing.T) {
+	clone, err := testClient.Clone(pooldap.WithBase("ou=people,dc=planetexpress,dc=com"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ou=people,dc=planetexpress,dc=com", clone.Config.Base)
+	assert.Equal(t, "dc=planetexpress,dc=com", testClient.Config.Base)
+
+	user, err := clone.GetUser("zoidberg")
+	assert.NoError(t, err)
+	assert.Regexp(t, "(?i)John A. Zoidberg", user["cn"])
+
+	clone, err = testClient.Clone(pooldap.WithBase("ou=nowhere,dc=planetexpress,dc=com"))
+	assert.NoError(t, err)
+	_, err = clone.GetUser("zoidberg")
+	assert.Error(t, err)
+}
@@ -0,0 +1,54 @@
+package pooldap
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// defaultLeakThreshold is how long a connection may stay checked out before
+// DetectLeaks warns, when LeakThreshold is not set.
+const defaultLeakThreshold = time.Minute
+
+// leakCheck watches a checked-out PoolConn that hasn't been closed.
+type leakCheck struct {
+	once  sync.Once
+	timer *time.Timer
+}
+
+// watchLeak warns through the pool's logger, with the stack that acquired
+// the connection, if p is still checked out after threshold or is garbage
+// collected without being closed.
+func (c *channelPool) watchLeak(p *PoolConn, threshold time.Duration) {
+	if threshold <= 0 {
+		threshold = defaultLeakThreshold
+	}
+	stack := debug.Stack()
+	acquired := time.Now()
+	logger := c.GetLogger()
+
+	check := &leakCheck{}
+	check.timer = time.AfterFunc(threshold, func() {
+		logger.Warnf("pooldap connection held for %s without being closed, acquired at:\n%s", time.Since(acquired), stack)
+	})
+	p.leak = check
+	runtime.SetFinalizer(p, func(*PoolConn) {
+		check.stop()
+		logger.Warnf("pooldap connection garbage collected without being closed, acquired at:\n%s", stack)
+	})
+}
+
+// stop disarms the check once the connection is closed.
+func (l *leakCheck) stop() {
+	l.once.Do(func() { l.timer.Stop() })
+}
+
+// closeLeak disarms the leak check of p, if any.
+func (p *PoolConn) closeLeak() {
+	if p.leak == nil {
+		return
+	}
+	p.leak.stop()
+	runtime.SetFinalizer(p, nil)
+}
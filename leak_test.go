@@ -0,0 +1,82 @@
+package pooldap
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLeakPool(t *testing.T, threshold time.Duration) (*channelPool, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	client := &Client{Config: LdapConfig{DetectLeaks: true, LeakThreshold: threshold}}
+	client.SetLogger(logger)
+	pool, err := NewChannelPool(1, 1, SharedPool, fakeFactory, client, nil, time.Hour)
+	require.NoError(t, err)
+	pool.(*channelPool).AliveChecks(false)
+	return pool.(*channelPool), hook
+}
+
+func leakWarnings(hook *test.Hook, message string) int {
+	n := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.Contains(entry.Message, message) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestChannelPool_DetectLeaksHeld(t *testing.T) {
+	pool, hook := newLeakPool(t, 20*time.Millisecond)
+	defer pool.Close()
+
+	closed, err := pool.Get()
+	require.NoError(t, err)
+	closed.Close()
+
+	leaked, err := pool.Get()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return leakWarnings(hook, "without being closed") == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Contains(t, hook.LastEntry().Message, "TestChannelPool_DetectLeaksHeld")
+	leaked.Close()
+}
+
+func TestChannelPool_DetectLeaksCollected(t *testing.T) {
+	pool, hook := newLeakPool(t, time.Hour)
+	defer pool.Close()
+
+	func() {
+		_, err := pool.Get()
+		require.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return leakWarnings(hook, "garbage collected") == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestChannelPool_DetectLeaksReplacement(t *testing.T) {
+	pool, hook := newLeakPool(t, 20*time.Millisecond)
+	defer pool.Close()
+
+	// replacing an unusable connection doesn't count as a checkout
+	conn, err := pool.Get()
+	require.NoError(t, err)
+	conn.MarkUnusable()
+	conn.Close()
+	assert.Equal(t, 1, pool.Len())
+
+	time.Sleep(50 * time.Millisecond)
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	assert.Zero(t, leakWarnings(hook, "without being closed"))
+	assert.Zero(t, leakWarnings(hook, "garbage collected"))
+}
@@ -0,0 +1,65 @@
+package pooldap
+
+import (
+	"strings"
+)
+
+// normalizeValue prepares an attribute value for an equality match the way
+// the caseIgnoreMatch and caseExactMatch rules do (RFC 4518): leading and
+// trailing spaces are insignificant and inner runs of spaces count as one.
+// Unless caseExact is set, case is folded as well.
+func normalizeValue(value string, caseExact bool) string {
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool { return r == ' ' }), " ")
+	if caseExact {
+		return value
+	}
+	return strings.ToLower(value)
+}
+
+// caseExact reports whether attribute is compared with caseExactMatch, as
+// listed in CaseExactAttributes. Other attributes use caseIgnoreMatch, the
+// rule of cn, uid and most naming attributes.
+func (c LdapConfig) caseExact(attribute string) bool {
+	return containsFold(c.CaseExactAttributes, attribute)
+}
+
+// normalize is normalizeValue with the matching rule of attribute.
+func (c LdapConfig) normalize(attribute, value string) string {
+	return normalizeValue(value, c.caseExact(attribute))
+}
+
+// ValuesMatch reports whether a and b are equal values of attribute under
+// its matching rule: caseIgnoreMatch unless attribute is listed in
+// Config.CaseExactAttributes. Both rules ignore leading, trailing and
+// repeated spaces.
+func (lc *Client) ValuesMatch(attribute, a, b string) bool {
+	return lc.Config.normalize(attribute, a) == lc.Config.normalize(attribute, b)
+}
+
+// GroupDN looks up the group called name in groups, a GetUserGroups result,
+// matching names as ValuesMatch does for Config.GroupNameAttribute, so
+// "Domain Admins" finds "domain admins". A name given exactly as returned
+// always finds its group; otherwise ok is false if the name matches several
+// groups, e.g. "admins" on a server with both "Admins" and "ADMINS".
+func (lc *Client) GroupDN(groups map[string]string, name string) (dn string, ok bool) {
+	if dn, ok = groups[name]; ok {
+		return
+	}
+	for groupName, groupDN := range groups {
+		if !lc.ValuesMatch(lc.Config.GroupNameAttribute, groupName, name) {
+			continue
+		}
+		if ok {
+			return "", false
+		}
+		dn, ok = groupDN, true
+	}
+	return
+}
+
+// usernameKey returns the key under which the group cache holds username,
+// so that usernames differing only in case, under the matching rule of
+// Config.Uid, share an entry.
+func (c LdapConfig) usernameKey(username string) string {
+	return c.normalize(c.uid(), username)
+}
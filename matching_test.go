@@ -0,0 +1,94 @@
+package pooldap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_ValuesMatch(t *testing.T) {
+	lc := &Client{Config: LdapConfig{CaseExactAttributes: []string{"employeeID"}}}
+
+	assert.True(t, lc.ValuesMatch("cn", "Domain Admins", "domain admins"))
+	assert.True(t, lc.ValuesMatch("cn", " Domain  Admins ", "DOMAIN ADMINS"))
+	assert.False(t, lc.ValuesMatch("cn", "Domain Admins", "Domain-Admins"))
+	assert.True(t, lc.ValuesMatch("uid", "Fry", "fry"))
+	assert.False(t, lc.ValuesMatch("employeeID", "AB12", "ab12"))
+	assert.False(t, lc.ValuesMatch("EMPLOYEEID", "AB12", "ab12"))
+	assert.True(t, lc.ValuesMatch("employeeID", "AB12 ", "AB12"))
+}
+
+func TestClient_GetUserGroupsCaseInsensitive(t *testing.T) {
+	groups := []*ldap.Entry{
+		{DN: "cn=Admins,ou=groups,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"Admins"}}}},
+		{DN: "cn=crew,ou=groups,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"crew"}}}},
+		{DN: "cn=admins,ou=legacy,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"admins"}}}},
+	}
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.HasPrefix(req.Filter, "(member=") {
+			return &ldap.SearchResult{Entries: groups}, nil
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+	}}
+	config := fakeUserConfig()
+	config.GroupCacheTTL = time.Minute
+	lc := newFakeClient(t, config, conn)
+
+	result, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"Admins": "cn=admins,ou=groups,dc=example,dc=com",
+		"crew":   "cn=crew,ou=groups,dc=example,dc=com",
+		"admins": "cn=admins,ou=legacy,dc=example,dc=com",
+	}, result)
+	dn, ok := lc.GroupDN(result, "CREW")
+	assert.True(t, ok)
+	assert.Equal(t, "cn=crew,ou=groups,dc=example,dc=com", dn)
+	_, ok = lc.GroupDN(result, "staff")
+	assert.False(t, ok)
+
+	// names differing only in case find their own group, others neither
+	dn, ok = lc.GroupDN(result, "Admins")
+	assert.True(t, ok)
+	assert.Equal(t, "cn=admins,ou=groups,dc=example,dc=com", dn)
+	dn, ok = lc.GroupDN(result, "admins")
+	assert.True(t, ok)
+	assert.Equal(t, "cn=admins,ou=legacy,dc=example,dc=com", dn)
+	_, ok = lc.GroupDN(result, "ADMINS")
+	assert.False(t, ok)
+
+	// usernames differing in case share a cache entry
+	_, err = lc.GetUserGroups("Fry")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 2)
+	lc.InvalidateGroups("FRY")
+	_, err = lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Len(t, conn.searches, 4)
+}
+
+func TestClient_GetUserGroupsCaseExact(t *testing.T) {
+	groups := []*ldap.Entry{
+		{DN: "cn=Admins,ou=groups,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"Admins"}}}},
+		{DN: "cn=admins,ou=legacy,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"admins"}}}},
+	}
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if strings.HasPrefix(req.Filter, "(member=") {
+			return &ldap.SearchResult{Entries: groups}, nil
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+	}}
+	config := fakeUserConfig()
+	config.CaseExactAttributes = []string{"cn"}
+	lc := newFakeClient(t, config, conn)
+
+	result, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+	_, ok := lc.GroupDN(result, "ADMINS")
+	assert.False(t, ok)
+}
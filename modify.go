@@ -0,0 +1,184 @@
+package pooldap
+
+import (
+	"github.com/pkg/errors"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// DeleteEntry deletes the entry at dn using a search pool connection. With
+// recursive set, all subordinate entries are deleted too: the subtree delete
+// control is tried first and, if the server doesn't support it, the children
+// are removed one by one, deepest first.
+func (lc *Client) DeleteEntry(dn string, recursive bool) (err error) {
+	conn, err := lc.searchPool.Get()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if !recursive {
+		err = conn.Del(ldap.NewDelRequest(dn, nil))
+		conn.AutoClose(err)
+		return
+	}
+
+	err = conn.Del(ldap.NewDelRequest(dn, []ldap.Control{NewControlSubtreeDelete()}))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailableCriticalExtension) {
+		lc.GetLogger().Debugf("subtree delete control not supported, deleting %s manually", dn)
+		err = deleteTree(conn, dn)
+	}
+	conn.AutoClose(err)
+	return
+}
+
+// ControlModifier is implemented by connections that can send a modify
+// request with controls, as those of the built-in dialers can.
+type ControlModifier interface {
+	ModifyWithControls(modifyRequest *ldap.ModifyRequest, controls []ldap.Control) error
+}
+
+// DNModifier is implemented by connections that can rename or move an
+// entry, as *ldap.Conn and so those of the built-in dialers can. The
+// ldap.Client interface leaves ModifyDN out.
+type DNModifier interface {
+	ModifyDN(modifyDNRequest *ldap.ModifyDNRequest) error
+}
+
+// ModifyWithControls sends modifyRequest with controls, which the ldap
+// package's ModifyRequest can't carry.
+func (c *stateConn) ModifyWithControls(modifyRequest *ldap.ModifyRequest, controls []ldap.Control) error {
+	response, err := c.mux.request(encodeModifyRequest(modifyRequest), controls, c.requestTimeout())
+	if err != nil {
+		return err
+	}
+	return resultError(response)
+}
+
+// encodeModifyRequest encodes modifyRequest as the ldap package does: its
+// additions, then deletions, then replacements.
+func encodeModifyRequest(modifyRequest *ldap.ModifyRequest) *ber.Packet {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationModifyRequest, nil, "Modify Request")
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, modifyRequest.DN, "DN"))
+	changes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Changes")
+	for _, group := range []struct {
+		operation  int64
+		attributes []ldap.PartialAttribute
+	}{
+		{ldap.AddAttribute, modifyRequest.AddAttributes},
+		{ldap.DeleteAttribute, modifyRequest.DeleteAttributes},
+		{ldap.ReplaceAttribute, modifyRequest.ReplaceAttributes},
+	} {
+		for _, attribute := range group.attributes {
+			change := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Change")
+			change.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, group.operation, "Operation"))
+			modification := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Modification")
+			modification.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Type, "Type"))
+			values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "AttributeValue")
+			for _, value := range attribute.Vals {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Vals"))
+			}
+			modification.AppendChild(values)
+			change.AppendChild(modification)
+			changes.AppendChild(change)
+		}
+	}
+	request.AppendChild(changes)
+	return request
+}
+
+// Modify applies modifyRequest using a search pool connection. With a
+// non-empty assertion filter the change is sent with the assertion control
+// and only applied if the entry still matches the filter, which allows
+// compare-and-swap updates; ErrAssertionFailed is returned if it doesn't.
+// Any controls, e.g. NewControlProxiedAuthorization, are sent as well.
+// Assertions and controls need a connection implementing ControlModifier,
+// as those of the built-in dialers do.
+func (lc *Client) Modify(modifyRequest *ldap.ModifyRequest, assertion string, controls ...ldap.Control) (err error) {
+	controls = controls[:len(controls):len(controls)]
+	if assertion != "" {
+		control, err := NewControlAssertion(assertion)
+		if err != nil {
+			return err
+		}
+		controls = append(controls, control)
+	}
+
+	conn, err := lc.searchPool.Get()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	err = conn.ModifyWithControls(modifyRequest, controls)
+	if ldap.IsErrorWithCode(err, LDAPResultAssertionFailed) {
+		return ErrAssertionFailed
+	}
+	conn.AutoClose(err)
+	return
+}
+
+// SetAttribute replaces all values of attr on the entry at dn with values.
+// Without values the attribute is removed. ErrNotFound is returned if there
+// is no entry at dn and ErrConstraintViolation if the directory rejects the
+// values.
+func (lc *Client) SetAttribute(dn, attr string, values ...string) error {
+	modifyRequest := ldap.NewModifyRequest(dn)
+	modifyRequest.Replace(attr, values)
+	return lc.modifyAttribute(modifyRequest)
+}
+
+// AddAttributeValues adds values to attr on the entry at dn, e.g. a member to
+// a group. Errors are as for SetAttribute; a value that is already present is
+// an ldap.LDAPResultAttributeOrValueExists error.
+func (lc *Client) AddAttributeValues(dn, attr string, values ...string) error {
+	modifyRequest := ldap.NewModifyRequest(dn)
+	modifyRequest.Add(attr, values)
+	return lc.modifyAttribute(modifyRequest)
+}
+
+// RemoveAttributeValues removes values from attr on the entry at dn. As in
+// LDAP itself, no values removes the attribute altogether. Errors are as for
+// SetAttribute; a value that isn't present is an
+// ldap.LDAPResultNoSuchAttribute error.
+func (lc *Client) RemoveAttributeValues(dn, attr string, values ...string) error {
+	modifyRequest := ldap.NewModifyRequest(dn)
+	modifyRequest.Delete(attr, values)
+	return lc.modifyAttribute(modifyRequest)
+}
+
+// modifyAttribute applies modifyRequest with Modify, turning a missing entry
+// into ErrNotFound and a constraint violation into ErrConstraintViolation.
+func (lc *Client) modifyAttribute(modifyRequest *ldap.ModifyRequest) error {
+	err := lc.Modify(modifyRequest, "")
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		return errors.Wrap(ErrNotFound, err.Error())
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation):
+		return errors.Wrap(ErrConstraintViolation, err.Error())
+	}
+	return err
+}
+
+// deleteTree deletes dn after recursively deleting its children, listing
+// them in pages so containers larger than the server's size limit go too.
+func deleteTree(conn *PoolConn, dn string) error {
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+	sr, err := conn.SearchWithPaging(searchRequest, autoPageSize)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range sr.Entries {
+		if err := deleteTree(conn, child.DN); err != nil {
+			return err
+		}
+	}
+	return conn.Del(ldap.NewDelRequest(dn, nil))
+}
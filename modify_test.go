@@ -0,0 +1,294 @@
+package pooldap
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// populatedOU answers one-level searches for a small tree:
+// ou=old > (cn=a, ou=sub > cn=b)
+func populatedOU(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	children := map[string][]string{
+		"ou=old,dc=example,dc=com":        {"cn=a,ou=old,dc=example,dc=com", "ou=sub,ou=old,dc=example,dc=com"},
+		"ou=sub,ou=old,dc=example,dc=com": {"cn=b,ou=sub,ou=old,dc=example,dc=com"},
+	}
+	sr := &ldap.SearchResult{}
+	for _, dn := range children[req.BaseDN] {
+		sr.Entries = append(sr.Entries, &ldap.Entry{DN: dn})
+	}
+	return sr, nil
+}
+
+func TestClient_DeleteEntrySubtreeControl(t *testing.T) {
+	conn := &fakeConn{searchFn: populatedOU}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	require.NoError(t, lc.DeleteEntry("ou=old,dc=example,dc=com", true))
+	require.Len(t, conn.dels, 1)
+	require.Len(t, conn.dels[0].Controls, 1)
+	assert.Equal(t, ControlTypeSubtreeDelete, conn.dels[0].Controls[0].GetControlType())
+}
+
+func TestClient_DeleteEntryManualFallback(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: populatedOU,
+		delFn: func(req *ldap.DelRequest) error {
+			if len(req.Controls) > 0 {
+				return ldap.NewError(ldap.LDAPResultUnavailableCriticalExtension, errors.New("unsupported control"))
+			}
+			return nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	require.NoError(t, lc.DeleteEntry("ou=old,dc=example,dc=com", true))
+	var deleted []string
+	for _, req := range conn.dels[1:] {
+		deleted = append(deleted, req.DN)
+	}
+	assert.Equal(t, []string{
+		"cn=a,ou=old,dc=example,dc=com",
+		"cn=b,ou=sub,ou=old,dc=example,dc=com",
+		"ou=sub,ou=old,dc=example,dc=com",
+		"ou=old,dc=example,dc=com",
+	}, deleted)
+}
+
+func TestClient_DeleteEntryManualFallbackPaged(t *testing.T) {
+	sizeLimited := func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		return nil, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	conn := &fakeConn{
+		searchFn: sizeLimited,
+		pagingFn: func(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+			return populatedOU(req)
+		},
+		delFn: func(req *ldap.DelRequest) error {
+			if len(req.Controls) > 0 {
+				return ldap.NewError(ldap.LDAPResultUnavailableCriticalExtension, errors.New("unsupported control"))
+			}
+			return nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	require.NoError(t, lc.DeleteEntry("ou=old,dc=example,dc=com", true))
+	assert.Len(t, conn.dels[1:], 4)
+}
+
+// versionedConn holds a single entry with a version attribute and honors
+// assertion controls of the form (version=N).
+type versionedConn struct {
+	fakeConn
+	version string
+}
+
+func (v *versionedConn) ModifyWithControls(req *ldap.ModifyRequest, controls []ldap.Control) error {
+	if control, ok := ldap.FindControl(controls, ControlTypeAssertion).(*ControlAssertion); ok {
+		if control.Filter != "(version="+v.version+")" {
+			return ldap.NewError(LDAPResultAssertionFailed, errors.New("assertion failed"))
+		}
+	}
+	for _, attr := range req.ReplaceAttributes {
+		if attr.Type == "version" {
+			v.version = attr.Vals[0]
+		}
+	}
+	return v.Modify(req)
+}
+
+func newVersionedClient(t *testing.T, conn ldap.Client) *Client {
+	lc := newFakeClient(t, LdapConfig{}, &fakeConn{})
+	lc.searchPool.Close()
+	searchPool, err := NewChannelPool(0, 1, SharedPool, fakeFactory, lc, nil, 0)
+	require.NoError(t, err)
+	searchPool.(*channelPool).AliveChecks(false)
+	require.NoError(t, searchPool.Adopt(conn))
+	lc.searchPool = searchPool
+	return lc
+}
+
+func TestClient_ModifyAssertion(t *testing.T) {
+	conn := &versionedConn{version: "1"}
+	lc := newVersionedClient(t, conn)
+
+	req := ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")
+	req.Replace("version", []string{"2"})
+	require.NoError(t, lc.Modify(req, "(version=1)"))
+	assert.Equal(t, "2", conn.version)
+
+	// a writer that read version 1 loses the race
+	req = ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")
+	req.Replace("version", []string{"3"})
+	assert.Equal(t, ErrAssertionFailed, lc.Modify(req, "(version=1)"))
+	assert.Equal(t, "2", conn.version)
+	assert.Equal(t, []string{"modify"}, conn.writes)
+}
+
+// versionedServer is versionedConn as a directory, answering the modify
+// requests of a stateConn and recording the controls they carried.
+type versionedServer struct {
+	mu       sync.Mutex
+	version  string
+	controls []map[string]string
+}
+
+func (v *versionedServer) handle(s *ldapServer, request *ber.Packet) {
+	op := protocolOp(request)
+	if op.Tag != ldap.ApplicationModifyRequest {
+		answerSearch(s, request)
+		return
+	}
+	controls := map[string]string{}
+	if len(request.Children) > 2 {
+		for _, control := range request.Children[2].Children {
+			value := control.Children[len(control.Children)-1]
+			controls[control.Children[0].Value.(string)] = value.Data.String()
+			if control.Children[0].Value.(string) == ControlTypeAssertion {
+				filter, err := ldap.DecompileFilter(ber.DecodePacket(value.Data.Bytes()))
+				if err != nil {
+					panic(err)
+				}
+				controls[ControlTypeAssertion] = filter
+			}
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.controls = append(v.controls, controls)
+	if filter, ok := controls[ControlTypeAssertion]; ok && filter != "(version="+v.version+")" {
+		s.reply(messageID(request), ldapResult(ldap.ApplicationModifyResponse, LDAPResultAssertionFailed, "assertion failed"))
+		return
+	}
+	for _, change := range op.Children[1].Children {
+		modification := change.Children[1]
+		if change.Children[0].Value.(int64) == ldap.ReplaceAttribute && modification.Children[0].Value.(string) == "version" {
+			v.version = modification.Children[1].Children[0].Value.(string)
+		}
+	}
+	s.reply(messageID(request), ldapResult(ldap.ApplicationModifyResponse, ldap.LDAPResultSuccess, ""))
+}
+
+// newServerClient returns a Client whose one search pool connection talks
+// to a directory answering with handle, as those of the built-in dialers do.
+func newServerClient(t *testing.T, handle func(s *ldapServer, request *ber.Packet)) *Client {
+	dialer := &serverDialer{t: t, handle: handle, servers: make(chan *ldapServer, 10)}
+	lc, err := NewClient(dialerTestConfig(), 1, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	t.Cleanup(lc.Close)
+	lc.searchPool.(*channelPool).AliveChecks(false)
+	return lc
+}
+
+func TestClient_ModifyAssertionDefaultConn(t *testing.T) {
+	server := &versionedServer{version: "1"}
+	lc := newServerClient(t, server.handle)
+
+	req := ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")
+	req.Replace("version", []string{"2"})
+	require.NoError(t, lc.Modify(req, "(version=1)"))
+	req = ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")
+	req.Replace("version", []string{"3"})
+	assert.Equal(t, ErrAssertionFailed, lc.Modify(req, "(version=1)"))
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, "2", server.version)
+	require.Len(t, server.controls, 2)
+	assert.Equal(t, "(version=1)", server.controls[0][ControlTypeAssertion])
+}
+
+func TestClient_ModifyProxiedAuthorization(t *testing.T) {
+	server := &versionedServer{version: "1"}
+	lc := newServerClient(t, server.handle)
+
+	req := ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")
+	req.Replace("version", []string{"2"})
+	proxy := NewControlProxiedAuthorization("dn:uid=leela,ou=people,dc=example,dc=com")
+	require.NoError(t, lc.Modify(req, "", proxy))
+	require.NoError(t, lc.Modify(req, "(version=2)", proxy))
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	require.Len(t, server.controls, 2)
+	assert.Equal(t, map[string]string{ControlTypeProxiedAuthorization: "dn:uid=leela,ou=people,dc=example,dc=com"}, server.controls[0])
+	assert.Equal(t, "dn:uid=leela,ou=people,dc=example,dc=com", server.controls[1][ControlTypeProxiedAuthorization])
+	assert.Equal(t, "(version=2)", server.controls[1][ControlTypeAssertion])
+}
+
+func TestClient_ModifyAssertionUnsupported(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")
+	req.Replace("version", []string{"2"})
+	assert.Equal(t, ErrNoControls, lc.Modify(req, "(version=1)"))
+	require.NoError(t, lc.Modify(req, ""))
+	assert.Equal(t, []string{"modify"}, conn.writes)
+
+	_, err := NewControlAssertion("version=1)")
+	assert.Error(t, err)
+}
+
+func TestClient_SetAttribute(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	require.NoError(t, lc.SetAttribute(fakeUser.DN, "mail", "fry@example.com"))
+	require.Len(t, conn.modifies, 1)
+	assert.Equal(t, fakeUser.DN, conn.modifies[0].DN)
+	assert.Equal(t, []ldap.PartialAttribute{{Type: "mail", Vals: []string{"fry@example.com"}}}, conn.modifies[0].ReplaceAttributes)
+	assert.Empty(t, conn.modifies[0].AddAttributes)
+	assert.Empty(t, conn.modifies[0].DeleteAttributes)
+}
+
+func TestClient_AddAttributeValues(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	group := "cn=crew,ou=groups,dc=example,dc=com"
+	require.NoError(t, lc.AddAttributeValues(group, "member", fakeUser.DN, "uid=leela,ou=people,dc=example,dc=com"))
+	require.Len(t, conn.modifies, 1)
+	assert.Equal(t, group, conn.modifies[0].DN)
+	assert.Equal(t, []ldap.PartialAttribute{{Type: "member", Vals: []string{fakeUser.DN, "uid=leela,ou=people,dc=example,dc=com"}}}, conn.modifies[0].AddAttributes)
+	assert.Empty(t, conn.modifies[0].ReplaceAttributes)
+}
+
+func TestClient_RemoveAttributeValues(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	group := "cn=crew,ou=groups,dc=example,dc=com"
+	require.NoError(t, lc.RemoveAttributeValues(group, "member", fakeUser.DN))
+	require.Len(t, conn.modifies, 1)
+	assert.Equal(t, []ldap.PartialAttribute{{Type: "member", Vals: []string{fakeUser.DN}}}, conn.modifies[0].DeleteAttributes)
+	assert.Empty(t, conn.modifies[0].AddAttributes)
+}
+
+func TestClient_ModifyAttributeErrors(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	conn.modifyFn = func(*ldap.ModifyRequest) error {
+		return ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	err := lc.SetAttribute("uid=nobody,ou=people,dc=example,dc=com", "mail", "nobody@example.com")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	conn.modifyFn = func(*ldap.ModifyRequest) error {
+		return ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("attribute mail is single-valued"))
+	}
+	err = lc.AddAttributeValues(fakeUser.DN, "mail", "fry@example.com")
+	assert.True(t, errors.Is(err, ErrConstraintViolation))
+	assert.Contains(t, err.Error(), "single-valued")
+
+	lc.Config.ReadOnly = true
+	assert.Equal(t, ErrReadOnly, lc.RemoveAttributeValues(fakeUser.DN, "mail"))
+}
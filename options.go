@@ -0,0 +1,81 @@
+package pooldap
+
+import "net"
+
+// ClientOption customizes a Client before its pools are created.
+type ClientOption func(*Client)
+
+// WithConfig applies fn to the client's LdapConfig.
+func WithConfig(fn func(*LdapConfig)) ClientOption {
+	return func(c *Client) {
+		fn(&c.Config)
+	}
+}
+
+// WithBindCredentials overrides the service account used by the search pool.
+// The password takes the place of BindPasswordFile and BindPasswordEnv.
+func WithBindCredentials(dn, password string) ClientOption {
+	return func(c *Client) {
+		c.Config.BindDN = dn
+		c.Config.BindPassword = password
+		c.Config.BindPasswordFile, c.Config.BindPasswordEnv = "", ""
+	}
+}
+
+// WithBase overrides the base DN used for user and group searches.
+func WithBase(base string) ClientOption {
+	return func(c *Client) {
+		c.Config.Base = base
+	}
+}
+
+// WithAsyncWarmup makes NewClient return before the pools are filled to their
+// initial capacity; the connections are created in the background. Use
+// Client.WarmupDone to wait for them.
+func WithAsyncWarmup() ClientOption {
+	return func(c *Client) {
+		c.asyncWarmup = true
+	}
+}
+
+// WithOperationHook calls fn after every search and bind performed through
+// the Client's methods with the time spent waiting for a connection and the
+// time spent on the wire.
+func WithOperationHook(fn func(OpStats)) ClientOption {
+	return func(c *Client) {
+		c.onOperation = fn
+	}
+}
+
+// WithBindHook calls fn after every Authenticate and AuthenticateSASL
+// attempt, successful or not, with a BindEvent suitable for audit logs.
+func WithBindHook(fn func(BindEvent)) ClientOption {
+	return func(c *Client) {
+		c.onBind = fn
+	}
+}
+
+// WithDialer replaces the Dialer used to open connections to the directory.
+func WithDialer(dialer Dialer) ClientOption {
+	return func(c *Client) {
+		c.Dialer = dialer
+	}
+}
+
+// WithNetDialer dials the directory with dialer, e.g. one with KeepAlive set
+// so that middleboxes don't silently drop idle pooled connections. It
+// replaces any Dialer set before.
+func WithNetDialer(dialer *net.Dialer) ClientOption {
+	return func(c *Client) {
+		c.Dialer = NetDialer{Dialer: dialer}
+	}
+}
+
+// WithPoolRegistry shares the Client's pools with the other Clients in
+// registry that connect to the same directory as the same service account;
+// see PoolRegistry.
+func WithPoolRegistry(registry *PoolRegistry) ClientOption {
+	return func(c *Client) {
+		c.registry = registry
+	}
+}
@@ -0,0 +1,104 @@
+// Package otelpooldap records pooldap operations as OpenTelemetry spans. It
+// lives in its own package so that the pooldap core doesn't depend on
+// OpenTelemetry.
+//
+// Each operation produces a "pooldap.Get" span for the wait for a pooled
+// connection followed by a "pooldap.Search" or "pooldap.Bind" span for the
+// LDAP operation. The spans are children of the span in the context passed to
+// context-aware methods such as Client.SearchContext.
+package otelpooldap
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/dimitertodorov/pooldap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/ldap.v2"
+)
+
+// TracerName is the instrumentation name used for the tracer.
+const TracerName = "github.com/dimitertodorov/pooldap/otelpooldap"
+
+// Span attribute keys.
+const (
+	PoolTypeKey   = attribute.Key("pooldap.pool_type")
+	BaseDNKey     = attribute.Key("ldap.base_dn")
+	ResultCodeKey = attribute.Key("ldap.result_code")
+)
+
+// WithTracing returns a pooldap.ClientOption that records the Client's
+// operations as spans of a tracer from provider. It replaces any other
+// operation hook; use Hook to combine it with one.
+func WithTracing(provider trace.TracerProvider) pooldap.ClientOption {
+	return pooldap.WithOperationHook(Hook(provider))
+}
+
+// Hook returns an operation hook, for pooldap.WithOperationHook, that records
+// every operation as spans of a tracer from provider.
+func Hook(provider trace.TracerProvider) func(pooldap.OpStats) {
+	tracer := provider.Tracer(TracerName)
+	return func(stats pooldap.OpStats) {
+		ctx := stats.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		poolType := PoolTypeKey.String(stats.PoolType.String())
+		acquired := stats.Start.Add(stats.WaitDuration)
+
+		_, get := tracer.Start(ctx, "pooldap.Get",
+			trace.WithTimestamp(stats.Start),
+			trace.WithSpanKind(trace.SpanKindInternal),
+			trace.WithAttributes(poolType))
+		if stats.NoConn {
+			get.RecordError(stats.Err)
+			get.SetStatus(codes.Error, stats.Err.Error())
+			get.End(trace.WithTimestamp(acquired))
+			return
+		}
+		get.End(trace.WithTimestamp(acquired))
+
+		attributes := []attribute.KeyValue{poolType}
+		if stats.BaseDN != "" {
+			attributes = append(attributes, BaseDNKey.String(stats.BaseDN))
+		}
+		attributes = append(attributes, ResultCodeKey.Int(resultCode(stats.Err)))
+		_, op := tracer.Start(ctx, spanName(stats.Operation),
+			trace.WithTimestamp(acquired),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attributes...))
+		if stats.Err != nil {
+			op.RecordError(stats.Err)
+			op.SetStatus(codes.Error, stats.Err.Error())
+		}
+		op.End(trace.WithTimestamp(acquired.Add(stats.WireDuration)))
+	}
+}
+
+// spanName returns the span name for operation, e.g. "pooldap.Search".
+func spanName(operation string) string {
+	if operation == "" {
+		return "pooldap"
+	}
+	return "pooldap." + strings.ToUpper(operation[:1]) + operation[1:]
+}
+
+// resultCode returns the LDAP result code carried by err, 0 (success) for
+// nil and ldap.ErrorNetwork for errors without one.
+func resultCode(err error) int {
+	if err == nil {
+		return ldap.LDAPResultSuccess
+	}
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		return int(ldapErr.ResultCode)
+	}
+	var bindErr *pooldap.BindError
+	if errors.As(err, &bindErr) {
+		return int(bindErr.Code)
+	}
+	return ldap.ErrorNetwork
+}
@@ -0,0 +1,109 @@
+package otelpooldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dimitertodorov/pooldap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gopkg.in/ldap.v2"
+)
+
+func newRecorder() (*tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+	exporter := tracetest.NewInMemoryExporter()
+	return exporter, sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+}
+
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	values := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		values[kv.Key] = kv.Value
+	}
+	return values
+}
+
+func TestHook_Search(t *testing.T) {
+	exporter, provider := newRecorder()
+	hook := Hook(provider)
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "handler")
+	start := time.Now()
+	hook(pooldap.OpStats{
+		Operation:    "search",
+		PoolType:     pooldap.SharedPool,
+		WaitDuration: 2 * time.Millisecond,
+		WireDuration: 5 * time.Millisecond,
+		Start:        start,
+		BaseDN:       "dc=example,dc=com",
+		Context:      ctx,
+	})
+	parent.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	get, search := spans[0], spans[1]
+
+	assert.Equal(t, "pooldap.Get", get.Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), get.Parent.SpanID())
+	assert.Equal(t, start, get.StartTime)
+	assert.Equal(t, 2*time.Millisecond, get.EndTime.Sub(get.StartTime))
+	assert.Equal(t, "shared", attributes(get)[PoolTypeKey].AsString())
+
+	assert.Equal(t, "pooldap.Search", search.Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), search.Parent.SpanID())
+	assert.Equal(t, get.EndTime, search.StartTime)
+	assert.Equal(t, 5*time.Millisecond, search.EndTime.Sub(search.StartTime))
+	attrs := attributes(search)
+	assert.Equal(t, "shared", attrs[PoolTypeKey].AsString())
+	assert.Equal(t, "dc=example,dc=com", attrs[BaseDNKey].AsString())
+	assert.Equal(t, int64(ldap.LDAPResultSuccess), attrs[ResultCodeKey].AsInt64())
+	assert.Equal(t, codes.Unset, search.Status.Code)
+}
+
+func TestHook_BindError(t *testing.T) {
+	exporter, provider := newRecorder()
+	hook := Hook(provider)
+
+	hook(pooldap.OpStats{
+		Operation:    "bind",
+		PoolType:     pooldap.BindPool,
+		WireDuration: time.Millisecond,
+		Start:        time.Now(),
+		Err:          ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials")),
+	})
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	bind := spans[1]
+	assert.Equal(t, "pooldap.Bind", bind.Name)
+	attrs := attributes(bind)
+	assert.Equal(t, "bind", attrs[PoolTypeKey].AsString())
+	assert.NotContains(t, attrs, BaseDNKey)
+	assert.Equal(t, int64(ldap.LDAPResultInvalidCredentials), attrs[ResultCodeKey].AsInt64())
+	assert.Equal(t, codes.Error, bind.Status.Code)
+}
+
+func TestHook_GetFailure(t *testing.T) {
+	exporter, provider := newRecorder()
+	hook := Hook(provider)
+
+	hook(pooldap.OpStats{
+		Operation: "search",
+		PoolType:  pooldap.SharedPool,
+		Start:     time.Now(),
+		Err:       pooldap.ErrClosed,
+		NoConn:    true,
+	})
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "pooldap.Get", spans[0].Name)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+}
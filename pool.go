@@ -1,12 +1,20 @@
 package pooldap
 
 import (
+	"context"
 	"errors"
+	"time"
+
+	"gopkg.in/ldap.v2"
 )
 
 var (
 	// ErrClosed is the error resulting if the pool is closed via pool.Close().
 	ErrClosed = errors.New("pool is closed")
+
+	// errGetTimeout is returned by getWithin when no connection became
+	// available in time.
+	errGetTimeout = errors.New("timed out waiting for a connection")
 )
 
 // Pool interface describes a pool implementation. A pool should have maximum
@@ -17,6 +25,10 @@ type Pool interface {
 	// be counted as an error.
 	Get() (*PoolConn, error)
 
+	// GetContext is Get that gives up with ctx.Err() once ctx is done,
+	// without leaving anything waiting on the pool.
+	GetContext(ctx context.Context) (*PoolConn, error)
+
 	// Close closes the pool and all its connections. After Close() the pool is
 	// no longer usable.
 	Close()
@@ -24,6 +36,56 @@ type Pool interface {
 	// Len returns the current number of connections of the pool.
 	Len() int
 
+	// LiveLen probes the idle connections and returns how many are alive,
+	// dropping the dead ones.
+	LiveLen() int
+
 	// RefillPool will refill up to the initial cap.
 	RefillPool()
+
+	// RefillPoolContext prunes expired idle connections and refills up to the
+	// initial cap until ctx is cancelled or the pool is closed.
+	RefillPoolContext(ctx context.Context)
+
+	// Reset replaces the pool's connections: idle ones are closed and
+	// recreated now, checked-out ones are closed when they are returned.
+	Reset()
+
+	// CloseAt returns the result codes that mark a connection unusable and
+	// SetCloseAt replaces them for connections handed out afterwards.
+	CloseAt() []uint8
+	SetCloseAt(closeAt []uint8)
+
+	// Adopt hands a connection created elsewhere to the pool, which then
+	// owns it. It fails if the pool is closed or at its maximum capacity.
+	Adopt(conn ldap.Client) error
+
+	// Stats returns the pool's connection counts and factory failures.
+	Stats() PoolStats
+
+	// WarmedUp returns a channel that is closed once the pool has been filled
+	// to its initial capacity.
+	WarmedUp() <-chan struct{}
+}
+
+// PoolStats is a snapshot of a pool's counters.
+type PoolStats struct {
+	// Idle and Open are the idle and all connections the pool has open.
+	Idle int
+	Open int
+	// DialErrors counts new connections that could not be dialed and
+	// BindErrors those that were dialed but whose service bind failed.
+	DialErrors uint64
+	BindErrors uint64
+}
+
+// getWithin gets a connection from pool, giving up after timeout.
+func getWithin(pool Pool, timeout time.Duration) (*PoolConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := pool.GetContext(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, errGetTimeout
+	}
+	return conn, err
 }
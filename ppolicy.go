@@ -0,0 +1,52 @@
+package pooldap
+
+import (
+	"gopkg.in/ldap.v2"
+)
+
+// PasswordPolicy is the password policy response control (draft-behera-ldap-
+// password-policy) returned by directories running a ppolicy overlay.
+// Fields the server didn't send are -1.
+type PasswordPolicy struct {
+	// GraceAuthNsRemaining is the number of grace logins left after expiry.
+	GraceAuthNsRemaining int64
+	// TimeBeforeExpiration is the number of seconds until the password expires.
+	TimeBeforeExpiration int64
+	// Error is the ppolicy error code, e.g. 0 for passwordExpired or 1 for
+	// accountLocked, and ErrorString its description.
+	Error       int8
+	ErrorString string
+	// MustChangePassword is set for the changeAfterReset error: the bind
+	// succeeded but the user has to change their password first.
+	MustChangePassword bool
+}
+
+// ppolicyChangeAfterReset is the password policy error code for a password
+// that must be changed after a reset.
+const ppolicyChangeAfterReset = 2
+
+// AuthenticateWithPolicy is Authenticate with the password policy request
+// control attached to the bind. policy is nil if the server didn't return the
+// response control; it is populated on failed binds too, e.g. to report a
+// locked account.
+func (lc *Client) AuthenticateWithPolicy(username, password string) (valid bool, userAttributes map[string]interface{}, policy *PasswordPolicy, err error) {
+	valid, userAttributes, result, err := lc.AuthenticateWithControls(username, password, ldap.NewControlBeheraPasswordPolicy())
+	if result != nil {
+		policy = passwordPolicyFromControls(result.Controls)
+	}
+	return
+}
+
+func passwordPolicyFromControls(controls []ldap.Control) *PasswordPolicy {
+	control, ok := ldap.FindControl(controls, ldap.ControlTypeBeheraPasswordPolicy).(*ldap.ControlBeheraPasswordPolicy)
+	if !ok {
+		return nil
+	}
+	return &PasswordPolicy{
+		GraceAuthNsRemaining: control.Grace,
+		TimeBeforeExpiration: control.Expire,
+		Error:                control.Error,
+		ErrorString:          control.ErrorString,
+		MustChangePassword:   control.Error == ppolicyChangeAfterReset,
+	}
+}
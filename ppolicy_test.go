@@ -0,0 +1,115 @@
+package pooldap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_AuthenticateWithPolicy(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			require.NotNil(t, ldap.FindControl(req.Controls, ldap.ControlTypeBeheraPasswordPolicy))
+			return &ldap.SimpleBindResult{Controls: []ldap.Control{
+				&ldap.ControlBeheraPasswordPolicy{Expire: 3600, Grace: -1, Error: -1},
+			}}, nil
+		},
+	}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	valid, _, policy, err := lc.AuthenticateWithPolicy("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	require.NotNil(t, policy)
+	assert.Equal(t, int64(3600), policy.TimeBeforeExpiration)
+	assert.Equal(t, int64(-1), policy.GraceAuthNsRemaining)
+}
+
+func TestClient_AuthenticateWithPolicyLocked(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			return &ldap.SimpleBindResult{Controls: []ldap.Control{
+				&ldap.ControlBeheraPasswordPolicy{Expire: -1, Grace: -1, Error: 1, ErrorString: "Account locked"},
+			}}, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+		},
+	}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	valid, _, policy, err := lc.AuthenticateWithPolicy("fry", "fry")
+	assert.Error(t, err)
+	assert.False(t, valid)
+	require.NotNil(t, policy)
+	assert.Equal(t, int8(1), policy.Error)
+}
+
+func TestClient_AuthenticateMustChangePassword(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			return &ldap.SimpleBindResult{Controls: []ldap.Control{
+				&ldap.ControlBeheraPasswordPolicy{Expire: -1, Grace: -1, Error: 2, ErrorString: "Password must be changed"},
+			}}, nil
+		},
+	}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	valid, attrs, policy, err := lc.AuthenticateWithPolicy("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	require.NotNil(t, policy)
+	assert.True(t, policy.MustChangePassword)
+	assert.Equal(t, true, attrs[MustChangePasswordKey])
+}
+
+func TestClient_AuthenticateMustChangePasswordAD(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(fakeUser),
+		simpleBindFn: func(req *ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+			return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 773, v3839"))
+		},
+	}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	valid, attrs, err := lc.Authenticate("fry", "fry")
+	assert.Error(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, true, attrs[MustChangePasswordKey])
+}
+
+func TestClient_AuthenticatePwdLastSet(t *testing.T) {
+	user := &ldap.Entry{DN: fakeUser.DN, Attributes: append(append([]*ldap.EntryAttribute(nil), fakeUser.Attributes...),
+		&ldap.EntryAttribute{Name: "pwdLastSet", Values: []string{"0"}},
+	)}
+	config := fakeUserConfig()
+	config.Attributes = append(config.Attributes, "pwdLastSet")
+	lc := newFakeClient(t, config, &fakeConn{searchFn: entriesResult(user)})
+
+	valid, attrs, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, true, attrs[MustChangePasswordKey])
+
+	lc = newFakeClient(t, fakeUserConfig(), &fakeConn{searchFn: entriesResult(fakeUser)})
+	_, attrs, err = lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.NotContains(t, attrs, MustChangePasswordKey)
+
+	// renamed and parsed, or kept as every value
+	for _, configure := range []func(*LdapConfig){
+		func(c *LdapConfig) { c.AttributeMap = map[string]string{"pwdLastSet": "passwordLastSet:int"} },
+		func(c *LdapConfig) { c.MultiValuedAttributes = []string{"pwdLastSet"} },
+	} {
+		config := fakeUserConfig()
+		config.Attributes = append(config.Attributes, "pwdLastSet")
+		configure(&config)
+		lc = newFakeClient(t, config, &fakeConn{searchFn: entriesResult(user)})
+		_, attrs, err = lc.Authenticate("fry", "fry")
+		require.NoError(t, err)
+		assert.Equal(t, true, attrs[MustChangePasswordKey])
+	}
+}
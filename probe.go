@@ -0,0 +1,62 @@
+package pooldap
+
+import (
+	"context"
+	"sync"
+)
+
+// ProbeHosts dials Config.Host and every replica in Config.Hosts and binds
+// as the service account on each, concurrently. It returns the outcome per
+// host: nil if the host is usable, otherwise the dial or bind error, or the
+// context error for hosts that hadn't answered when ctx was done. The probe
+// connections are closed and never enter the pools.
+func (lc *Client) ProbeHosts(ctx context.Context) map[string]error {
+	hosts := lc.Config.hosts()
+
+	var (
+		mu      sync.Mutex
+		results = make(map[string]error, len(hosts))
+		wg      sync.WaitGroup
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() { done <- lc.probeHost(host) }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			mu.Lock()
+			results[host] = err
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return results
+}
+
+// probeHost dials host and binds as the service account, if one is set.
+func (lc *Client) probeHost(host string) error {
+	conn, err := lc.dialHost(host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dn, password := lc.bindCredentials()
+	if dn == "" {
+		return nil
+	}
+	if err := lc.checkSecureBind(password); err != nil {
+		return err
+	}
+	if err := conn.Bind(dn, password); err != nil {
+		return newBindError(err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package pooldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+// hostDialer fails dials to the hosts in down. Dials to those in hung block
+// until release is closed.
+type hostDialer struct {
+	down    map[string]bool
+	hung    map[string]bool
+	release chan struct{}
+}
+
+func (d hostDialer) Dial(network, addr string) (ldap.Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.hung[host] {
+		<-d.release
+	}
+	if d.down[host] {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+	}
+	return &fakeConn{}, nil
+}
+
+func (d hostDialer) DialTLS(network, addr string, config *tls.Config) (ldap.Client, error) {
+	return d.Dial(network, addr)
+}
+
+func TestClient_ProbeHosts(t *testing.T) {
+	config := dialerTestConfig()
+	config.Hosts = []string{"ldap.example.com", "ldap-02.example.com"}
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "secret"
+	lc := &Client{Config: config, Dialer: hostDialer{down: map[string]bool{"ldap-02.example.com": true}}}
+
+	results := lc.ProbeHosts(context.Background())
+	require.Len(t, results, 2)
+	assert.NoError(t, results["ldap.example.com"])
+	assert.True(t, ldap.IsErrorWithCode(results["ldap-02.example.com"], ldap.ErrorNetwork))
+}
+
+func TestClient_ProbeHostsContext(t *testing.T) {
+	config := dialerTestConfig()
+	config.Hosts = []string{"ldap-02.example.com"}
+	release := make(chan struct{})
+	defer close(release)
+	lc := &Client{Config: config, Dialer: hostDialer{hung: map[string]bool{"ldap-02.example.com": true}, release: release}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	results := lc.ProbeHosts(ctx)
+	assert.NoError(t, results["ldap.example.com"])
+	assert.Equal(t, context.DeadlineExceeded, results["ldap-02.example.com"])
+}
@@ -0,0 +1,72 @@
+package pooldap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// searcher is the subset of ldap.Client needed to issue searches.
+type searcher interface {
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+// rangedAttributeValues returns every value of attribute on entry. Active
+// Directory caps multi-valued attributes (1500 values by default) and returns
+// them as "member;range=0-1499" instead of "member"; in that case follow-up
+// searches are issued against entry.DN until the final "range=N-*" chunk.
+func rangedAttributeValues(conn searcher, entry *ldap.Entry, attribute string) ([]string, error) {
+	values, high, done := rangedChunk(entry, attribute)
+	if done {
+		return values, nil
+	}
+
+	for {
+		searchRequest := ldap.NewSearchRequest(
+			entry.DN,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{fmt.Sprintf("%s;range=%d-*", attribute, high+1)},
+			nil,
+		)
+		sr, err := conn.Search(searchRequest)
+		if err != nil {
+			return nil, err
+		}
+		if len(sr.Entries) < 1 {
+			return nil, ErrNotFound
+		}
+
+		var chunk []string
+		chunk, high, done = rangedChunk(sr.Entries[0], attribute)
+		values = append(values, chunk...)
+		if done {
+			return values, nil
+		}
+	}
+}
+
+// rangedChunk extracts the values of attribute from entry. If the values were
+// returned as a range, high is the last index returned and done is false until
+// the range ends with "*".
+func rangedChunk(entry *ldap.Entry, attribute string) (values []string, high int, done bool) {
+	prefix := strings.ToLower(attribute) + ";range="
+	for _, attr := range entry.Attributes {
+		name := strings.ToLower(attr.Name)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		bounds := strings.SplitN(name[len(prefix):], "-", 2)
+		if len(bounds) != 2 || bounds[1] == "*" {
+			return attr.Values, 0, true
+		}
+		high, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return attr.Values, 0, true
+		}
+		return attr.Values, high, false
+	}
+	return entry.GetAttributeValues(attribute), 0, true
+}
@@ -0,0 +1,50 @@
+package pooldap
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
+)
+
+func rangedEntry(dn, name string, low, high, total int) *ldap.Entry {
+	var values []string
+	for i := low; i <= high && i < total; i++ {
+		values = append(values, fmt.Sprintf("cn=user%d,dc=example,dc=com", i))
+	}
+	return &ldap.Entry{DN: dn, Attributes: []*ldap.EntryAttribute{{Name: name, Values: values}}}
+}
+
+func TestRangedAttributeValues(t *testing.T) {
+	const total = 3200
+	dn := "cn=big,dc=example,dc=com"
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		var low int
+		fmt.Sscanf(req.Attributes[0], "member;range=%d-*", &low)
+		high := low + 1499
+		name := fmt.Sprintf("member;range=%d-%d", low, high)
+		if high >= total-1 {
+			name = fmt.Sprintf("member;range=%d-*", low)
+		}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{rangedEntry(dn, name, low, high, total)}}, nil
+	}}
+
+	values, err := rangedAttributeValues(conn, rangedEntry(dn, "member;range=0-1499", 0, 1499, total), "member")
+	assert.NoError(t, err)
+	assert.Len(t, values, total)
+	assert.Equal(t, "cn=user3199,dc=example,dc=com", values[total-1])
+	assert.Len(t, conn.searches, 2)
+	assert.Equal(t, "member;range=1500-*", conn.searches[0].Attributes[0])
+	assert.Equal(t, "member;range=3000-*", conn.searches[1].Attributes[0])
+}
+
+func TestRangedAttributeValuesNotRanged(t *testing.T) {
+	conn := &fakeConn{}
+	entry := rangedEntry("cn=small,dc=example,dc=com", "member", 0, 2, 3)
+
+	values, err := rangedAttributeValues(conn, entry, "member")
+	assert.NoError(t, err)
+	assert.Len(t, values, 3)
+	assert.Empty(t, conn.searches)
+}
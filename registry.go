@@ -0,0 +1,137 @@
+package pooldap
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// PoolRegistry lets Clients that connect to the same directory as the same
+// service account share one search and one bind pool, e.g. the Clients of a
+// multi-tenant application that differ only in their bases and filters.
+// Pass it to each of them with WithPoolRegistry.
+//
+// Clients share pools when their poolKey matches: host, port, TLS settings,
+// bind credentials, client certificates and ReadOnly. Everything else in
+// their LdapConfig stays their own. The pools are sized, dial and apply
+// their connection limits and timeouts as set up by the first Client, even
+// after it is closed; later Clients' pool sizes and Dialer are ignored. A
+// shared pool is closed when the last Client using it is closed. The Clients
+// can't change their credentials, as that would change them for all of
+// them: Clone a Client WithBindCredentials to get pools for new ones.
+type PoolRegistry struct {
+	mu    sync.Mutex
+	pools map[poolKey]*sharedPools
+}
+
+// NewPoolRegistry returns an empty PoolRegistry.
+func NewPoolRegistry() *PoolRegistry {
+	return &PoolRegistry{pools: make(map[poolKey]*sharedPools)}
+}
+
+// poolKey holds the settings that decide whether two Clients can use the
+// same connections.
+type poolKey struct {
+	host               string
+	hosts              string
+	port               int
+	serverName         string
+	useSSL             bool
+	skipTLS            bool
+	insecureSkipVerify bool
+	bindDN             string
+	bindPassword       string
+	bindPoolAsService  bool
+	lazyBind           bool
+	readOnly           bool
+	// leaf certificates of ClientCertificates
+	certificates string
+}
+
+// sharedPools are the pools of one poolKey and the number of Clients using
+// them.
+type sharedPools struct {
+	searchPool Pool
+	bindPool   Pool
+	stopRefill context.CancelFunc
+	clients    int
+}
+
+// poolKey returns the key under which c's pools are registered.
+func (c *Client) poolKey() poolKey {
+	dn, password := c.bindCredentials()
+	var certificates strings.Builder
+	for _, cert := range c.ClientCertificates {
+		if len(cert.Certificate) > 0 {
+			certificates.Write(cert.Certificate[0])
+		}
+	}
+	return poolKey{
+		host:               c.Config.Host,
+		hosts:              strings.Join(c.Config.Hosts, ","),
+		port:               c.Config.Port,
+		serverName:         c.Config.ServerName,
+		useSSL:             c.Config.UseSSL,
+		skipTLS:            c.Config.SkipTLS,
+		insecureSkipVerify: c.Config.InsecureSkipVerify,
+		bindDN:             dn,
+		bindPassword:       password,
+		bindPoolAsService:  c.Config.BindPoolAsService,
+		lazyBind:           c.Config.LazyBind,
+		readOnly:           c.Config.ReadOnly,
+		certificates:       certificates.String(),
+	}
+}
+
+// acquire returns the pools registered for c's poolKey, opening them with a
+// copy of c as their parent client if there are none yet.
+func (r *PoolRegistry) acquire(c *Client) (*sharedPools, error) {
+	key := c.poolKey()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	shared, ok := r.pools[key]
+	if !ok {
+		searchPool, bindPool, stopRefill, err := c.poolOwner().openPools(c.poolSettings)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedPools{searchPool: searchPool, bindPool: bindPool, stopRefill: stopRefill}
+		r.pools[key] = shared
+	}
+	shared.clients++
+	return shared, nil
+}
+
+// poolOwner returns the parent client of shared pools opened for c: a copy
+// of the settings they dial and bind with, so that they don't depend on c
+// staying open.
+func (c *Client) poolOwner() *Client {
+	owner := &Client{
+		Config:             c.Config,
+		ClientCertificates: c.ClientCertificates,
+		Dialer:             c.Dialer,
+		logger:             c.GetLogger(),
+		asyncWarmup:        c.asyncWarmup,
+		warmupCtx:          c.warmupCtx,
+	}
+	owner.setBindCredentials(c.bindCredentials())
+	return owner
+}
+
+// release drops a Client's use of shared, closing the pools once no Client
+// uses them.
+func (r *PoolRegistry) release(shared *sharedPools) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if shared.clients--; shared.clients > 0 {
+		return
+	}
+	for key, pools := range r.pools {
+		if pools == shared {
+			delete(r.pools, key)
+		}
+	}
+	shared.stopRefill()
+	shared.searchPool.Close()
+	shared.bindPool.Close()
+}
@@ -0,0 +1,122 @@
+package pooldap
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolRegistry_SharesConnections(t *testing.T) {
+	var conns []*fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+		conns = append(conns, conn)
+		return conn
+	}}
+	registry := NewPoolRegistry()
+	config := fakeUserConfig()
+	config.Host, config.Port, config.SkipTLS = "ldap.example.com", 389, true
+	config.BindDN, config.BindPassword = "cn=service,dc=example,dc=com", "secret"
+
+	tenantA, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer), WithPoolRegistry(registry), WithBase("ou=a,dc=example,dc=com"))
+	require.NoError(t, err)
+	tenantB, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer), WithPoolRegistry(registry), WithBase("ou=b,dc=example,dc=com"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, dialer.dialCount())
+	assert.Same(t, tenantA.searchPool, tenantB.searchPool)
+	assert.Same(t, tenantA.bindPool, tenantB.bindPool)
+	tenantA.searchPool.(*channelPool).AliveChecks(false)
+
+	// each client keeps its own base on the shared connection
+	_, err = tenantA.GetUser("fry")
+	require.NoError(t, err)
+	_, err = tenantB.GetUser("fry")
+	require.NoError(t, err)
+	var bases []string
+	for _, conn := range conns {
+		for _, req := range conn.searches {
+			bases = append(bases, req.BaseDN)
+		}
+	}
+	assert.Equal(t, []string{"ou=a,dc=example,dc=com", "ou=b,dc=example,dc=com"}, bases)
+
+	// a clone with another base shares them too, other credentials don't
+	tenantC, err := tenantA.Clone(WithBase("ou=c,dc=example,dc=com"))
+	require.NoError(t, err)
+	assert.Same(t, tenantA.searchPool, tenantC.searchPool)
+	other, err := NewClient(config, 1, 1, 1, 1, time.Hour, WithDialer(dialer), WithPoolRegistry(registry), WithBindCredentials("cn=other,dc=example,dc=com", "secret"))
+	require.NoError(t, err)
+	assert.NotSame(t, tenantA.searchPool, other.searchPool)
+	assert.Equal(t, 4, dialer.dialCount())
+	other.Close()
+
+	// the pools close with the last client using them
+	tenantA.Close()
+	tenantA.Close()
+	tenantB.Close()
+	for _, conn := range conns[:2] {
+		assert.False(t, conn.isClosed())
+	}
+	tenantC.Close()
+	for _, conn := range conns {
+		assert.True(t, conn.isClosed())
+	}
+	_, err = tenantC.searchPool.Get()
+	assert.Equal(t, ErrClosed, err)
+	assert.Empty(t, registry.pools)
+}
+
+func TestPoolRegistry_RefusesCredentialChanges(t *testing.T) {
+	var mu sync.Mutex
+	passwords := map[*fakeConn][]string{}
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{}
+		conn.bindFn = func(username, password string) error {
+			mu.Lock()
+			passwords[conn] = append(passwords[conn], password)
+			mu.Unlock()
+			return nil
+		}
+		return conn
+	}}
+	registry := NewPoolRegistry()
+	config := fakeUserConfig()
+	config.Host, config.Port, config.SkipTLS = "ldap.example.com", 389, true
+	config.BindDN, config.BindPassword = "cn=service,dc=example,dc=com", "secret"
+
+	tenantA, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer), WithPoolRegistry(registry))
+	require.NoError(t, err)
+	tenantB, err := NewClient(config, 1, 1, 0, 1, time.Hour, WithDialer(dialer), WithPoolRegistry(registry))
+	require.NoError(t, err)
+	defer tenantB.Close()
+
+	assert.True(t, errors.Is(tenantB.SetBindCredentials(config.BindDN, "rotated"), ErrSharedPools))
+	assert.True(t, errors.Is(tenantB.RotateCredentials(config.BindDN, "rotated"), ErrSharedPools))
+	dn, password := tenantB.bindCredentials()
+	assert.Equal(t, config.BindDN, dn)
+	assert.Equal(t, "secret", password)
+	assert.Equal(t, 1, dialer.dialCount())
+
+	// the shared pools keep working, with their own settings, once the
+	// client that opened them is closed
+	tenantA.Close()
+	tenantB.searchPool.(*channelPool).AliveChecks(false)
+	conn, err := tenantB.searchPool.(*channelPool).NewConn()
+	require.NoError(t, err)
+	conn.Close()
+	mu.Lock()
+	for _, bound := range passwords {
+		assert.Equal(t, []string{"secret"}, bound)
+	}
+	mu.Unlock()
+
+	// a clone gets pools of its own for the new credentials
+	rotated, err := tenantB.Clone(WithBindCredentials(config.BindDN, "rotated"))
+	require.NoError(t, err)
+	defer rotated.Close()
+	assert.NotSame(t, tenantB.searchPool, rotated.searchPool)
+}
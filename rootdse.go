@@ -0,0 +1,130 @@
+package pooldap
+
+import (
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// rootDSE holds what the directory advertises about itself in its root DSE.
+type rootDSE struct {
+	controls   []string
+	extensions []string
+	serverType ServerType
+}
+
+// rootDSEAttributes are the root DSE attributes readRootDSE reads.
+var rootDSEAttributes = []string{
+	"supportedControl", "supportedExtension", "supportedCapabilities",
+	"vendorName", "isGlobalCatalogReady", "objectClass",
+}
+
+// ServerType identifies the directory server implementation.
+type ServerType string
+
+const (
+	// ServerTypeUnknown is a server that couldn't be told apart.
+	ServerTypeUnknown         ServerType = ""
+	ServerTypeActiveDirectory ServerType = "ad"
+	ServerTypeOpenLDAP        ServerType = "openldap"
+	// ServerType389DS is 389 Directory Server, including Red Hat Directory
+	// Server.
+	ServerType389DS ServerType = "389ds"
+)
+
+// ldapCapActiveDirectory is the supportedCapabilities OID of Active
+// Directory domain controllers.
+const ldapCapActiveDirectory = "1.2.840.113556.1.4.800"
+
+// ServerType returns Config.ServerType if set, otherwise the type detected
+// from the root DSE: Active Directory by its supportedCapabilities or
+// isGlobalCatalogReady, OpenLDAP by its OpenLDAProotDSE object class and 389
+// Directory Server by its vendorName. ServerTypeUnknown is returned without
+// an error for other servers. The root DSE is read on first use and cached
+// like SupportedControls.
+func (lc *Client) ServerType() (ServerType, error) {
+	if lc.Config.ServerType != "" {
+		return ServerType(strings.ToLower(lc.Config.ServerType)), nil
+	}
+	dse, err := lc.readRootDSE()
+	if err != nil {
+		return ServerTypeUnknown, err
+	}
+	return dse.serverType, nil
+}
+
+// detectServerType tells the server type from a root DSE entry.
+func detectServerType(entry *ldap.Entry) ServerType {
+	vendor := strings.ToLower(entry.GetAttributeValue("vendorName"))
+	switch {
+	case containsString(attributeValues(entry, "supportedCapabilities"), ldapCapActiveDirectory),
+		entry.GetAttributeValue("isGlobalCatalogReady") != "":
+		return ServerTypeActiveDirectory
+	case containsFold(attributeValues(entry, "objectClass"), "OpenLDAProotDSE"),
+		strings.Contains(vendor, "openldap"):
+		return ServerTypeOpenLDAP
+	case strings.Contains(vendor, "389 project"), strings.Contains(vendor, "red hat"),
+		strings.Contains(vendor, "fedora project"):
+		return ServerType389DS
+	}
+	return ServerTypeUnknown
+}
+
+// SupportedControls returns the OIDs of the controls the directory lists in
+// its root DSE under supportedControl, e.g. ldap.ControlTypePaging. The root
+// DSE is read once and cached for the life of the Client; failures are not
+// cached.
+func (lc *Client) SupportedControls() ([]string, error) {
+	dse, err := lc.readRootDSE()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), dse.controls...), nil
+}
+
+// SupportedExtensions returns the OIDs of the extended operations the
+// directory lists under supportedExtension, e.g. StartTLS
+// (1.3.6.1.4.1.1466.20037). It is cached like SupportedControls.
+func (lc *Client) SupportedExtensions() ([]string, error) {
+	dse, err := lc.readRootDSE()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), dse.extensions...), nil
+}
+
+func (lc *Client) readRootDSE() (*rootDSE, error) {
+	lc.rootDSEMu.Lock()
+	defer lc.rootDSEMu.Unlock()
+	if lc.rootDSE != nil {
+		return lc.rootDSE, nil
+	}
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		rootDSEAttributes,
+		nil,
+	)
+	sr, err := lc.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) < 1 {
+		return nil, ErrNotFound
+	}
+	lc.rootDSE = &rootDSE{
+		controls:   attributeValues(sr.Entries[0], "supportedControl"),
+		extensions: attributeValues(sr.Entries[0], "supportedExtension"),
+		serverType: detectServerType(sr.Entries[0]),
+	}
+	return lc.rootDSE, nil
+}
+
+// lacksControl reports whether the cached root DSE was read and doesn't list
+// controlType. Without a cached root DSE nothing is known to be missing.
+func (lc *Client) lacksControl(controlType string) bool {
+	lc.rootDSEMu.Lock()
+	defer lc.rootDSEMu.Unlock()
+	return lc.rootDSE != nil && !containsString(lc.rootDSE.controls, controlType)
+}
@@ -0,0 +1,106 @@
+package pooldap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+// rootDSESearch answers root DSE reads with controls and extensions and every
+// other search with a size limit error.
+func rootDSESearch(controls, extensions []string) func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		if req.BaseDN == "" && req.Scope == ldap.ScopeBaseObject {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{{
+				Attributes: []*ldap.EntryAttribute{
+					{Name: "supportedControl", Values: controls},
+					{Name: "supportedExtension", Values: extensions},
+				},
+			}}}, nil
+		}
+		return &ldap.SearchResult{}, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+}
+
+func TestClient_SupportedControls(t *testing.T) {
+	controls := []string{ldap.ControlTypePaging, ControlTypeServerSideSort, ControlTypeDirSync}
+	extensions := []string{"1.3.6.1.4.1.1466.20037", "1.3.6.1.4.1.4203.1.11.1"}
+	conn := &fakeConn{searchFn: rootDSESearch(controls, extensions)}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	supported, err := lc.SupportedControls()
+	require.NoError(t, err)
+	assert.Equal(t, controls, supported)
+	require.Len(t, conn.searches, 1)
+	assert.Equal(t, rootDSEAttributes, conn.searches[0].Attributes)
+
+	supported, err = lc.SupportedExtensions()
+	require.NoError(t, err)
+	assert.Equal(t, extensions, supported)
+	// read once, then cached
+	assert.Len(t, conn.searches, 1)
+}
+
+func TestClient_SearchAutoWithoutPaging(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: rootDSESearch([]string{ControlTypeServerSideSort}, nil),
+		pagingFn: func(*ldap.SearchRequest, uint32) (*ldap.SearchResult, error) {
+			t.Fatal("SearchAuto paged a search on a server without paging")
+			return nil, nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+	_, err := lc.SupportedControls()
+	require.NoError(t, err)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=*)", nil, nil)
+	_, err = lc.SearchAuto(req)
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded))
+}
+
+func TestClient_ServerType(t *testing.T) {
+	for expected, attributes := range map[ServerType][]*ldap.EntryAttribute{
+		ServerTypeActiveDirectory: {
+			{Name: "supportedCapabilities", Values: []string{"1.2.840.113556.1.4.800", "1.2.840.113556.1.4.1670"}},
+			{Name: "isGlobalCatalogReady", Values: []string{"TRUE"}},
+		},
+		ServerTypeOpenLDAP: {
+			{Name: "objectClass", Values: []string{"top", "OpenLDAProotDSE"}},
+			{Name: "supportedControl", Values: []string{ldap.ControlTypePaging}},
+		},
+		ServerType389DS: {
+			{Name: "vendorName", Values: []string{"389 Project"}},
+			{Name: "objectClass", Values: []string{"top"}},
+		},
+		ServerTypeUnknown: {
+			{Name: "vendorName", Values: []string{"ForgeRock AS."}},
+		},
+	} {
+		entry := &ldap.Entry{Attributes: attributes}
+		conn := &fakeConn{searchFn: entriesResult(entry)}
+		lc := newFakeClient(t, LdapConfig{}, conn)
+
+		serverType, err := lc.ServerType()
+		require.NoError(t, err)
+		assert.Equal(t, expected, serverType)
+		_, err = lc.ServerType()
+		require.NoError(t, err)
+		assert.Len(t, conn.searches, 1, expected)
+	}
+}
+
+func TestClient_ServerTypeConfigured(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{ServerType: "AD"}, conn)
+
+	serverType, err := lc.ServerType()
+	require.NoError(t, err)
+	assert.Equal(t, ServerTypeActiveDirectory, serverType)
+	assert.Empty(t, conn.searches)
+
+	config := LdapConfig{Host: "localhost", Port: 389, Base: "dc=example,dc=com", UserFilter: "(uid=%s)", ServerType: "novell"}
+	assert.EqualError(t, config.Validate(), `server_type "novell" is not one of ad, openldap or 389ds`)
+}
@@ -0,0 +1,244 @@
+package pooldap
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// SASL mechanisms understood by AuthenticateSASL.
+const (
+	SASLMechanismDigestMD5 = "DIGEST-MD5"
+	SASLMechanismGSSAPI    = "GSSAPI"
+)
+
+// ErrSASLUnsupported is returned by AuthenticateSASL when the bind pool
+// connection can't perform SASL binds, or not with the mechanism asked for.
+var ErrSASLUnsupported = errors.New("connection does not support SASL binds")
+
+// SASLBinder is implemented by connections that can perform a SASL bind.
+// Those of the built-in dialers do DIGEST-MD5. For other mechanisms, e.g.
+// GSSAPI, where password is unused and the credentials come from the
+// binder's own Kerberos setup, AuthenticateSASL needs a Dialer (or adopted
+// connections) returning an ldap.Client that implements SASLBinder.
+type SASLBinder interface {
+	SASLBind(mechanism, username, password string) error
+}
+
+// AuthenticateSASL is Authenticate with a SASL bind using mechanism, e.g.
+// SASLMechanismDigestMD5, instead of a simple bind. The SASL authentication
+// identity is username rather than the user's DN.
+func (lc *Client) AuthenticateSASL(username, password, mechanism string) (valid bool, userAttributes map[string]interface{}, err error) {
+	defer func() { lc.auditBind(username, mechanism, userAttributes, err) }()
+	userAttributes, err = lc.GetUser(username)
+	if err != nil {
+		return
+	}
+
+	timer := lc.startOp("bind", BindPool)
+	bindConn, err := lc.bindPool.Get()
+	timer.connAcquired()
+	if err != nil {
+		timer.getFailed(err)
+		return
+	}
+	defer bindConn.Close()
+
+	binder, ok := bindConn.Conn.(SASLBinder)
+	if !ok {
+		err = ErrSASLUnsupported
+		timer.done(err)
+		return
+	}
+	bindConn.uses++
+	err = binder.SASLBind(mechanism, username, password)
+	timer.done(err)
+	if lc.Config.BindPoolAsService {
+		// Return the connection to the pool as the service account
+		if rebindErr := bindConn.Bind(lc.bindCredentials()); rebindErr != nil {
+			lc.GetLogger().Errorf("could not rebind as service account: %s", rebindErr)
+			bindConn.MarkUnusable()
+		}
+	}
+	if err != nil {
+		bindConn.AutoClose(err)
+		return false, userAttributes, newBindError(err)
+	}
+
+	valid = true
+	return
+}
+
+// SASLBind performs a DIGEST-MD5 bind (RFC 2831) as username, the SASL
+// authentication identity, verifying the server's rspauth if it sends one.
+// Other mechanisms fail with ErrSASLUnsupported.
+func (c *stateConn) SASLBind(mechanism, username, password string) error {
+	if !strings.EqualFold(mechanism, SASLMechanismDigestMD5) {
+		return errors.Wrap(ErrSASLUnsupported, mechanism)
+	}
+	challenge, inProgress, err := c.saslBindStep(SASLMechanismDigestMD5, nil)
+	if err != nil {
+		return err
+	}
+	if !inProgress {
+		return ldap.NewError(ldap.LDAPResultProtocolError, errors.New("ldap: DIGEST-MD5 bind ended without a challenge"))
+	}
+	directives, err := parseDigestDirectives(string(challenge))
+	if err != nil {
+		return ldap.NewError(ldap.LDAPResultProtocolError, err)
+	}
+	cnonce, err := newCnonce()
+	if err != nil {
+		return err
+	}
+	response, rspauth, err := digestMD5Response(directives, username, password, "ldap/"+c.host, cnonce)
+	if err != nil {
+		return ldap.NewError(ldap.LDAPResultProtocolError, err)
+	}
+	final, inProgress, err := c.saslBindStep(SASLMechanismDigestMD5, []byte(response))
+	if err != nil {
+		return err
+	}
+	if len(final) > 0 {
+		directives, err := parseDigestDirectives(string(final))
+		if err != nil {
+			return ldap.NewError(ldap.LDAPResultProtocolError, err)
+		}
+		if directives["rspauth"] != rspauth {
+			return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("ldap: server failed DIGEST-MD5 mutual authentication"))
+		}
+	}
+	if inProgress {
+		_, _, err = c.saslBindStep(SASLMechanismDigestMD5, []byte{})
+	}
+	return err
+}
+
+// saslBindStep sends a SASL bind request with credentials, if not nil, and
+// returns the server's SASL credentials and whether it expects another step.
+func (c *stateConn) saslBindStep(mechanism string, credentials []byte) (serverCredentials []byte, inProgress bool, err error) {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "User Name"))
+	auth := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SASL Credentials")
+	auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, mechanism, "Mechanism"))
+	if credentials != nil {
+		auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(credentials), "Credentials"))
+	}
+	request.AppendChild(auth)
+
+	response, err := c.mux.request(request, nil, c.requestTimeout())
+	if err != nil {
+		return nil, false, err
+	}
+	for _, child := range response.Children {
+		if child.ClassType == ber.ClassContext && child.Tag == 7 {
+			serverCredentials = child.Data.Bytes()
+		}
+	}
+	err = resultError(response)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSaslBindInProgress) {
+		return serverCredentials, true, nil
+	}
+	return serverCredentials, false, err
+}
+
+// newCnonce returns a random DIGEST-MD5 client nonce.
+func newCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// digestMD5Response returns the DIGEST-MD5 response to the server's
+// challenge directives for digestURI, e.g. "ldap/dc1.example.com", and the
+// rspauth the server should answer with.
+func digestMD5Response(challenge map[string]string, username, password, digestURI, cnonce string) (response, rspauth string, err error) {
+	nonce := challenge["nonce"]
+	if nonce == "" {
+		return "", "", errors.New("DIGEST-MD5 challenge without a nonce")
+	}
+	if qop, ok := challenge["qop"]; ok && !containsFold(strings.Split(qop, ","), "auth") {
+		return "", "", errors.Errorf("DIGEST-MD5 challenge without qop auth: %q", qop)
+	}
+	realm := challenge["realm"]
+	const nc, qop = "00000001", "auth"
+
+	secret := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	a1 := string(secret[:]) + ":" + nonce + ":" + cnonce
+	digest := func(a2 string) string {
+		return md5Hex(md5Hex(a1) + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + md5Hex(a2))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "username=%s", quoteDigest(username))
+	if realm != "" {
+		fmt.Fprintf(&b, ",realm=%s", quoteDigest(realm))
+	}
+	fmt.Fprintf(&b, ",nonce=%s,cnonce=%s,nc=%s,qop=%s,digest-uri=%s,response=%s",
+		quoteDigest(nonce), quoteDigest(cnonce), nc, qop, quoteDigest(digestURI), digest("AUTHENTICATE:"+digestURI))
+	if strings.EqualFold(challenge["charset"], "utf-8") {
+		b.WriteString(",charset=utf-8")
+	}
+	return b.String(), digest(":" + digestURI), nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// quoteDigest quotes a DIGEST-MD5 directive value.
+func quoteDigest(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// parseDigestDirectives parses the comma separated key=value directives of
+// a DIGEST-MD5 challenge, whose values may be quoted. Of repeated keys, e.g.
+// realm, the first is kept.
+func parseDigestDirectives(s string) (map[string]string, error) {
+	directives := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, errors.Errorf("malformed DIGEST-MD5 directive %q", s)
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.Errorf("unterminated DIGEST-MD5 directive %q", key)
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		if _, seen := directives[key]; !seen {
+			directives[key] = value.String()
+		}
+		s = strings.TrimPrefix(strings.TrimSpace(s), ",")
+		s = strings.TrimSpace(s)
+	}
+	return directives, nil
+}
@@ -0,0 +1,163 @@
+package pooldap
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// fakeSASLConn checks DIGEST-MD5 binds against a single known password.
+type fakeSASLConn struct {
+	fakeConn
+	password   string
+	mechanisms []string
+}
+
+func (f *fakeSASLConn) SASLBind(mechanism, username, password string) error {
+	f.mechanisms = append(f.mechanisms, mechanism)
+	if mechanism != SASLMechanismDigestMD5 {
+		return ldap.NewError(ldap.LDAPResultAuthMethodNotSupported, errors.New("unsupported mechanism"))
+	}
+	if password != f.password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func newFakeSASLClient(t *testing.T, conn ldap.Client) *Client {
+	lc := newFakeClient(t, fakeUserConfig(), &fakeConn{searchFn: entriesResult(fakeUser)})
+	lc.bindPool.Close()
+	bindPool, err := NewChannelPool(0, 1, BindPool, fakeFactory, lc, nil, 0)
+	require.NoError(t, err)
+	bindPool.(*channelPool).AliveChecks(false)
+	require.NoError(t, bindPool.Adopt(conn))
+	lc.bindPool = bindPool
+	return lc
+}
+
+func TestClient_AuthenticateSASL(t *testing.T) {
+	conn := &fakeSASLConn{password: "fry"}
+	lc := newFakeSASLClient(t, conn)
+
+	valid, user, err := lc.AuthenticateSASL("fry", "fry", SASLMechanismDigestMD5)
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, fakeUser.DN, user["dn"])
+
+	valid, _, err = lc.AuthenticateSASL("fry", "leela", SASLMechanismDigestMD5)
+	assert.False(t, valid)
+	var bindErr *BindError
+	require.True(t, errors.As(err, &bindErr))
+	assert.Equal(t, uint16(ldap.LDAPResultInvalidCredentials), bindErr.Code)
+	assert.Equal(t, []string{SASLMechanismDigestMD5, SASLMechanismDigestMD5}, conn.mechanisms)
+}
+
+func TestClient_AuthenticateSASLUnsupported(t *testing.T) {
+	lc := newFakeClient(t, fakeUserConfig(), &fakeConn{searchFn: entriesResult(fakeUser)})
+
+	valid, _, err := lc.AuthenticateSASL("fry", "fry", SASLMechanismDigestMD5)
+	assert.False(t, valid)
+	assert.Equal(t, ErrSASLUnsupported, err)
+}
+
+func TestDigestMD5Response(t *testing.T) {
+	// the example of RFC 2831, section 4
+	challenge, err := parseDigestDirectives(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth",algorithm=md5-sess,charset=utf-8`)
+	require.NoError(t, err)
+	assert.Equal(t, "elwood.innosoft.com", challenge["realm"])
+	assert.Equal(t, "md5-sess", challenge["algorithm"])
+
+	response, rspauth, err := digestMD5Response(challenge, "chris", "secret", "imap/elwood.innosoft.com", "OA6MHXh6VqTrRk")
+	require.NoError(t, err)
+	assert.Equal(t, `username="chris",realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",cnonce="OA6MHXh6VqTrRk",nc=00000001,qop=auth,digest-uri="imap/elwood.innosoft.com",response=d388dad90d4bbd760a152321f2143af7,charset=utf-8`, response)
+	assert.Equal(t, "ea40f60335c427b5527b84dbabcdfffd", rspauth)
+
+	parsed, err := parseDigestDirectives(`username="a\"b",nc=00000001`)
+	require.NoError(t, err)
+	assert.Equal(t, `a"b`, parsed["username"])
+	_, err = parseDigestDirectives(`nonce="open`)
+	assert.Error(t, err)
+	_, _, err = digestMD5Response(map[string]string{"nonce": "n", "qop": "auth-conf"}, "chris", "secret", "ldap/x", "c")
+	assert.Error(t, err)
+}
+
+// digestServer does DIGEST-MD5 binds for a single known password, the way
+// RFC 2831 has the server check them.
+type digestServer struct {
+	password string
+
+	mu   sync.Mutex
+	uris []string
+}
+
+func (d *digestServer) handle(s *ldapServer, request *ber.Packet) {
+	op := protocolOp(request)
+	if op.Tag != ldap.ApplicationBindRequest {
+		answerSearch(s, request)
+		return
+	}
+	auth := op.Children[2]
+	if auth.Tag != 3 {
+		// a simple bind, e.g. as the service account
+		s.reply(messageID(request), ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, ""))
+		return
+	}
+	reply := func(code int, credentials string) {
+		response := ldapResult(ldap.ApplicationBindResponse, code, "")
+		if credentials != "" {
+			response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, credentials, "serverSaslCreds"))
+		}
+		s.reply(messageID(request), response)
+	}
+	challenge := map[string]string{"realm": "example.com", "nonce": "OA6MG9tEQGm2hh", "qop": "auth", "charset": "utf-8"}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case len(auth.Children) == 1:
+		reply(ldap.LDAPResultSaslBindInProgress, `realm="example.com",nonce="OA6MG9tEQGm2hh",qop="auth",charset=utf-8,algorithm=md5-sess`)
+	case auth.Children[1].Value.(string) == "":
+		reply(ldap.LDAPResultSuccess, "")
+	default:
+		directives, err := parseDigestDirectives(auth.Children[1].Value.(string))
+		if err != nil {
+			reply(ldap.LDAPResultProtocolError, "")
+			return
+		}
+		d.uris = append(d.uris, directives["digest-uri"])
+		expected, rspauth, _ := digestMD5Response(challenge, directives["username"], d.password, directives["digest-uri"], directives["cnonce"])
+		if expected != auth.Children[1].Value.(string) {
+			reply(ldap.LDAPResultInvalidCredentials, "")
+			return
+		}
+		reply(ldap.LDAPResultSaslBindInProgress, "rspauth="+rspauth)
+	}
+}
+
+func TestClient_AuthenticateSASLDigestMD5(t *testing.T) {
+	server := &digestServer{password: "fry"}
+	conn, _ := serveLDAP(t, server.handle)
+	lc := newFakeSASLClient(t, conn)
+
+	valid, user, err := lc.AuthenticateSASL("fry", "fry", SASLMechanismDigestMD5)
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, fakeUser.DN, user["dn"])
+
+	valid, _, err = lc.AuthenticateSASL("fry", "leela", SASLMechanismDigestMD5)
+	assert.False(t, valid)
+	var bindErr *BindError
+	require.True(t, errors.As(err, &bindErr))
+	assert.Equal(t, uint16(ldap.LDAPResultInvalidCredentials), bindErr.Code)
+
+	_, _, err = lc.AuthenticateSASL("fry", "fry", SASLMechanismGSSAPI)
+	assert.True(t, errors.Is(err, ErrSASLUnsupported))
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, []string{"ldap/ldap.example.com", "ldap/ldap.example.com"}, server.uris)
+}
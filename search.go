@@ -0,0 +1,156 @@
+package pooldap
+
+import (
+	"context"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Search runs searchRequest on a search pool connection. Any controls are
+// sent in addition to those already on the request; the request itself is
+// not modified. Config.SizeLimit and Config.TimeLimit apply unless the
+// request sets its own limits. Response controls are returned on the result.
+// A referral from the server is returned as a *ReferralError.
+func (lc *Client) Search(searchRequest *ldap.SearchRequest, controls ...ldap.Control) (sr *ldap.SearchResult, err error) {
+	return lc.search(context.Background(), searchRequest, controls)
+}
+
+// SearchContext is Search that stops waiting for a pooled connection when
+// ctx is done. ctx is passed on to the operation hook, e.g. for tracing. A
+// search still running when ctx is done is cancelled on the server with the
+// Cancel extended operation, on connections implementing ContextSearcher,
+// as those of the built-in dialers do.
+func (lc *Client) SearchContext(ctx context.Context, searchRequest *ldap.SearchRequest, controls ...ldap.Control) (*ldap.SearchResult, error) {
+	return lc.search(ctx, searchRequest, controls)
+}
+
+func (lc *Client) search(ctx context.Context, searchRequest *ldap.SearchRequest, controls []ldap.Control) (sr *ldap.SearchResult, err error) {
+	req := *searchRequest
+	lc.applyLimits(&req)
+	if len(controls) > 0 {
+		req.Controls = append(append([]ldap.Control(nil), searchRequest.Controls...), controls...)
+	}
+
+	timer := lc.startSearch(ctx, req.BaseDN)
+	conn, err := lc.searchPool.GetContext(ctx)
+	timer.connAcquired()
+	if err != nil {
+		timer.getFailed(err)
+		return
+	}
+	defer conn.Close()
+
+	sr, err = conn.SearchContext(ctx, &req)
+	timer.done(err)
+	if err != nil {
+		conn.AutoClose(err)
+		err = newReferralError(err, sr)
+		return
+	}
+	err = checkSort(req.Controls, sr)
+	return
+}
+
+// autoPageSize is the page size SearchAuto uses once the server has refused
+// to return the full result in one go.
+const autoPageSize = 500
+
+// SearchAuto runs searchRequest as a plain search and, if the server answers
+// with LDAPResultSizeLimitExceeded, runs it again with the paged results
+// control to gather the full set. Callers don't need to know the server's
+// size limit up front. Controls are sent as with Search. Once
+// SupportedControls has been read, servers that don't list the paged results
+// control get the size limit error instead of a paged search they'd reject.
+func (lc *Client) SearchAuto(searchRequest *ldap.SearchRequest, controls ...ldap.Control) (sr *ldap.SearchResult, err error) {
+	sr, err = lc.Search(searchRequest, controls...)
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || lc.lacksControl(ldap.ControlTypePaging) {
+		return
+	}
+	lc.GetLogger().Debugf("size limit exceeded for %s, retrying with paging", searchRequest.Filter)
+
+	req := *searchRequest
+	req.Controls = append(append([]ldap.Control(nil), searchRequest.Controls...), controls...)
+	lc.applyLimits(&req)
+
+	timer := lc.startSearch(context.Background(), req.BaseDN)
+	conn, err := lc.searchPool.Get()
+	timer.connAcquired()
+	if err != nil {
+		timer.getFailed(err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	sr, err = conn.SearchWithPaging(&req, autoPageSize)
+	timer.done(err)
+	if err != nil {
+		conn.AutoClose(err)
+		err = newReferralError(err, sr)
+		return
+	}
+	err = checkSort(req.Controls, sr)
+	return
+}
+
+// SearchBase returns the entries under base matching filter with attributes
+// attrs, where scope is one of the ldap.Scope constants. The configured
+// limits apply and paging kicks in as with SearchAuto.
+func (lc *Client) SearchBase(base string, scope int, filter string, attrs []string) ([]*ldap.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		base,
+		scope, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attrs,
+		nil,
+	)
+	sr, err := lc.SearchAuto(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Entries, nil
+}
+
+// noAttributes is the OID asking the server to return entries without any
+// attributes (RFC 4511 section 4.5.1.8).
+const noAttributes = "1.1"
+
+// Count returns how many entries under base match filter. It always pages,
+// so the count is accurate past the server's size limit, and asks for no
+// attributes so only the DNs come back. Config.SizeLimit doesn't apply.
+func (lc *Client) Count(base, filter string) (int, error) {
+	searchRequest := ldap.NewSearchRequest(
+		base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, lc.Config.timeLimit(), false,
+		filter,
+		[]string{noAttributes},
+		nil,
+	)
+
+	timer := lc.startSearch(context.Background(), base)
+	conn, err := lc.searchPool.Get()
+	timer.connAcquired()
+	if err != nil {
+		timer.getFailed(err)
+		return 0, err
+	}
+	defer conn.Close()
+
+	sr, err := conn.SearchWithPaging(searchRequest, autoPageSize)
+	timer.done(err)
+	if err != nil {
+		conn.AutoClose(err)
+		return 0, err
+	}
+	return len(sr.Entries), nil
+}
+
+// applyLimits sets the configured size and time limits on req where it
+// doesn't set its own.
+func (lc *Client) applyLimits(req *ldap.SearchRequest) {
+	if req.SizeLimit == 0 {
+		req.SizeLimit = lc.Config.SizeLimit
+	}
+	if req.TimeLimit == 0 {
+		req.TimeLimit = lc.Config.timeLimit()
+	}
+}
@@ -0,0 +1,376 @@
+package pooldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const controlTypeSortRequest = "1.2.840.113556.1.4.473"
+
+func TestClient_SearchControls(t *testing.T) {
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		sr := &ldap.SearchResult{}
+		for _, sn := range []string{"Zoidberg", "Fry", "Leela"} {
+			sr.Entries = append(sr.Entries, &ldap.Entry{Attributes: []*ldap.EntryAttribute{{Name: "sn", Values: []string{sn}}}})
+		}
+		if ldap.FindControl(req.Controls, controlTypeSortRequest) != nil {
+			sort.Slice(sr.Entries, func(i, j int) bool {
+				return sr.Entries[i].Attributes[0].Values[0] < sr.Entries[j].Attributes[0].Values[0]
+			})
+			sr.Controls = append(sr.Controls, ldap.NewControlString("1.2.840.113556.1.4.474", false, ""))
+		}
+		return sr, nil
+	}}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(sn=*)", []string{"sn"}, nil)
+	sr, err := lc.Search(req, ldap.NewControlString(controlTypeSortRequest, true, ""))
+	require.NoError(t, err)
+	assert.Empty(t, req.Controls)
+
+	var names []string
+	for _, entry := range sr.Entries {
+		names = append(names, entry.Attributes[0].Values[0])
+	}
+	assert.Equal(t, []string{"Fry", "Leela", "Zoidberg"}, names)
+	assert.Len(t, sr.Controls, 1)
+}
+
+func TestClient_SearchProxiedAuthorization(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+	_, err := lc.Search(req, NewControlProxiedAuthorization("dn:uid=fry,ou=people,dc=example,dc=com"))
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 1)
+
+	control, ok := ldap.FindControl(conn.searches[0].Controls, ControlTypeProxiedAuthorization).(*ldap.ControlString)
+	require.True(t, ok)
+	assert.True(t, control.Criticality)
+	assert.Equal(t, "dn:uid=fry,ou=people,dc=example,dc=com", control.ControlValue)
+}
+
+func TestClient_SearchAuto(t *testing.T) {
+	entries := make([]*ldap.Entry, 0, 3)
+	for _, uid := range []string{"fry", "leela", "bender"} {
+		entries = append(entries, &ldap.Entry{DN: "uid=" + uid + ",ou=people,dc=example,dc=com"})
+	}
+	conn := &fakeConn{
+		searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+			return &ldap.SearchResult{Entries: entries[:1]}, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+		},
+		pagingFn: func(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+			assert.Equal(t, uint32(autoPageSize), pagingSize)
+			return &ldap.SearchResult{Entries: entries}, nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=*)", nil, nil)
+	sr, err := lc.SearchAuto(req)
+	require.NoError(t, err)
+	assert.Len(t, sr.Entries, 3)
+	assert.Len(t, conn.searches, 2)
+}
+
+func TestClient_SearchAutoUnpaged(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: entriesResult(&ldap.Entry{DN: "uid=fry,ou=people,dc=example,dc=com"}),
+		pagingFn: func(*ldap.SearchRequest, uint32) (*ldap.SearchResult, error) {
+			t.Fatal("SearchAuto paged a search that fit the size limit")
+			return nil, nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+	sr, err := lc.SearchAuto(req)
+	require.NoError(t, err)
+	assert.Len(t, sr.Entries, 1)
+}
+
+func TestClient_SearchDontUseCopy(t *testing.T) {
+	conn := &fakeConn{}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+	_, err := lc.Search(req, NewControlDontUseCopy(), ldap.NewControlManageDsaIT(true))
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 1)
+	assert.NotNil(t, ldap.FindControl(conn.searches[0].Controls, ControlTypeDontUseCopy))
+	assert.NotNil(t, ldap.FindControl(conn.searches[0].Controls, ldap.ControlTypeManageDsaIT))
+	assert.Empty(t, req.Controls)
+
+	packet := ber.DecodePacket(NewControlDontUseCopy().Encode().Bytes())
+	require.Len(t, packet.Children, 2)
+	assert.Equal(t, ControlTypeDontUseCopy, packet.Children[0].Value)
+	assert.Equal(t, true, packet.Children[1].Value)
+}
+
+func TestNewControlMatchedValues(t *testing.T) {
+	control, err := NewControlMatchedValues("(proxyAddresses=SMTP:*)(mail=*@example.com)")
+	require.NoError(t, err)
+
+	packet := ber.DecodePacket(control.Encode().Bytes())
+	require.Len(t, packet.Children, 3)
+	assert.Equal(t, ControlTypeMatchedValues, packet.Children[0].Value)
+	filter := ber.DecodePacket(packet.Children[2].Data.Bytes())
+	require.Len(t, filter.Children, 2)
+	assert.Equal(t, ber.Tag(ldap.FilterSubstrings), filter.Children[0].Tag)
+
+	for _, invalid := range []string{"", "proxyAddresses=SMTP:*", "(&(a=b)(c=d))", "(!(a=b))", "(a=b"} {
+		_, err := NewControlMatchedValues(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestClient_SearchMatchedValues(t *testing.T) {
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		values := []string{"SMTP:fry@example.com", "smtp:philip@example.com", "X400:c=US;a= ;p=PlanetExpress;o=Crew;s=Fry;"}
+		// honor the control as a server would for "(proxyAddresses=SMTP:*)"
+		if ldap.FindControl(req.Controls, ControlTypeMatchedValues) != nil {
+			var matched []string
+			for _, value := range values {
+				if strings.HasPrefix(strings.ToUpper(value), "SMTP:") {
+					matched = append(matched, value)
+				}
+			}
+			values = matched
+		}
+		entry := &ldap.Entry{DN: fakeUser.DN, Attributes: []*ldap.EntryAttribute{{Name: "proxyAddresses", Values: values}}}
+		return &ldap.SearchResult{Entries: []*ldap.Entry{entry}}, nil
+	}}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	control, err := NewControlMatchedValues("(proxyAddresses=SMTP:*)")
+	require.NoError(t, err)
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", []string{"proxyAddresses"}, nil)
+	sr, err := lc.Search(req, control)
+	require.NoError(t, err)
+	require.Len(t, sr.Entries, 1)
+	assert.Equal(t, []string{"SMTP:fry@example.com", "smtp:philip@example.com"}, sr.Entries[0].GetAttributeValues("proxyAddresses"))
+}
+
+func TestClient_SearchLimits(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	config := fakeUserConfig()
+	config.SizeLimit = 100
+	config.TimeLimit = 1500 * time.Millisecond
+	lc := newFakeClient(t, config, conn)
+
+	_, err := lc.GetUserGroups("fry")
+	require.NoError(t, err)
+	_, err = lc.GetGroupMembers("cn=crew,ou=groups,dc=example,dc=com")
+	require.NoError(t, err)
+	_, err = lc.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=*)", nil, nil))
+	require.NoError(t, err)
+	require.Len(t, conn.searches, 4)
+	for _, req := range conn.searches {
+		assert.Equal(t, 100, req.SizeLimit, req.Filter)
+		assert.Equal(t, 2, req.TimeLimit, req.Filter)
+	}
+
+	// limits set on the request win
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 5, 1, false, "(uid=*)", nil, nil)
+	_, err = lc.Search(req)
+	require.NoError(t, err)
+	assert.Equal(t, 5, conn.searches[4].SizeLimit)
+	assert.Equal(t, 1, conn.searches[4].TimeLimit)
+}
+
+func TestClient_SearchNoLimits(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+
+	_, err := lc.GetUser("fry")
+	require.NoError(t, err)
+	assert.Equal(t, 0, conn.searches[0].SizeLimit)
+	assert.Equal(t, 0, conn.searches[0].TimeLimit)
+}
+
+func TestClient_SearchContext(t *testing.T) {
+	type ctxKey struct{}
+	var stats []OpStats
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+	lc.onOperation = func(s OpStats) { stats = append(stats, s) }
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+	_, err := lc.SearchContext(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, "request", stats[0].Context.Value(ctxKey{}))
+	assert.Equal(t, "dc=example,dc=com", stats[0].BaseDN)
+	assert.False(t, stats[0].NoConn)
+
+	// with the only connection checked out, the wait ends with the context
+	held, err := lc.searchPool.Get()
+	require.NoError(t, err)
+	defer held.Close()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = lc.SearchContext(ctx, req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	require.Len(t, stats, 2)
+	assert.True(t, stats[1].NoConn)
+}
+
+// sortingSearch answers with entries sorted as asked by a server-side sort
+// control, or a sort failure for attributes other than sn.
+func sortingSearch(sns ...string) func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		sr := &ldap.SearchResult{}
+		for _, sn := range sns {
+			sr.Entries = append(sr.Entries, &ldap.Entry{Attributes: []*ldap.EntryAttribute{{Name: "sn", Values: []string{sn}}}})
+		}
+		control, ok := ldap.FindControl(req.Controls, ControlTypeServerSideSort).(*ControlServerSideSort)
+		if !ok {
+			return sr, nil
+		}
+		key := control.Keys[0]
+		var result *ber.Packet
+		if key.Attribute == "sn" {
+			sort.Slice(sr.Entries, func(i, j int) bool {
+				less := sr.Entries[i].Attributes[0].Values[0] < sr.Entries[j].Attributes[0].Values[0]
+				return less != key.Reverse
+			})
+			result = encodeSortResult(ldap.LDAPResultSuccess, "")
+		} else {
+			result = encodeSortResult(ldap.LDAPResultInappropriateMatching, key.Attribute)
+		}
+		sr.Controls = append(sr.Controls, ldap.NewControlString(ControlTypeServerSideSortResult, false, string(result.Bytes())))
+		return sr, nil
+	}
+}
+
+func TestClient_SearchServerSideSort(t *testing.T) {
+	conn := &fakeConn{searchFn: sortingSearch("Zoidberg", "Fry", "Leela")}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(sn=*)", []string{"sn"}, nil)
+	sr, err := lc.Search(req, NewControlServerSideSort(SortKey{Attribute: "sn", Reverse: true}))
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range sr.Entries {
+		names = append(names, entry.Attributes[0].Values[0])
+	}
+	assert.Equal(t, []string{"Zoidberg", "Leela", "Fry"}, names)
+
+	_, err = lc.SearchAuto(req, NewControlServerSideSort(SortKey{Attribute: "jpegPhoto"}))
+	var sortErr *SortError
+	require.True(t, errors.As(err, &sortErr))
+	assert.Equal(t, uint16(ldap.LDAPResultInappropriateMatching), sortErr.Code)
+	assert.Equal(t, "jpegPhoto", sortErr.Attribute)
+}
+
+func TestControlServerSideSort_Encode(t *testing.T) {
+	packet := NewControlServerSideSort(SortKey{Attribute: "sn"}, SortKey{Attribute: "givenName", OrderingRule: "2.5.13.3", Reverse: true}).Encode()
+	require.Len(t, packet.Children, 2)
+	assert.Equal(t, ControlTypeServerSideSort, packet.Children[0].Value)
+
+	value, err := ber.DecodePacketErr(packet.Children[1].Data.Bytes())
+	require.NoError(t, err)
+	require.Len(t, value.Children, 2)
+	assert.Equal(t, "sn", value.Children[0].Children[0].Value)
+	require.Len(t, value.Children[1].Children, 3)
+	assert.Equal(t, "2.5.13.3", value.Children[1].Children[1].Data.String())
+}
+
+func TestClient_SearchBase(t *testing.T) {
+	conn := &fakeConn{searchFn: entriesResult(fakeUser)}
+	lc := newFakeClient(t, LdapConfig{Base: "dc=example,dc=com", SizeLimit: 50}, conn)
+
+	entries, err := lc.SearchBase("ou=people,dc=example,dc=com", ldap.ScopeSingleLevel, "(uid=fry)", []string{"cn"})
+	require.NoError(t, err)
+	assert.Equal(t, []*ldap.Entry{fakeUser}, entries)
+
+	require.Len(t, conn.searches, 1)
+	req := conn.searches[0]
+	assert.Equal(t, "ou=people,dc=example,dc=com", req.BaseDN)
+	assert.Equal(t, ldap.ScopeSingleLevel, req.Scope)
+	assert.Equal(t, "(uid=fry)", req.Filter)
+	assert.Equal(t, []string{"cn"}, req.Attributes)
+	assert.Equal(t, 50, req.SizeLimit)
+}
+
+func TestClient_SearchBasePages(t *testing.T) {
+	conn := &fakeConn{
+		searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+			return nil, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+		},
+		pagingFn: func(*ldap.SearchRequest, uint32) (*ldap.SearchResult, error) {
+			return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser, fakeUser}}, nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	entries, err := lc.SearchBase("dc=example,dc=com", ldap.ScopeBaseObject, "(objectClass=*)", nil)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	require.Len(t, conn.searches, 2)
+	assert.Equal(t, ldap.ScopeBaseObject, conn.searches[1].Scope)
+}
+
+func TestClient_Count(t *testing.T) {
+	tree := make([]*ldap.Entry, 1234)
+	for i := range tree {
+		tree[i] = &ldap.Entry{DN: fmt.Sprintf("uid=user%d,ou=people,dc=example,dc=com", i)}
+	}
+	pages := 0
+	conn := &fakeConn{
+		pagingFn: func(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+			assert.Equal(t, []string{"1.1"}, req.Attributes)
+			assert.Equal(t, 0, req.SizeLimit)
+			sr := &ldap.SearchResult{}
+			for start := 0; start < len(tree); start += int(pagingSize) {
+				end := start + int(pagingSize)
+				if end > len(tree) {
+					end = len(tree)
+				}
+				sr.Entries = append(sr.Entries, tree[start:end]...)
+				pages++
+			}
+			return sr, nil
+		},
+	}
+	lc := newFakeClient(t, LdapConfig{SizeLimit: 100}, conn)
+
+	count, err := lc.Count("ou=people,dc=example,dc=com", "(objectClass=person)")
+	require.NoError(t, err)
+	assert.Equal(t, 1234, count)
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, "(objectClass=person)", conn.searches[0].Filter)
+}
+
+func TestClient_SearchReferral(t *testing.T) {
+	conn := &fakeConn{searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		return &ldap.SearchResult{}, ldap.NewError(ldap.LDAPResultReferral, errors.New("no referral URL given"))
+	}}
+	lc := newFakeClient(t, LdapConfig{}, conn)
+
+	req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+	_, err := lc.Search(req)
+	var referralErr *ReferralError
+	require.True(t, errors.As(err, &referralErr))
+	assert.Empty(t, referralErr.URLs)
+	assert.Equal(t, "no referral URL given", referralErr.Msg)
+
+	conn.searchFn = func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	_, err = lc.Search(req)
+	assert.False(t, errors.Is(err, ErrReferral))
+}
@@ -0,0 +1,69 @@
+package pooldap
+
+import (
+	"sync"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Session is a dedicated connection bound as one user, for interactive work
+// that issues many operations under that identity. It lives outside the
+// pools: nothing else uses the connection and it is never rebound, so the
+// caller must Close it when done.
+type Session struct {
+	lc        *Client
+	conn      ldap.Client
+	closeOnce sync.Once
+}
+
+// NewSession dials a new connection, outside the pools, and binds it as dn.
+// Bind failures are returned as *BindError. An empty password is refused with
+// ErrInvalidCredentials unless Config.AllowEmptyPassword is set, as with
+// Authenticate.
+func (lc *Client) NewSession(dn, password string) (*Session, error) {
+	if password == "" && !lc.Config.AllowEmptyPassword {
+		return nil, ErrInvalidCredentials
+	}
+	if err := lc.checkSecureBind(password); err != nil {
+		return nil, err
+	}
+	conn, err := lc.dialWithRetries()
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Bind(dn, password); err != nil {
+		conn.Close()
+		return nil, newBindError(err)
+	}
+	return &Session{lc: lc, conn: conn}, nil
+}
+
+// Search runs searchRequest as the session's user. Controls, limits and
+// response controls are handled as with Client.Search.
+func (s *Session) Search(searchRequest *ldap.SearchRequest, controls ...ldap.Control) (*ldap.SearchResult, error) {
+	req := *searchRequest
+	s.lc.applyLimits(&req)
+	if len(controls) > 0 {
+		req.Controls = append(append([]ldap.Control(nil), searchRequest.Controls...), controls...)
+	}
+	sr, err := s.conn.Search(&req)
+	if err != nil {
+		return sr, err
+	}
+	return sr, checkSort(req.Controls, sr)
+}
+
+// Modify applies modifyRequest as the session's user. It is refused with
+// ErrReadOnly when Config.ReadOnly is set.
+func (s *Session) Modify(modifyRequest *ldap.ModifyRequest) error {
+	if s.lc.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	return s.conn.Modify(modifyRequest)
+}
+
+// Close ends the session, sending an Unbind if the connection supports it.
+// It is safe to call more than once.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() { unbindAndClose(s.conn) })
+}
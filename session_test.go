@@ -0,0 +1,66 @@
+package pooldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_NewSession(t *testing.T) {
+	var conns []*fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn := &fakeConn{searchFn: entriesResult(&ldap.Entry{DN: "uid=fry,ou=people,dc=example,dc=com"})}
+		conns = append(conns, conn)
+		return conn
+	}}
+	lc, err := NewClient(dialerTestConfig(), 0, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	session, err := lc.NewSession("uid=admin,dc=example,dc=com", "secret")
+	require.NoError(t, err)
+	require.Len(t, conns, 1)
+	conn := conns[0]
+
+	for i := 0; i < 3; i++ {
+		req := ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(uid=fry)", nil, nil)
+		sr, err := session.Search(req)
+		require.NoError(t, err)
+		assert.Len(t, sr.Entries, 1)
+	}
+	require.NoError(t, session.Modify(ldap.NewModifyRequest("uid=fry,ou=people,dc=example,dc=com")))
+
+	// one bind, every operation on the same connection, none through the pools
+	assert.Equal(t, []string{"uid=admin,dc=example,dc=com"}, conn.binds)
+	assert.Len(t, conn.searches, 3)
+	assert.Equal(t, []string{"modify"}, conn.writes)
+	assert.Equal(t, 1, dialer.dialCount())
+
+	session.Close()
+	session.Close()
+	assert.True(t, conn.isClosed())
+}
+
+func TestClient_NewSessionBindError(t *testing.T) {
+	var conn *fakeConn
+	dialer := &fakeDialer{conn: func() *fakeConn {
+		conn = &fakeConn{bindFn: func(string, string) error {
+			return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+		}}
+		return conn
+	}}
+	lc, err := NewClient(dialerTestConfig(), 0, 1, 0, 1, time.Hour, WithDialer(dialer))
+	require.NoError(t, err)
+	defer lc.Close()
+
+	_, err = lc.NewSession("uid=admin,dc=example,dc=com", "wrong")
+	var bindErr *BindError
+	assert.ErrorAs(t, err, &bindErr)
+	assert.True(t, conn.isClosed())
+
+	_, err = lc.NewSession("uid=admin,dc=example,dc=com", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
@@ -0,0 +1,131 @@
+package pooldap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	// ControlTypeServerSideSort is the server-side sort request control
+	// (RFC 2891).
+	ControlTypeServerSideSort = "1.2.840.113556.1.4.473"
+	// ControlTypeServerSideSortResult is its response control.
+	ControlTypeServerSideSortResult = "1.2.840.113556.1.4.474"
+)
+
+// SortKey is one attribute to sort search results by.
+type SortKey struct {
+	Attribute string
+	// OrderingRule is an optional matching rule OID used to compare values.
+	OrderingRule string
+	Reverse      bool
+}
+
+// ControlServerSideSort asks the server to sort the results of a search by
+// Keys, the first key being the most significant. Pass it to Client.Search
+// or Client.SearchAuto, which then return a *SortError if the server could
+// not sort, e.g. by an attribute without an ordering rule.
+type ControlServerSideSort struct {
+	Keys []SortKey
+}
+
+// NewControlServerSideSort returns a non-critical sort control for keys, so
+// that a server that can't sort reports why in the response control instead
+// of refusing the search.
+func NewControlServerSideSort(keys ...SortKey) *ControlServerSideSort {
+	return &ControlServerSideSort{Keys: keys}
+}
+
+func (c *ControlServerSideSort) GetControlType() string {
+	return ControlTypeServerSideSort
+}
+
+func (c *ControlServerSideSort) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ControlTypeServerSideSort, "Control Type (Server-Side Sort)"))
+
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Server-Side Sort)")
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Key List")
+	for _, key := range c.Keys {
+		seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Key")
+		seq.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, key.Attribute, "Attribute Type"))
+		if key.OrderingRule != "" {
+			seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, key.OrderingRule, "Ordering Rule"))
+		}
+		if key.Reverse {
+			seq.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, true, "Reverse Order"))
+		}
+		list.AppendChild(seq)
+	}
+	value.AppendChild(list)
+	packet.AppendChild(value)
+	return packet
+}
+
+func (c *ControlServerSideSort) String() string {
+	keys := make([]string, len(c.Keys))
+	for i, key := range c.Keys {
+		keys[i] = key.Attribute
+		if key.Reverse {
+			keys[i] = "-" + keys[i]
+		}
+	}
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: false  Keys: %s", "Server-Side Sort", ControlTypeServerSideSort, strings.Join(keys, ","))
+}
+
+// encodeSortResult encodes the value of a sort response control.
+func encodeSortResult(code uint16, attribute string) *ber.Packet {
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Result")
+	seq.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Sort Result Code"))
+	if attribute != "" {
+		seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, attribute, "Attribute Type"))
+	}
+	return seq
+}
+
+// checkSort returns a *SortError if requestControls asked for sorting and a
+// response control in sr reports that the server couldn't sort.
+func checkSort(requestControls []ldap.Control, sr *ldap.SearchResult) error {
+	if _, ok := ldap.FindControl(requestControls, ControlTypeServerSideSort).(*ControlServerSideSort); !ok || sr == nil {
+		return nil
+	}
+	for _, control := range sr.Controls {
+		if control.GetControlType() != ControlTypeServerSideSortResult {
+			continue
+		}
+		if err := decodeSortResult(control); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSortResult reads a sort response control, which the ldap package
+// doesn't know and delivers as an *ldap.ControlString holding the encoded
+// value.
+func decodeSortResult(control ldap.Control) error {
+	c, ok := control.(*ldap.ControlString)
+	if !ok {
+		return errors.Errorf("unexpected sort response control %T", control)
+	}
+	packet, err := ber.DecodePacketErr([]byte(c.ControlValue))
+	if err != nil {
+		return errors.Wrap(err, "decoding sort response control")
+	}
+	if len(packet.Children) == 0 {
+		return errors.New("malformed sort response control")
+	}
+	code, _ := packet.Children[0].Value.(int64)
+	if code == ldap.LDAPResultSuccess {
+		return nil
+	}
+	sortErr := &SortError{Code: uint16(code)}
+	if len(packet.Children) > 1 {
+		sortErr.Attribute = packet.Children[1].Data.String()
+	}
+	return sortErr
+}
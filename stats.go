@@ -0,0 +1,81 @@
+package pooldap
+
+import (
+	"context"
+	"time"
+)
+
+// OpStats describes a single operation performed by the Client.
+type OpStats struct {
+	// Operation is "search" or "bind".
+	Operation string
+	PoolType  PoolType
+	// WaitDuration is the time spent acquiring a connection from the pool.
+	WaitDuration time.Duration
+	// WireDuration is the time spent on the LDAP operation itself.
+	WireDuration time.Duration
+	Err          error
+	// NoConn is set when Err comes from acquiring the connection, in which
+	// case no LDAP operation was sent.
+	NoConn bool
+	// Start is when the operation started waiting for a connection.
+	Start time.Time
+	// BaseDN is the base of a search, empty for binds.
+	BaseDN string
+	// Context is the context passed to a context-aware method such as
+	// SearchContext, context.Background() for searches without one and nil
+	// for binds.
+	Context context.Context
+}
+
+// PoolStats returns the counters of the search and bind pools.
+func (lc *Client) PoolStats() (search, bind PoolStats) {
+	return lc.searchPool.Stats(), lc.bindPool.Stats()
+}
+
+// opTimer measures an operation for the OnOperation hook.
+type opTimer struct {
+	lc       *Client
+	stats    OpStats
+	start    time.Time
+	acquired time.Time
+}
+
+func (lc *Client) startOp(operation string, poolType PoolType) *opTimer {
+	start := time.Now()
+	return &opTimer{lc: lc, stats: OpStats{Operation: operation, PoolType: poolType, Start: start}, start: start}
+}
+
+// startSearch starts timing a search of baseDN on behalf of ctx.
+func (lc *Client) startSearch(ctx context.Context, baseDN string) *opTimer {
+	t := lc.startOp("search", SharedPool)
+	t.stats.BaseDN = baseDN
+	t.stats.Context = ctx
+	return t
+}
+
+// connAcquired marks the end of the wait for a pooled connection.
+func (t *opTimer) connAcquired() {
+	t.acquired = time.Now()
+	t.stats.WaitDuration = t.acquired.Sub(t.start)
+}
+
+// getFailed reports an operation that failed to acquire a connection.
+func (t *opTimer) getFailed(err error) {
+	t.stats.NoConn = true
+	t.done(err)
+}
+
+// done reports the operation to the hook, if one is set.
+func (t *opTimer) done(err error) {
+	if t.lc.onOperation == nil {
+		return
+	}
+	if t.acquired.IsZero() {
+		t.connAcquired()
+	} else {
+		t.stats.WireDuration = time.Since(t.acquired)
+	}
+	t.stats.Err = err
+	t.lc.onOperation(t.stats)
+}
@@ -0,0 +1,32 @@
+package pooldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_OperationHook(t *testing.T) {
+	conn := &fakeConn{searchFn: func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+		time.Sleep(20 * time.Millisecond)
+		return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+	}}
+	lc := newFakeClient(t, fakeUserConfig(), conn)
+	var stats []OpStats
+	WithOperationHook(func(s OpStats) { stats = append(stats, s) })(lc)
+
+	_, _, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, "search", stats[0].Operation)
+	assert.True(t, stats[0].WireDuration >= 20*time.Millisecond)
+	assert.True(t, stats[0].WaitDuration < 20*time.Millisecond)
+
+	assert.Equal(t, "bind", stats[1].Operation)
+	assert.Equal(t, BindPool, stats[1].PoolType)
+	assert.NoError(t, stats[1].Err)
+}
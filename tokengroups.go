@@ -0,0 +1,77 @@
+package pooldap
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// tokenGroupsKey is the user attribute under which Authenticate returns the
+// groups resolved from tokenGroups when Config.TokenGroups is set.
+const tokenGroupsKey = "tokenGroups"
+
+// tokenGroups reads the tokenGroups of the entry at dn on conn, which must be
+// bound as that user, and resolves the SIDs to a map of group name to group
+// DN. Active Directory computes tokenGroups from every group in the user's
+// security token, including nested and primary groups, so unlike memberOf it
+// is the effective membership. SIDs of groups outside the group base, such as
+// foreign security principals, are left out.
+func (lc *Client) tokenGroups(conn *PoolConn, dn string) (groups map[string]string, err error) {
+	// tokenGroups is constructed and only returned by base searches
+	sr, err := conn.Search(ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, lc.Config.timeLimit(), false,
+		"(objectClass=*)",
+		[]string{"tokenGroups"},
+		nil,
+	))
+	if err != nil {
+		return
+	}
+	if len(sr.Entries) != 1 {
+		err = ErrNotFound
+		return
+	}
+
+	groups = make(map[string]string)
+	sids := sr.Entries[0].GetRawAttributeValues("tokenGroups")
+	if len(sids) == 0 {
+		return
+	}
+	var filter strings.Builder
+	filter.WriteString("(|")
+	for _, sid := range sids {
+		filter.WriteString("(objectSid=" + escapeBinary(sid) + ")")
+	}
+	filter.WriteString(")")
+
+	sr, err = conn.SearchWithPaging(ldap.NewSearchRequest(
+		lc.Config.groupBase(),
+		searchScope(lc.Config.GroupSearchScope), ldap.NeverDerefAliases, 0, lc.Config.timeLimit(), false,
+		filter.String(),
+		[]string{lc.Config.GroupNameAttribute},
+		nil,
+	), autoPageSize)
+	if err != nil {
+		return
+	}
+	for _, entry := range sr.Entries {
+		groupDn, err := NormalizeDN(entry.DN)
+		if err != nil {
+			groupDn = entry.DN
+		}
+		groups[entry.GetAttributeValue(lc.Config.GroupNameAttribute)] = groupDn
+	}
+	return
+}
+
+// escapeBinary escapes every byte of value for use in a search filter, the
+// form needed to match binary attributes such as objectSid.
+func escapeBinary(value []byte) string {
+	var b strings.Builder
+	for _, c := range value {
+		fmt.Fprintf(&b, "\\%02x", c)
+	}
+	return b.String()
+}
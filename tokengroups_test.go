@@ -0,0 +1,67 @@
+package pooldap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+func TestClient_AuthenticateTokenGroups(t *testing.T) {
+	domainUsers := []byte{0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x15, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x01, 0x02, 0x00, 0x00}
+	deliveryCrew := []byte{0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x15, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x51, 0x04, 0x00, 0x00}
+	groups := map[string]*ldap.Entry{
+		escapeBinary(domainUsers): {
+			DN:         "CN=Domain Users,CN=Users,DC=example,DC=com",
+			Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"Domain Users"}}},
+		},
+		escapeBinary(deliveryCrew): {
+			DN:         "CN=Delivery Crew,OU=Groups,DC=example,DC=com",
+			Attributes: []*ldap.EntryAttribute{{Name: "cn", Values: []string{"Delivery Crew"}}},
+		},
+	}
+
+	conn := &fakeConn{searchFn: func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		switch {
+		case req.Scope == ldap.ScopeBaseObject:
+			return &ldap.SearchResult{Entries: []*ldap.Entry{{
+				DN: req.BaseDN,
+				Attributes: []*ldap.EntryAttribute{{
+					Name:       "tokenGroups",
+					Values:     []string{string(domainUsers), string(deliveryCrew)},
+					ByteValues: [][]byte{domainUsers, deliveryCrew},
+				}},
+			}}}, nil
+		case strings.Contains(req.Filter, "objectSid"):
+			sr := &ldap.SearchResult{}
+			for sid, group := range groups {
+				if strings.Contains(req.Filter, "(objectSid="+sid+")") {
+					sr.Entries = append(sr.Entries, group)
+				}
+			}
+			return sr, nil
+		default:
+			return &ldap.SearchResult{Entries: []*ldap.Entry{fakeUser}}, nil
+		}
+	}}
+	config := fakeUserConfig()
+	config.TokenGroups = true
+	lc := newFakeClient(t, config, conn)
+
+	valid, user, err := lc.Authenticate("fry", "fry")
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, map[string]string{
+		"Domain Users":  "cn=domain users,cn=users,dc=example,dc=com",
+		"Delivery Crew": "cn=delivery crew,ou=groups,dc=example,dc=com",
+	}, user["tokenGroups"])
+	require.Len(t, conn.searches, 3)
+	assert.Equal(t, fakeUser.DN, conn.searches[1].BaseDN)
+	assert.Equal(t, []string{"tokenGroups"}, conn.searches[1].Attributes)
+}
+
+func TestEscapeBinary(t *testing.T) {
+	assert.Equal(t, `\01\05\00\ff`, escapeBinary([]byte{0x01, 0x05, 0x00, 0xff}))
+}
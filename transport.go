@@ -0,0 +1,302 @@
+package pooldap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// firstMuxMessageID is the message ID muxConn numbers its own requests from.
+// The ldap package counts up from 1, so the two never meet.
+const firstMuxMessageID = 1 << 30
+
+// muxConn sits between an *ldap.Conn and the network connection, so that
+// stateConn can send the requests the ldap package can't, e.g. a Cancel, a
+// modify with controls or a SASL bind, and learn the message IDs of those it
+// sends. Responses to its own requests are taken off the wire; everything
+// else reaches the *ldap.Conn as it came.
+type muxConn struct {
+	// wmu serializes writes, which are whole LDAP messages
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	conn    net.Conn
+	nextID  int64
+	pending map[int64]*muxRequest
+	// searches receives the message ID of the next search request the
+	// *ldap.Conn writes, see watchSearch
+	searches chan int64
+	closed   bool
+
+	// the *ldap.Conn reads what isn't ours from the pipe
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+// muxRequest waits for the response to one of muxConn's own requests.
+type muxRequest struct {
+	id       int64
+	response chan *ber.Packet
+	// hold, if set, keeps the reader from reading on until it is closed,
+	// e.g. while StartTLS swaps the connection underneath
+	hold chan struct{}
+}
+
+func newMuxConn(conn net.Conn) *muxConn {
+	pr, pw := io.Pipe()
+	m := &muxConn{conn: conn, nextID: firstMuxMessageID, pending: make(map[int64]*muxRequest), pr: pr, pw: pw}
+	go m.read()
+	return m
+}
+
+// read takes LDAP messages off the connection until it fails, handing those
+// answering muxConn's requests to their waiters and the rest to the pipe.
+func (m *muxConn) read() {
+	var (
+		raw    bytes.Buffer
+		reader *bufio.Reader
+		conn   net.Conn
+	)
+	for {
+		m.mu.Lock()
+		if m.conn != conn {
+			conn = m.conn
+			reader = bufio.NewReader(conn)
+		}
+		m.mu.Unlock()
+
+		raw.Reset()
+		packet, err := ber.ReadPacket(io.TeeReader(reader, &raw))
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		if len(packet.Children) < 2 {
+			m.fail(errors.New("ldap: malformed message"))
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		m.mu.Lock()
+		req, ours := m.pending[id]
+		delete(m.pending, id)
+		m.mu.Unlock()
+		if !ours {
+			if _, err := m.pw.Write(raw.Bytes()); err != nil {
+				m.fail(err)
+				return
+			}
+			continue
+		}
+		req.response <- packet
+		if req.hold != nil {
+			<-req.hold
+		}
+	}
+}
+
+// fail closes the connection after a read error, failing whatever waits.
+func (m *muxConn) fail(err error) {
+	m.pw.CloseWithError(err)
+	m.Close()
+}
+
+// request sends op, with controls if there are any, as a message of its own
+// and returns the protocol op of the response. timeout bounds the wait
+// unless it is zero.
+func (m *muxConn) request(op *ber.Packet, controls []ldap.Control, timeout time.Duration) (*ber.Packet, error) {
+	m.wmu.Lock()
+	req, err := m.send(m.current(), op, controls, nil)
+	m.wmu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.await(req, timeout)
+}
+
+// send writes op to conn as a message with a new message ID, registering
+// the request for its response. The caller holds wmu.
+func (m *muxConn) send(conn net.Conn, op *ber.Packet, controls []ldap.Control, hold chan struct{}) (*muxRequest, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+	}
+	req := &muxRequest{id: m.nextID, response: make(chan *ber.Packet, 1), hold: hold}
+	m.nextID++
+	m.pending[req.id] = req
+	m.mu.Unlock()
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, req.id, "MessageID"))
+	packet.AppendChild(op)
+	if len(controls) > 0 {
+		encoded := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			encoded.AppendChild(control.Encode())
+		}
+		packet.AppendChild(encoded)
+	}
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		m.forget(req.id)
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return req, nil
+}
+
+// await returns the protocol op of the response to req.
+func (m *muxConn) await(req *muxRequest, timeout time.Duration) (*ber.Packet, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case response, ok := <-req.response:
+		if !ok {
+			return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+		}
+		return response.Children[1], nil
+	case <-expired:
+		m.forget(req.id)
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: response timed out"))
+	}
+}
+
+// forget stops waiting for the response to id.
+func (m *muxConn) forget(id int64) {
+	m.mu.Lock()
+	delete(m.pending, id)
+	m.mu.Unlock()
+}
+
+// watchSearch returns a channel receiving the message ID of the next search
+// request the *ldap.Conn writes.
+func (m *muxConn) watchSearch() <-chan int64 {
+	ids := make(chan int64, 1)
+	m.mu.Lock()
+	m.searches = ids
+	m.mu.Unlock()
+	return ids
+}
+
+// startTLS upgrades the connection with the StartTLS extended operation,
+// handshaking underneath the *ldap.Conn, which keeps reading and writing
+// plain LDAP messages.
+func (m *muxConn) startTLS(config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, "1.3.6.1.4.1.1466.20037", "TLS Extended Command"))
+
+	// nothing is written or read while the connection is swapped
+	hold := make(chan struct{})
+	defer close(hold)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	raw := m.current()
+	req, err := m.send(raw, request, nil, hold)
+	if err != nil {
+		return nil, err
+	}
+	response, err := m.await(req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(response); err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.Handshake(); err != nil {
+		m.Close()
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.Errorf("TLS handshake failed (%v)", err))
+	}
+	m.mu.Lock()
+	m.conn = conn
+	m.mu.Unlock()
+	return conn, nil
+}
+
+func (m *muxConn) Read(b []byte) (int, error) {
+	return m.pr.Read(b)
+}
+
+// Write sends a message of the *ldap.Conn, noting its message ID if it is a
+// search watchSearch waits for.
+func (m *muxConn) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	searches := m.searches
+	m.mu.Unlock()
+	if searches != nil {
+		if packet := ber.DecodePacket(b); len(packet.Children) > 1 && packet.Children[1].Tag == ldap.ApplicationSearchRequest {
+			m.mu.Lock()
+			m.searches = nil
+			m.mu.Unlock()
+			id, _ := packet.Children[0].Value.(int64)
+			searches <- id
+		}
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.current().Write(b)
+}
+
+// Close closes the connection, failing the requests still waiting for a
+// response.
+func (m *muxConn) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	conn := m.conn
+	for id, req := range m.pending {
+		close(req.response)
+		delete(m.pending, id)
+	}
+	m.mu.Unlock()
+	m.pr.Close()
+	return conn.Close()
+}
+
+func (m *muxConn) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *muxConn) current() net.Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+func (m *muxConn) LocalAddr() net.Addr                { return m.current().LocalAddr() }
+func (m *muxConn) RemoteAddr() net.Addr               { return m.current().RemoteAddr() }
+func (m *muxConn) SetDeadline(t time.Time) error      { return m.current().SetDeadline(t) }
+func (m *muxConn) SetReadDeadline(t time.Time) error  { return m.current().SetReadDeadline(t) }
+func (m *muxConn) SetWriteDeadline(t time.Time) error { return m.current().SetWriteDeadline(t) }
+
+// resultError returns the error an LDAPResult response op carries, or nil
+// for success.
+func resultError(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: malformed response"))
+	}
+	code, _ := op.Children[0].Value.(int64)
+	if code == ldap.LDAPResultSuccess {
+		return nil
+	}
+	message, _ := op.Children[2].Value.(string)
+	return ldap.NewError(uint8(code), errors.New(message))
+}
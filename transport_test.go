@@ -0,0 +1,130 @@
+package pooldap
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// ldapServer is a scripted directory at the other end of a stateConn,
+// answering each request message with handle.
+type ldapServer struct {
+	conn   net.Conn
+	handle func(s *ldapServer, request *ber.Packet)
+
+	mu       sync.Mutex
+	requests []*ber.Packet
+}
+
+// serveLDAP returns a stateConn, as the built-in dialers return them, talking
+// to an ldapServer over a pipe.
+func serveLDAP(t *testing.T, handle func(s *ldapServer, request *ber.Packet)) (*stateConn, *ldapServer) {
+	client, server := net.Pipe()
+	s := &ldapServer{conn: server, handle: handle}
+	go s.serve()
+	conn := newStateConn(client, "ldap.example.com:389")
+	t.Cleanup(conn.Close)
+	return conn, s
+}
+
+func (s *ldapServer) serve() {
+	defer s.conn.Close()
+	for {
+		request, err := ber.ReadPacket(s.conn)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, request)
+		s.mu.Unlock()
+		s.handle(s, request)
+	}
+}
+
+// received returns the request messages read so far.
+func (s *ldapServer) received() []*ber.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ber.Packet(nil), s.requests...)
+}
+
+// reply sends op as the response to the message with id.
+func (s *ldapServer) reply(id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	_, _ = s.conn.Write(packet.Bytes())
+}
+
+// messageID and protocolOp take a request message apart.
+func messageID(request *ber.Packet) int64        { return request.Children[0].Value.(int64) }
+func protocolOp(request *ber.Packet) *ber.Packet { return request.Children[1] }
+
+// ldapResult returns an LDAPResult response op with tag.
+func ldapResult(tag ber.Tag, code int, message string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "diagnosticMessage"))
+	return op
+}
+
+// searchEntry returns a search result entry op for dn without attributes.
+func searchEntry(dn string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Object Name"))
+	op.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes"))
+	return op
+}
+
+// answerSearch answers a search request with an entry at its base.
+func answerSearch(s *ldapServer, request *ber.Packet) {
+	base := protocolOp(request).Children[0].Value.(string)
+	s.reply(messageID(request), searchEntry(base))
+	s.reply(messageID(request), ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""))
+}
+
+func TestStateConn_Mux(t *testing.T) {
+	conn, server := serveLDAP(t, func(s *ldapServer, request *ber.Packet) {
+		switch protocolOp(request).Tag {
+		case ldap.ApplicationSearchRequest:
+			answerSearch(s, request)
+		case ldap.ApplicationExtendedRequest:
+			s.reply(messageID(request), ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform, "not now"))
+		}
+	})
+
+	// requests of the ldap package and of the muxConn share the connection
+	sr, err := conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+	require.NoError(t, err)
+	require.Len(t, sr.Entries, 1)
+	_, err = conn.mux.request(NewCancelRequest(1), nil, time.Second)
+	require.NoError(t, err)
+	err = conn.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform))
+	_, ok := conn.TLSConnectionState()
+	assert.False(t, ok)
+	sr, err = conn.Search(ldap.NewSearchRequest("ou=people,dc=example,dc=com", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ou=people,dc=example,dc=com", sr.Entries[0].DN)
+
+	requests := server.received()
+	require.Len(t, requests, 4)
+	assert.Less(t, messageID(requests[0]), int64(firstMuxMessageID))
+	assert.GreaterOrEqual(t, messageID(requests[1]), int64(firstMuxMessageID))
+	assert.GreaterOrEqual(t, messageID(requests[2]), int64(firstMuxMessageID))
+	assert.Less(t, messageID(requests[3]), int64(firstMuxMessageID))
+
+	// closing fails what still waits
+	conn.Close()
+	_, err = conn.mux.request(NewCancelRequest(1), nil, time.Second)
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.ErrorNetwork))
+	assert.True(t, conn.closed())
+}